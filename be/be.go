@@ -1,30 +1,63 @@
 // Simple HTTP server for evaluating AFE.
 //
 // Listens on each service address in the config. Assumes that all the
-// addresses and ports are listenable on the current host.
+// addresses and ports (or Unix domain sockets) are listenable on the
+// current host.
+//
+// Optionally serves health checks over HTTP and gRPC, ready once every
+// address is being listened on.
 package main
 
 import (
 	"afe/config"
+	"afe/health"
+	"afe/logging"
+	"context"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
 )
 
 var ProxyConfig config.ProxyConfig
 var configpath = flag.String("config", "config.yaml", "full path to config file")
+var healthListen = flag.String("health-listen", "", "host:port to serve /livez and /readyz on, disabled if empty")
+var grpcHealthListen = flag.String("grpc-health-listen", "", "host:port to serve the gRPC health service on, disabled if empty")
+
+// listening counts the addresses being listened on.
+var listening atomic.Int64
 
 func main() {
+	flag.Parse()
+
 	if err := config.ParseConfigFromFile(*configpath, &ProxyConfig); err != nil {
-		log.Fatal(err)
+		logging.Fatal("loading configuration failed", "err", err)
+	}
+
+	var level slog.LevelVar
+	if err := logging.Setup(ProxyConfig.Logging, &level); err != nil {
+		logging.Fatal("configuring logging failed", "err", err)
 	}
+	slog.Debug("configuration loaded", "config", fmt.Sprintf("%+v", ProxyConfig))
 
-	log.Printf("%+v", ProxyConfig)
+	// The proxy passes each request's ID in this header
+	requestIDHeader := ProxyConfig.RequestID.HeaderName()
+
+	want := 0
+	for _, service := range ProxyConfig.Proxy.Services {
+		want += len(service.Hosts)
+	}
+	serveHealth(want)
 
 	var wg sync.WaitGroup
 
@@ -33,20 +66,34 @@ func main() {
 			wg.Add(1)
 
 			hostport := host.String() // Avoid capturing host variable in go func()
+			socket := host.SocketPath()
 			go func() {
-				log.Printf("HTTP server starting on %s", hostport)
+				slog.Info("HTTP server starting", "address", hostport)
 
 				handler := func(w http.ResponseWriter, req *http.Request) {
+					ctx := logging.NewContext(req.Context(), "request_id", req.Header.Get(requestIDHeader))
 					time.Sleep(time.Duration(rand.Intn(300)) * time.Millisecond)
-					log.Printf("%s handling request for %s", hostport, req.URL)
+					slog.InfoContext(ctx, "handling request", "address", hostport, "url", req.URL.String())
 					_, err := io.WriteString(w, fmt.Sprintf("service: %s, addr: %s",
 						service.Name, hostport))
 					if err != nil {
-						log.Fatal(err)
+						slog.WarnContext(ctx, "writing response failed", "address", hostport, "err", err)
 					}
 				}
 
-				log.Fatal(http.ListenAndServe(hostport, http.HandlerFunc(handler)))
+				network, address := "tcp", hostport
+				if socket != "" {
+					os.Remove(socket) // Left behind by a previous run
+					network, address = "unix", socket
+				}
+				l, err := net.Listen(network, address)
+				if err != nil {
+					logging.Fatal("listening failed", "address", address, "err", err)
+				}
+				listening.Add(1)
+
+				err = http.Serve(l, http.HandlerFunc(handler))
+				logging.Fatal("serving failed", "address", address, "err", err)
 				wg.Done() // NOTREACHED
 			}()
 		}
@@ -54,3 +101,51 @@ func main() {
 
 	wg.Wait()
 }
+
+// serveHealth serves the health checks on the addresses given by the
+// flags, if any. The server is ready once it is listening on want
+// addresses.
+func serveHealth(want int) {
+	liveness := health.NewRegistry()
+	liveness.MustRegister(health.Check{
+		Name: "ping",
+		Func: func(context.Context) error { return nil },
+	})
+
+	readiness := health.NewRegistry()
+	readiness.MustRegister(health.Check{
+		Name: "listening",
+		Func: func(context.Context) error {
+			if n := listening.Load(); n < int64(want) {
+				return errors.Errorf("listening on %d of %d addresses", n, want)
+			}
+			return nil
+		},
+	})
+
+	if *healthListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /livez", health.Handler(liveness))
+		mux.Handle("GET /readyz", health.Handler(readiness))
+		go func() {
+			err := http.ListenAndServe(*healthListen, mux)
+			logging.Fatal("serving health checks failed", "address", *healthListen, "err", err)
+		}()
+	}
+
+	if *grpcHealthListen != "" {
+		l, err := net.Listen("tcp", *grpcHealthListen)
+		if err != nil {
+			logging.Fatal("listening failed", "address", *grpcHealthListen, "err", err)
+		}
+		s := grpc.NewServer()
+		health.NewGRPCServer(map[string]*health.Registry{
+			"":         readiness,
+			"liveness": liveness,
+		}).Register(s)
+		go func() {
+			err := s.Serve(l)
+			logging.Fatal("serving gRPC health checks failed", "address", *grpcHealthListen, "err", err)
+		}()
+	}
+}
@@ -3,57 +3,589 @@
 package config
 
 import (
-	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
 
+// unixScheme is the prefix of an Address that names a Unix domain socket.
+const unixScheme = "unix://"
+
 // A host:port pair for a service.
+//
+// Address may be an IP address, a DNS name (which the proxy resolves and
+// periodically re-resolves), or a Unix domain socket written as
+// "unix:///path/to/socket", in which case Port is unused.
+//
+// Weight is the host's share of the service's requests relative to the
+// other hosts, 1 if not set. It is unused where a HostPort is not a
+// service's host.
 type HostPort struct {
-	Address string
-	Port    int
+	Address string `json:"address"`
+	Port    int    `json:"port,omitempty"`
+	Weight  int    `json:"weight,omitempty"`
 }
 
-// String returns a "host:port" string for the HostPort.
+// String returns a "host:port" string for the HostPort, or the
+// "unix:///path" address if it is a Unix domain socket.
 func (hp HostPort) String() string {
-	return fmt.Sprintf("%s:%d", hp.Address, hp.Port)
+	if hp.IsUnix() {
+		return hp.Address
+	}
+	return net.JoinHostPort(hp.Address, strconv.Itoa(hp.Port))
+}
+
+// IsUnix returns true if the HostPort is a Unix domain socket.
+func (hp HostPort) IsUnix() bool {
+	return strings.HasPrefix(hp.Address, unixScheme)
+}
+
+// SocketPath returns the filesystem path of a Unix domain socket
+// HostPort, or the empty string if it is not one.
+func (hp HostPort) SocketPath() string {
+	if !hp.IsUnix() {
+		return ""
+	}
+	return strings.TrimPrefix(hp.Address, unixScheme)
+}
+
+// IsHostname returns true if the HostPort's address is a DNS name that
+// must be resolved, rather than an IP address or a Unix domain socket.
+func (hp HostPort) IsHostname() bool {
+	return hp.Address != "" && !hp.IsUnix() && net.ParseIP(hp.Address) == nil
+}
+
+// Discovery source types.
+const (
+	// DiscoveryDNSSRV discovers hosts from the SRV records for Name.
+	DiscoveryDNSSRV = "dns-srv"
+	// DiscoveryDNS discovers hosts from the A and AAAA records for Name,
+	// each listening on Port.
+	DiscoveryDNS = "dns"
+	// DiscoveryKubernetes discovers hosts from the EndpointSlices of the
+	// Kubernetes Service Name in Namespace, using the port named
+	// PortName.
+	DiscoveryKubernetes = "kubernetes"
+	// DiscoveryFile discovers hosts from the JSON or YAML hosts file at
+	// Path, re-reading it when it changes.
+	DiscoveryFile = "file"
+)
+
+// A Discovery describes a dynamic source of hosts for a service. Polled
+// sources are checked every Interval, watched sources as they change, and
+// the results replace the service's hosts. If the source fails the last
+// known hosts are kept.
+type Discovery struct {
+	Type      string        `json:"type"`
+	Name      string        `json:"name,omitempty"`
+	Port      int           `json:"port,omitempty"`
+	Interval  time.Duration `json:"interval,omitempty"`
+	Namespace string        `json:"namespace,omitempty"`
+	PortName  string        `yaml:"portName" json:"portName,omitempty"`
+	Path      string        `json:"path,omitempty"`
+}
+
+// A hostsFile is the content of a DiscoveryFile hosts file.
+type hostsFile struct {
+	Hosts []HostPort
+}
+
+// A Readiness describes how a service affects the proxy's readiness. The
+// proxy is only ready if each Critical service has at least
+// MinHealthyHosts healthy hosts, 1 if not set.
+type Readiness struct {
+	Critical        bool `json:"critical,omitempty"`
+	MinHealthyHosts int  `yaml:"minHealthyHosts" json:"minHealthyHosts,omitempty"`
+}
+
+// A ServiceAccessLog configures how a service's requests are recorded in
+// the access log. SampleRatio is the fraction of requests that are
+// logged, 1 if not set, though server errors are always logged. Redact
+// lists the AccessLogRedactable fields whose values are replaced.
+type ServiceAccessLog struct {
+	SampleRatio float64  `yaml:"sampleRatio" json:"sampleRatio,omitempty"`
+	Redact      []string `json:"redact,omitempty"`
+}
+
+// DefaultSLOWindow is the window an SLO is measured over if the
+// configuration doesn't set one, and MinSLOWindow the shortest it can be,
+// the longest window its burn rate alerts look at.
+const (
+	DefaultSLOWindow = 30 * 24 * time.Hour
+	MinSLOWindow     = 3 * 24 * time.Hour
+)
+
+// An SLO is a service's service level objectives, measured over Window,
+// DefaultSLOWindow if not set. Availability is the fraction of requests,
+// e.g., 0.999, that must not fail with a server error. Latency is the
+// fraction of requests that must be handled within a threshold. Either
+// may be left out.
+type SLO struct {
+	Availability float64       `json:"availability,omitempty"`
+	Latency      *LatencySLO   `json:"latency,omitempty"`
+	Window       time.Duration `json:"window,omitempty"`
+}
+
+// A LatencySLO is an objective that a Percentile of requests, e.g., 0.99,
+// are handled within Threshold.
+type LatencySLO struct {
+	Threshold  time.Duration `json:"threshold"`
+	Percentile float64       `json:"percentile"`
 }
 
 // A service consists of a name, a domain, and an array of
-// host:port pairs that provide that service.
+// host:port pairs that provide that service. The hosts may instead be
+// found dynamically from a Discovery source.
+//
+// RegionServices sends requests from clients in a region, found in the
+// Geo database, to the backends of another service, named by the map's
+// value. A region is a country or country-subdivision code, as in Geo,
+// and the most specific matching region is used.
+//
+// Requests that take longer than SlowThreshold are kept in the Capture
+// log, if there is one. If it isn't set only failed requests are kept.
+//
+// ACL restricts the clients the service's requests are accepted from, as
+// well as the proxy's ACL.
 type Service struct {
-	Name   string
-	Domain string
-	Hosts  []HostPort
+	Name      string            `json:"name"`
+	Domain    string            `json:"domain"`
+	Hosts     []HostPort        `json:"hosts,omitempty"`
+	Discovery *Discovery        `json:"discovery,omitempty"`
+	Readiness Readiness         `json:"readiness"`
+	AccessLog *ServiceAccessLog `yaml:"accessLog" json:"accessLog,omitempty"`
+	// RegionServices maps a region to the service its requests are sent to
+	RegionServices map[string]string `yaml:"regionServices" json:"regionServices,omitempty"`
+	SLO            *SLO              `yaml:"slo" json:"slo,omitempty"`
+	// SlowThreshold is how long a request can take before it is captured
+	SlowThreshold time.Duration `yaml:"slowThreshold" json:"slowThreshold,omitempty"`
+	ACL           *ACL          `yaml:"acl" json:"acl,omitempty"`
+}
+
+// An ACL restricts the clients requests are accepted from by their IP
+// address, the address the connection is from. Allow and Deny are lists
+// of CIDRs, e.g., "10.0.0.0/8", or single addresses. A client in a Deny
+// CIDR is refused, as is a client in none of the Allow CIDRs if there
+// are any.
+type ACL struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// copy returns a deep copy of the ACL, nil if it is nil.
+func (a *ACL) copy() *ACL {
+	if a == nil {
+		return nil
+	}
+	return &ACL{
+		Allow: append([]string(nil), a.Allow...),
+		Deny:  append([]string(nil), a.Deny...),
+	}
+}
+
+// ParsePrefix parses an ACL entry, a CIDR or a single address, which is
+// returned as a prefix of its full length.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
+
+// Admin configures the admin listener, which serves the admin API. It
+// is disabled if Listen has no port. GRPCListen optionally serves the
+// gRPC health service. ACL restricts the clients of both.
+type Admin struct {
+	Listen     HostPort `json:"listen"`
+	GRPCListen HostPort `yaml:"grpcListen" json:"grpcListen"`
+	ACL        *ACL     `yaml:"acl" json:"acl,omitempty"`
+}
+
+// Shutdown configures how the proxy shuts down on SIGTERM. It fails its
+// readiness checks and keeps serving for DrainPeriod, so that load
+// balancers in front of it stop sending it requests, then stops accepting
+// connections and waits up to Timeout for active requests to finish.
+type Shutdown struct {
+	DrainPeriod time.Duration `yaml:"drainPeriod" json:"drainPeriod"`
+	Timeout     time.Duration `json:"timeout"`
+}
+
+// Shutdown defaults, used if the configuration doesn't set them.
+const (
+	DefaultDrainPeriod     = 5 * time.Second
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+// Tracing configures OpenTelemetry tracing. Spans are exported with OTLP
+// over gRPC to the collector at Endpoint, a "host:port", and tracing is
+// disabled if it isn't set. Insecure disables TLS to the collector.
+// SampleRatio is the fraction of new traces that are sampled, 1 if not
+// set. Requests that are part of a trace are sampled if their parent is.
+type Tracing struct {
+	Endpoint    string  `json:"endpoint,omitempty"`
+	Insecure    bool    `json:"insecure,omitempty"`
+	SampleRatio float64 `yaml:"sampleRatio" json:"sampleRatio,omitempty"`
+}
+
+// StatsD formats.
+const (
+	// StatsDPlain metrics have their label values in their names, e.g.,
+	// "proxy_requests_total.my-service".
+	StatsDPlain = "statsd"
+	// StatsDDogStatsD metrics have their labels as DogStatsD tags.
+	StatsDDogStatsD = "dogstatsd"
+)
+
+// Metrics defaults, used if the configuration doesn't set them.
+const (
+	DefaultStatsDFlushInterval = time.Second
+	DefaultOTLPMetricsInterval = 10 * time.Second
+)
+
+// A StatsD configures pushing metrics over UDP to the StatsD or DogStatsD
+// server at Address, a "host:port", in Format, StatsDPlain if not set.
+// Metric names are prefixed with Prefix. Metrics are buffered in to
+// packets, and sent at least every FlushInterval,
+// DefaultStatsDFlushInterval if not set.
+type StatsD struct {
+	Address       string        `json:"address"`
+	Format        string        `json:"format,omitempty"`
+	Prefix        string        `json:"prefix,omitempty"`
+	FlushInterval time.Duration `yaml:"flushInterval" json:"flushInterval,omitempty"`
+}
+
+// An OTLPMetrics configures pushing metrics with OTLP over gRPC to the
+// collector at Endpoint, a "host:port", every Interval,
+// DefaultOTLPMetricsInterval if not set. Insecure disables TLS to the
+// collector.
+type OTLPMetrics struct {
+	Endpoint string        `json:"endpoint"`
+	Insecure bool          `json:"insecure,omitempty"`
+	Interval time.Duration `json:"interval,omitempty"`
+}
+
+// A Metrics configures the monitoring systems the proxy's metrics are
+// pushed to, in addition to being served for Prometheus on the admin
+// listener.
+type Metrics struct {
+	StatsD *StatsD      `yaml:"statsd" json:"statsd,omitempty"`
+	OTLP   *OTLPMetrics `yaml:"otlp" json:"otlp,omitempty"`
+}
+
+// Request ID formats.
+const (
+	// RequestIDUUIDv7 IDs are time-ordered RFC 9562 version 7 UUIDs.
+	RequestIDUUIDv7 = "uuidv7"
+	// RequestIDULID IDs are ULIDs, time-ordered and 26 characters long.
+	RequestIDULID = "ulid"
+)
+
+// DefaultRequestIDHeader is the request ID header used if the
+// configuration doesn't set one.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// A RequestID configures how requests are identified. A request's ID is
+// taken from its Header, DefaultRequestIDHeader if not set, or generated
+// in Format, RequestIDUUIDv7 if not set, if it doesn't have one. The ID
+// is passed to the backend and returned to the client in the same
+// header.
+type RequestID struct {
+	Header string `json:"header,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// HeaderName returns the request ID header.
+func (r RequestID) HeaderName() string {
+	if r.Header == "" {
+		return DefaultRequestIDHeader
+	}
+	return r.Header
+}
+
+// Access log formats.
+const (
+	// AccessLogJSON records are JSON objects.
+	AccessLogJSON = "json"
+	// AccessLogLogfmt records are logfmt key=value pairs.
+	AccessLogLogfmt = "logfmt"
+	// AccessLogCommon records are in the Common Log Format.
+	AccessLogCommon = "common"
+	// AccessLogCombined records are in the Combined Log Format, the
+	// Common Log Format with the referer and user agent.
+	AccessLogCombined = "combined"
+)
+
+// Access log outputs.
+const (
+	// AccessLogStdout writes records to standard output.
+	AccessLogStdout = "stdout"
+	// AccessLogFile writes records to the file at Path, rotated when it
+	// reaches MaxSizeMB.
+	AccessLogFile = "file"
+	// AccessLogSyslog sends records to syslog at SyslogAddress over
+	// SyslogNetwork, or the local syslog if they aren't set.
+	AccessLogSyslog = "syslog"
+)
+
+// AccessLogRedactable lists the access log fields that can be redacted.
+var AccessLogRedactable = []string{"client_ip", "path", "query", "user_agent", "referer"}
+
+// Access log defaults, used if the configuration doesn't set them.
+const (
+	DefaultAccessLogMaxSizeMB  = 100
+	DefaultAccessLogMaxBackups = 5
+)
+
+// An AccessLog configures the access log, which records each request
+// the proxy handles in Format, AccessLogJSON if not set, to Output,
+// AccessLogStdout if not set. A rotated file keeps MaxBackups previous
+// files.
+type AccessLog struct {
+	Format        string `json:"format,omitempty"`
+	Output        string `json:"output,omitempty"`
+	Path          string `json:"path,omitempty"`
+	MaxSizeMB     int    `yaml:"maxSizeMB" json:"maxSizeMB,omitempty"`
+	MaxBackups    int    `yaml:"maxBackups" json:"maxBackups,omitempty"`
+	SyslogNetwork string `yaml:"syslogNetwork" json:"syslogNetwork,omitempty"`
+	SyslogAddress string `yaml:"syslogAddress" json:"syslogAddress,omitempty"`
+}
+
+// Client keys, how clients are identified in client statistics.
+const (
+	// ClientKeyHash identifies a client by a keyed hash of its IP
+	// address.
+	ClientKeyHash = "hash"
+	// ClientKeyPrefix identifies a client by the network prefix of its
+	// IP address.
+	ClientKeyPrefix = "prefix"
+)
+
+// Client statistics defaults, used if the configuration doesn't set them.
+const (
+	DefaultClientStatsTopK           = 10
+	DefaultClientStatsWindow         = time.Minute
+	DefaultClientStatsIPv4PrefixBits = 24
+	DefaultClientStatsIPv6PrefixBits = 48
+)
+
+// A ClientStats configures per-client statistics, which track the TopK
+// clients, DefaultClientStatsTopK if not set, by request rate and error
+// rate over each Window, DefaultClientStatsWindow if not set.
+//
+// Clients are identified by Key, ClientKeyHash if not set, so that their
+// addresses aren't stored. ClientKeyHash uses HashKey as the key of an
+// HMAC, a random key if not set, which changes each time the proxy
+// starts. ClientKeyPrefix truncates addresses to IPv4PrefixBits or
+// IPv6PrefixBits.
+type ClientStats struct {
+	Key            string        `json:"key,omitempty"`
+	HashKey        string        `yaml:"hashKey" json:"-"`
+	IPv4PrefixBits int           `yaml:"ipv4PrefixBits" json:"ipv4PrefixBits,omitempty"`
+	IPv6PrefixBits int           `yaml:"ipv6PrefixBits" json:"ipv6PrefixBits,omitempty"`
+	TopK           int           `yaml:"topK" json:"topK,omitempty"`
+	Window         time.Duration `json:"window,omitempty"`
+}
+
+// A Geo configures looking up the location and network of each client
+// in local MaxMind-format databases: Database, a GeoIP2 or GeoLite2
+// Country or City database, and ASNDatabase, an ASN database. Either may
+// be empty.
+//
+// Latencies are observed by region and ASN, for the Regions and ASNs
+// listed, with others grouped together, so that the number of series is
+// bounded. A region is an ISO 3166-1 country code, e.g., "BR", or an ISO
+// 3166-2 country-subdivision code, e.g., "US-CA".
+type Geo struct {
+	Database    string   `json:"database,omitempty"`
+	ASNDatabase string   `yaml:"asnDatabase" json:"asnDatabase,omitempty"`
+	Regions     []string `json:"regions,omitempty"`
+	ASNs        []uint32 `yaml:"asns" json:"asns,omitempty"`
+}
+
+// ValidRegion returns true if region is a country or country-subdivision
+// code, e.g., "BR" or "US-CA".
+func ValidRegion(region string) bool {
+	country, subdivision, hasSubdivision := strings.Cut(region, "-")
+	if len(country) != 2 || strings.IndexFunc(country, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+		return false
+	}
+	if !hasSubdivision {
+		return true
+	}
+	return len(subdivision) >= 1 && len(subdivision) <= 3 &&
+		strings.IndexFunc(subdivision, func(r rune) bool { return (r < 'A' || r > 'Z') && (r < '0' || r > '9') }) < 0
+}
+
+// DefaultCaptureSize is the number of requests captured if the
+// configuration doesn't set it.
+const DefaultCaptureSize = 100
+
+// CaptureRedactedHeaders lists the headers whose values are always
+// redacted from captured requests.
+var CaptureRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// A Capture configures the capture log, which keeps the last Size
+// requests, DefaultCaptureSize if not set, that failed with a server
+// error or took longer than their service's SlowThreshold. The values of
+// the RedactHeaders and CaptureRedactedHeaders headers are redacted. The
+// captured requests are written to a new file in DumpDir, the temporary
+// directory if not set, when the proxy receives SIGUSR1.
+type Capture struct {
+	Size          int      `json:"size,omitempty"`
+	RedactHeaders []string `yaml:"redactHeaders" json:"redactHeaders,omitempty"`
+	DumpDir       string   `yaml:"dumpDir" json:"dumpDir,omitempty"`
+}
+
+// Log formats.
+const (
+	// LogText logs are slog text, key=value pairs.
+	LogText = "text"
+	// LogJSON logs are JSON objects.
+	LogJSON = "json"
+)
+
+// A Logging configures the application log, which is written to standard
+// error. Level is the least severe level logged, "debug", "info", "warn"
+// or "error", "info" if not set. Format is LogText if not set. The admin
+// API can change the level while the proxy runs.
+type Logging struct {
+	Level  string `json:"level,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// SlogLevel returns the configured level.
+func (l Logging) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	if l.Level == "" {
+		return level, nil
+	}
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		return level, errors.Errorf("Logging level %q is unknown", l.Level)
+	}
+	return level, nil
 }
 
 // A proxy consists of the host:port that the proxy should
 // listen on, and details of the services it proxies for.
+//
+// Resolvers is an optional list of "host:port" DNS servers used to
+// resolve hosts that are DNS names. If empty the servers in
+// /etc/resolv.conf are used.
+//
+// ACL restricts the clients requests to every service, and health checks,
+// are accepted from.
 type Proxy struct {
-	Listen   HostPort
-	Services []Service
+	Listen      HostPort     `json:"listen"`
+	Admin       Admin        `json:"admin"`
+	ACL         *ACL         `yaml:"acl" json:"acl,omitempty"`
+	Resolvers   []string     `json:"resolvers,omitempty"`
+	Shutdown    Shutdown     `json:"shutdown"`
+	Tracing     Tracing      `json:"tracing"`
+	Metrics     Metrics      `json:"metrics"`
+	RequestID   RequestID    `yaml:"requestId" json:"requestId"`
+	AccessLog   *AccessLog   `yaml:"accessLog" json:"accessLog,omitempty"`
+	Logging     Logging      `json:"logging"`
+	ClientStats *ClientStats `yaml:"clientStats" json:"clientStats,omitempty"`
+	Geo         *Geo         `json:"geo,omitempty"`
+	Capture     *Capture     `json:"capture,omitempty"`
+	Services    []Service    `json:"services"`
 }
 
 // The complete proxy configuration.
 type ProxyConfig struct {
-	Proxy
+	Proxy `json:"proxy"`
 }
 
 // Copy performs a deep copy of the ProxyConfig.
 func (pc ProxyConfig) Copy(to *ProxyConfig) {
 	*to = ProxyConfig{}
 	to.Listen = pc.Listen
+	to.Admin = pc.Admin
+	to.Admin.ACL = pc.Admin.ACL.copy()
+	to.ACL = pc.ACL.copy()
+	to.Shutdown = pc.Shutdown
+	to.Tracing = pc.Tracing
+	if pc.Metrics.StatsD != nil {
+		sd := *pc.Metrics.StatsD
+		to.Metrics.StatsD = &sd
+	}
+	if pc.Metrics.OTLP != nil {
+		otlp := *pc.Metrics.OTLP
+		to.Metrics.OTLP = &otlp
+	}
+	to.RequestID = pc.RequestID
+	to.Logging = pc.Logging
+	if pc.AccessLog != nil {
+		al := *pc.AccessLog
+		to.AccessLog = &al
+	}
+	if pc.ClientStats != nil {
+		cs := *pc.ClientStats
+		to.ClientStats = &cs
+	}
+	if pc.Geo != nil {
+		g := *pc.Geo
+		g.Regions = append([]string(nil), pc.Geo.Regions...)
+		g.ASNs = append([]uint32(nil), pc.Geo.ASNs...)
+		to.Geo = &g
+	}
+	if pc.Capture != nil {
+		c := *pc.Capture
+		c.RedactHeaders = append([]string(nil), pc.Capture.RedactHeaders...)
+		to.Capture = &c
+	}
+	to.Resolvers = append(to.Resolvers, pc.Resolvers...)
 	for _, service := range pc.Services {
 		s := Service{
-			Name:   service.Name,
-			Domain: service.Domain,
+			Name:          service.Name,
+			Domain:        service.Domain,
+			Readiness:     service.Readiness,
+			SlowThreshold: service.SlowThreshold,
+			ACL:           service.ACL.copy(),
+		}
+		if service.Discovery != nil {
+			d := *service.Discovery
+			s.Discovery = &d
+		}
+		if service.AccessLog != nil {
+			al := *service.AccessLog
+			al.Redact = append([]string(nil), service.AccessLog.Redact...)
+			s.AccessLog = &al
+		}
+		if service.SLO != nil {
+			slo := *service.SLO
+			if service.SLO.Latency != nil {
+				l := *service.SLO.Latency
+				slo.Latency = &l
+			}
+			s.SLO = &slo
+		}
+		if service.RegionServices != nil {
+			s.RegionServices = make(map[string]string, len(service.RegionServices))
+			for region, name := range service.RegionServices {
+				s.RegionServices[region] = name
+			}
 		}
 		for _, host := range service.Hosts {
 			h := HostPort{
 				Address: host.Address,
 				Port:    host.Port,
+				Weight:  host.Weight,
 			}
 			s.Hosts = append(s.Hosts, h)
 		}
@@ -82,6 +614,28 @@ func ParseConfig(data []byte, config *ProxyConfig) error {
 	return nil
 }
 
+// ParseHostsFromFile parses a DiscoveryFile hosts file, returning the
+// hosts it lists.
+func ParseHostsFromFile(filename string) ([]HostPort, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read from %s failed", filename)
+	}
+
+	return ParseHosts(content)
+}
+
+// ParseHosts parses the content of a DiscoveryFile hosts file, which is
+// JSON or YAML, returning the hosts it lists.
+func ParseHosts(data []byte) ([]HostPort, error) {
+	var hf hostsFile
+	if err := yaml.Unmarshal(data, &hf); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling failed")
+	}
+
+	return hf.Hosts, nil
+}
+
 // ValidateConfig verifies the configuration appears sensible. If not it
 // returns one or more errors identified in the configuration.
 func ValidateConfig(config *ProxyConfig) []error {
@@ -97,6 +651,89 @@ func ValidateConfig(config *ProxyConfig) []error {
 		errs = append(errs, errors.New("Listen Port is not set"))
 	}
 
+	if config.Admin.Listen.Port != 0 && config.Admin.Listen == config.Listen {
+		errs = append(errs, errors.New("Admin Listen is the same as Listen"))
+	}
+
+	if config.Admin.GRPCListen.Port != 0 {
+		if config.Admin.Listen.Port == 0 {
+			errs = append(errs, errors.New("Admin GRPCListen is set without Admin Listen"))
+		}
+		if config.Admin.GRPCListen == config.Listen || config.Admin.GRPCListen == config.Admin.Listen {
+			errs = append(errs, errors.New("Admin GRPCListen is the same as another listener"))
+		}
+	}
+
+	if config.ACL != nil {
+		errs = append(errs, validateACL("Proxy", config.ACL)...)
+	}
+
+	if config.Admin.ACL != nil {
+		errs = append(errs, validateACL("Admin", config.Admin.ACL)...)
+	}
+
+	for i, resolver := range config.Resolvers {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			errs = append(errs, errors.Errorf("Resolver %d (%q) is not a host:port pair", i, resolver))
+		}
+	}
+
+	if config.Shutdown.DrainPeriod < 0 {
+		errs = append(errs, errors.New("Shutdown drainPeriod is negative"))
+	}
+
+	if config.Shutdown.Timeout < 0 {
+		errs = append(errs, errors.New("Shutdown timeout is negative"))
+	}
+
+	if config.Tracing.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(config.Tracing.Endpoint); err != nil {
+			errs = append(errs, errors.Errorf("Tracing endpoint (%q) is not a host:port pair", config.Tracing.Endpoint))
+		}
+	}
+
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		errs = append(errs, errors.New("Tracing sampleRatio is not between 0 and 1"))
+	}
+
+	errs = append(errs, validateMetrics(config.Metrics)...)
+
+	switch config.RequestID.Format {
+	case "", RequestIDUUIDv7, RequestIDULID:
+	default:
+		errs = append(errs, errors.Errorf("Request ID format %q is unknown", config.RequestID.Format))
+	}
+
+	if strings.ContainsAny(config.RequestID.Header, " \t:") {
+		errs = append(errs, errors.Errorf("Request ID header %q is not a valid header name", config.RequestID.Header))
+	}
+
+	if config.AccessLog != nil {
+		errs = append(errs, validateAccessLog(config.AccessLog)...)
+	}
+
+	if _, err := config.Logging.SlogLevel(); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch config.Logging.Format {
+	case "", LogText, LogJSON:
+	default:
+		errs = append(errs, errors.Errorf("Logging format %q is unknown", config.Logging.Format))
+	}
+
+	if config.ClientStats != nil {
+		errs = append(errs, validateClientStats(config.ClientStats)...)
+	}
+
+	if config.Geo != nil {
+		errs = append(errs, validateGeo(config.Geo)...)
+	}
+
+	if config.Capture != nil {
+		errs = append(errs, validateCapture(config.Capture)...)
+	}
+
 	if len(config.Services) == 0 {
 		errs = append(errs, errors.New("No services have been defined"))
 	}
@@ -111,18 +748,308 @@ func ValidateConfig(config *ProxyConfig) []error {
 			errs = append(errs, errors.Errorf("Service %s has no domain", service.Name))
 		}
 
-		if len(service.Hosts) == 0 {
+		if service.Discovery != nil {
+			if len(service.Hosts) != 0 {
+				errs = append(errs, errors.Errorf("Service %s has both hosts and discovery", service.Name))
+			}
+			errs = append(errs, validateDiscovery(service.Name, service.Discovery)...)
+		} else if len(service.Hosts) == 0 {
 			errs = append(errs, errors.Errorf("Service %s has no hosts", service.Name))
 		}
 
-		for j, host := range service.Hosts {
-			if host.Address == "" {
-				errs = append(errs, errors.Errorf("The %d host in service %s has no address", j, service.Name))
+		errs = append(errs, ValidateHosts(service.Name, service.Hosts)...)
+
+		if service.Readiness.MinHealthyHosts < 0 {
+			errs = append(errs, errors.Errorf("Service %s has a negative minHealthyHosts", service.Name))
+		}
+
+		if al := service.AccessLog; al != nil {
+			if al.SampleRatio < 0 || al.SampleRatio > 1 {
+				errs = append(errs, errors.Errorf("Service %s has an access log sampleRatio that is not between 0 and 1", service.Name))
+			}
+			for _, field := range al.Redact {
+				if !redactable(field) {
+					errs = append(errs, errors.Errorf("Service %s redacts unknown access log field %q", service.Name, field))
+				}
 			}
+		}
+
+		if service.SLO != nil {
+			errs = append(errs, validateSLO(service.Name, service.SLO)...)
+		}
+
+		if service.SlowThreshold < 0 {
+			errs = append(errs, errors.Errorf("Service %s has a negative slowThreshold", service.Name))
+		}
+
+		if service.ACL != nil {
+			errs = append(errs, validateACL("Service "+service.Name, service.ACL)...)
+		}
+
+		if len(service.RegionServices) > 0 && (config.Geo == nil || config.Geo.Database == "") {
+			errs = append(errs, errors.Errorf("Service %s has regionServices without a geo database", service.Name))
+		}
+		for region, name := range service.RegionServices {
+			if !ValidRegion(region) {
+				errs = append(errs, errors.Errorf("Service %s has a regionServices region %q that is not a region code", service.Name, region))
+			}
+			if !hasService(config.Services, name) || name == service.Name {
+				errs = append(errs, errors.Errorf("Service %s sends region %s to %q, which is not another service", service.Name, region, name))
+			}
+		}
+	}
+
+	return errs
+}
+
+// ValidateHosts verifies the hosts for the named service appear sensible.
+// If not it returns one or more errors identified in the hosts.
+func ValidateHosts(name string, hosts []HostPort) []error {
+	var errs []error
+
+	for j, host := range hosts {
+		if host.Address == "" {
+			errs = append(errs, errors.Errorf("The %d host in service %s has no address", j, name))
+		}
+
+		if host.Weight < 0 {
+			errs = append(errs, errors.Errorf("The %d host in service %s has a negative weight", j, name))
+		}
 
-			if host.Port == 0 {
-				errs = append(errs, errors.Errorf("The %d host in service %s has no port", j, service.Name))
+		if host.IsUnix() {
+			if !strings.HasPrefix(host.SocketPath(), "/") {
+				errs = append(errs, errors.Errorf("The %d host in service %s has no absolute socket path", j, name))
 			}
+			if host.Port != 0 {
+				errs = append(errs, errors.Errorf("The %d host in service %s is a Unix socket and has a port", j, name))
+			}
+			continue
+		}
+
+		if host.Port == 0 {
+			errs = append(errs, errors.Errorf("The %d host in service %s has no port", j, name))
+		}
+	}
+
+	return errs
+}
+
+// validateDiscovery verifies the discovery configuration for the named
+// service.
+func validateDiscovery(name string, d *Discovery) []error {
+	var errs []error
+
+	switch d.Type {
+	case DiscoveryDNSSRV:
+	case DiscoveryDNS:
+		if d.Port == 0 {
+			errs = append(errs, errors.Errorf("Discovery for service %s has no port", name))
+		}
+	case DiscoveryKubernetes:
+		if d.Namespace == "" {
+			errs = append(errs, errors.Errorf("Discovery for service %s has no namespace", name))
+		}
+	case DiscoveryFile:
+		if d.Path == "" {
+			errs = append(errs, errors.Errorf("Discovery for service %s has no path", name))
+		}
+		return errs
+	default:
+		errs = append(errs, errors.Errorf("Discovery for service %s has unknown type %q", name, d.Type))
+		return errs
+	}
+
+	if d.Name == "" {
+		errs = append(errs, errors.Errorf("Discovery for service %s has no name", name))
+	}
+
+	if d.Interval < 0 {
+		errs = append(errs, errors.Errorf("Discovery for service %s has a negative interval", name))
+	}
+
+	return errs
+}
+
+// validateMetrics verifies the metrics push configuration.
+func validateMetrics(m Metrics) []error {
+	var errs []error
+
+	if sd := m.StatsD; sd != nil {
+		if _, _, err := net.SplitHostPort(sd.Address); err != nil {
+			errs = append(errs, errors.Errorf("Metrics statsd address (%q) is not a host:port pair", sd.Address))
+		}
+		switch sd.Format {
+		case "", StatsDPlain, StatsDDogStatsD:
+		default:
+			errs = append(errs, errors.Errorf("Metrics statsd format %q is unknown", sd.Format))
+		}
+		if sd.FlushInterval < 0 {
+			errs = append(errs, errors.New("Metrics statsd flushInterval is negative"))
+		}
+	}
+
+	if otlp := m.OTLP; otlp != nil {
+		if _, _, err := net.SplitHostPort(otlp.Endpoint); err != nil {
+			errs = append(errs, errors.Errorf("Metrics otlp endpoint (%q) is not a host:port pair", otlp.Endpoint))
+		}
+		if otlp.Interval < 0 {
+			errs = append(errs, errors.New("Metrics otlp interval is negative"))
+		}
+	}
+
+	return errs
+}
+
+// validateAccessLog verifies the access log configuration.
+func validateAccessLog(al *AccessLog) []error {
+	var errs []error
+
+	switch al.Format {
+	case "", AccessLogJSON, AccessLogLogfmt, AccessLogCommon, AccessLogCombined:
+	default:
+		errs = append(errs, errors.Errorf("Access log has unknown format %q", al.Format))
+	}
+
+	switch al.Output {
+	case "", AccessLogStdout, AccessLogSyslog:
+	case AccessLogFile:
+		if al.Path == "" {
+			errs = append(errs, errors.New("Access log file has no path"))
+		}
+	default:
+		errs = append(errs, errors.Errorf("Access log has unknown output %q", al.Output))
+	}
+
+	if al.MaxSizeMB < 0 || al.MaxBackups < 0 {
+		errs = append(errs, errors.New("Access log maxSizeMB or maxBackups is negative"))
+	}
+
+	return errs
+}
+
+// redactable returns true if field is one of AccessLogRedactable.
+func redactable(field string) bool {
+	for _, f := range AccessLogRedactable {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// validateClientStats verifies the client statistics configuration.
+func validateClientStats(cs *ClientStats) []error {
+	var errs []error
+
+	switch cs.Key {
+	case "", ClientKeyHash, ClientKeyPrefix:
+	default:
+		errs = append(errs, errors.Errorf("Client stats key %q is unknown", cs.Key))
+	}
+
+	if cs.IPv4PrefixBits < 0 || cs.IPv4PrefixBits > 32 {
+		errs = append(errs, errors.New("Client stats ipv4PrefixBits is not between 0 and 32"))
+	}
+
+	if cs.IPv6PrefixBits < 0 || cs.IPv6PrefixBits > 128 {
+		errs = append(errs, errors.New("Client stats ipv6PrefixBits is not between 0 and 128"))
+	}
+
+	if cs.TopK < 0 || cs.Window < 0 {
+		errs = append(errs, errors.New("Client stats topK or window is negative"))
+	}
+
+	return errs
+}
+
+// validateGeo verifies the geo configuration.
+func validateGeo(g *Geo) []error {
+	var errs []error
+
+	if g.Database == "" && g.ASNDatabase == "" {
+		errs = append(errs, errors.New("Geo has no database or asnDatabase"))
+	}
+
+	for _, region := range g.Regions {
+		if !ValidRegion(region) {
+			errs = append(errs, errors.Errorf("Geo region %q is not a region code", region))
+		}
+	}
+
+	return errs
+}
+
+// hasService returns true if services includes one called name.
+func hasService(services []Service, name string) bool {
+	for _, s := range services {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSLO verifies the named service's SLO.
+func validateSLO(name string, slo *SLO) []error {
+	var errs []error
+
+	if slo.Availability == 0 && slo.Latency == nil {
+		errs = append(errs, errors.Errorf("SLO for service %s has no objectives", name))
+	}
+
+	if slo.Availability < 0 || slo.Availability >= 1 {
+		errs = append(errs, errors.Errorf("SLO for service %s has an availability that is not between 0 and 1", name))
+	}
+
+	if l := slo.Latency; l != nil {
+		if l.Threshold <= 0 {
+			errs = append(errs, errors.Errorf("SLO for service %s has a latency threshold that is not positive", name))
+		}
+		if l.Percentile <= 0 || l.Percentile >= 1 {
+			errs = append(errs, errors.Errorf("SLO for service %s has a latency percentile that is not between 0 and 1", name))
+		}
+	}
+
+	if slo.Window < 0 {
+		errs = append(errs, errors.Errorf("SLO for service %s has a negative window", name))
+	} else if slo.Window != 0 && slo.Window < MinSLOWindow {
+		errs = append(errs, errors.Errorf("SLO for service %s has a window shorter than %v", name, MinSLOWindow))
+	}
+
+	return errs
+}
+
+// validateACL verifies the ACL of the proxy, the admin listener or a
+// service, named by owner.
+func validateACL(owner string, acl *ACL) []error {
+	var errs []error
+
+	for _, entry := range acl.Allow {
+		if _, err := ParsePrefix(entry); err != nil {
+			errs = append(errs, errors.Errorf("%s ACL allow %q is not a CIDR or IP address", owner, entry))
+		}
+	}
+
+	for _, entry := range acl.Deny {
+		if _, err := ParsePrefix(entry); err != nil {
+			errs = append(errs, errors.Errorf("%s ACL deny %q is not a CIDR or IP address", owner, entry))
+		}
+	}
+
+	return errs
+}
+
+// validateCapture verifies the capture log configuration.
+func validateCapture(c *Capture) []error {
+	var errs []error
+
+	if c.Size < 0 {
+		errs = append(errs, errors.New("Capture size is negative"))
+	}
+
+	for _, header := range c.RedactHeaders {
+		if header == "" || strings.ContainsAny(header, " \t:") {
+			errs = append(errs, errors.Errorf("Capture redactHeaders %q is not a valid header name", header))
 		}
 	}
 
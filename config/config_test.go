@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 )
@@ -14,6 +15,69 @@ func TestParseConfig(t *testing.T) {
     address: "127.0.0.1"
     port: 8080
 
+  admin:
+    listen:
+      address: "127.0.0.1"
+      port: 8081
+    grpcListen:
+      address: "127.0.0.1"
+      port: 8082
+    acl:
+      allow: ["10.0.0.0/8", "::1"]
+
+  acl:
+    deny: ["192.0.2.0/24"]
+
+  shutdown:
+    drainPeriod: 10s
+    timeout: 1m
+
+  tracing:
+    endpoint: "otel-collector:4317"
+    insecure: true
+    sampleRatio: 0.25
+
+  metrics:
+    statsd:
+      address: "127.0.0.1:8125"
+      format: dogstatsd
+      prefix: afe.
+    otlp:
+      endpoint: "otel-collector:4317"
+      interval: 30s
+
+  requestId:
+    header: X-Correlation-Id
+    format: ulid
+
+  accessLog:
+    format: logfmt
+    output: file
+    path: /var/log/afe/access.log
+    maxSizeMB: 50
+    maxBackups: 3
+
+  logging:
+    level: debug
+    format: json
+
+  clientStats:
+    key: prefix
+    ipv4PrefixBits: 16
+    topK: 5
+    window: 30s
+
+  geo:
+    database: /var/lib/GeoIP/GeoLite2-City.mmdb
+    asnDatabase: /var/lib/GeoIP/GeoLite2-ASN.mmdb
+    regions: [BR, US-CA]
+    asns: [64496]
+
+  capture:
+    size: 50
+    redactHeaders: [X-Api-Key]
+    dumpDir: /var/lib/afe
+
   services:
     - name: my-service
       domain: my-service.my-company.com
@@ -22,6 +86,31 @@ func TestParseConfig(t *testing.T) {
           port: 9090
         - address: "127.0.0.1"
           port: 9091
+          weight: 3
+      readiness:
+        critical: true
+        minHealthyHosts: 2
+      accessLog:
+        sampleRatio: 0.5
+        redact: [client_ip, query]
+      regionServices:
+        BR: other-service
+      slo:
+        availability: 0.999
+        latency:
+          threshold: 300ms
+          percentile: 0.99
+        window: 168h
+      slowThreshold: 500ms
+      acl:
+        allow: ["10.1.0.0/16"]
+        deny: ["10.1.2.3"]
+    - name: other-service
+      domain: other-service.my-company.com
+      discovery:
+        type: dns-srv
+        name: _http._tcp.other-service.my-company.com
+        interval: 10s
 `
 	expectedConfig := ProxyConfig{
 		Proxy{
@@ -29,6 +118,70 @@ func TestParseConfig(t *testing.T) {
 				Address: "127.0.0.1",
 				Port:    8080,
 			},
+			Admin: Admin{
+				Listen: HostPort{
+					Address: "127.0.0.1",
+					Port:    8081,
+				},
+				GRPCListen: HostPort{
+					Address: "127.0.0.1",
+					Port:    8082,
+				},
+				ACL: &ACL{Allow: []string{"10.0.0.0/8", "::1"}},
+			},
+			ACL: &ACL{Deny: []string{"192.0.2.0/24"}},
+			Shutdown: Shutdown{
+				DrainPeriod: 10 * time.Second,
+				Timeout:     time.Minute,
+			},
+			Tracing: Tracing{
+				Endpoint:    "otel-collector:4317",
+				Insecure:    true,
+				SampleRatio: 0.25,
+			},
+			Metrics: Metrics{
+				StatsD: &StatsD{
+					Address: "127.0.0.1:8125",
+					Format:  StatsDDogStatsD,
+					Prefix:  "afe.",
+				},
+				OTLP: &OTLPMetrics{
+					Endpoint: "otel-collector:4317",
+					Interval: 30 * time.Second,
+				},
+			},
+			RequestID: RequestID{
+				Header: "X-Correlation-Id",
+				Format: RequestIDULID,
+			},
+			AccessLog: &AccessLog{
+				Format:     AccessLogLogfmt,
+				Output:     AccessLogFile,
+				Path:       "/var/log/afe/access.log",
+				MaxSizeMB:  50,
+				MaxBackups: 3,
+			},
+			Logging: Logging{
+				Level:  "debug",
+				Format: LogJSON,
+			},
+			ClientStats: &ClientStats{
+				Key:            ClientKeyPrefix,
+				IPv4PrefixBits: 16,
+				TopK:           5,
+				Window:         30 * time.Second,
+			},
+			Geo: &Geo{
+				Database:    "/var/lib/GeoIP/GeoLite2-City.mmdb",
+				ASNDatabase: "/var/lib/GeoIP/GeoLite2-ASN.mmdb",
+				Regions:     []string{"BR", "US-CA"},
+				ASNs:        []uint32{64496},
+			},
+			Capture: &Capture{
+				Size:          50,
+				RedactHeaders: []string{"X-Api-Key"},
+				DumpDir:       "/var/lib/afe",
+			},
 			Services: []Service{{
 				Name:   "my-service",
 				Domain: "my-service.my-company.com",
@@ -38,7 +191,35 @@ func TestParseConfig(t *testing.T) {
 				}, {
 					Address: "127.0.0.1",
 					Port:    9091,
+					Weight:  3,
 				}},
+				Readiness: Readiness{
+					Critical:        true,
+					MinHealthyHosts: 2,
+				},
+				AccessLog: &ServiceAccessLog{
+					SampleRatio: 0.5,
+					Redact:      []string{"client_ip", "query"},
+				},
+				RegionServices: map[string]string{"BR": "other-service"},
+				SLO: &SLO{
+					Availability: 0.999,
+					Latency: &LatencySLO{
+						Threshold:  300 * time.Millisecond,
+						Percentile: 0.99,
+					},
+					Window: 7 * 24 * time.Hour,
+				},
+				SlowThreshold: 500 * time.Millisecond,
+				ACL:           &ACL{Allow: []string{"10.1.0.0/16"}, Deny: []string{"10.1.2.3"}},
+			}, {
+				Name:   "other-service",
+				Domain: "other-service.my-company.com",
+				Discovery: &Discovery{
+					Type:     DiscoveryDNSSRV,
+					Name:     "_http._tcp.other-service.my-company.com",
+					Interval: 10 * time.Second,
+				},
 			}},
 		},
 	}
@@ -52,6 +233,42 @@ func TestParseConfig(t *testing.T) {
 	}
 }
 
+func TestParseHosts(t *testing.T) {
+	expectedHosts := []HostPort{{
+		Address: "127.0.0.1",
+		Port:    9090,
+	}, {
+		Address: "unix:///run/app.sock",
+	}}
+
+	var tests = []struct {
+		format string
+		in     string
+	}{
+		{"YAML", `hosts:
+  - address: "127.0.0.1"
+    port: 9090
+  - address: "unix:///run/app.sock"
+`},
+		{"JSON", `{"hosts": [{"address": "127.0.0.1", "port": 9090}, {"address": "unix:///run/app.sock"}]}`},
+	}
+
+	for _, tt := range tests {
+		hosts, err := ParseHosts([]byte(tt.in))
+		if err != nil {
+			t.Errorf("valid %s hosts failed to parse: %v", tt.format, err)
+			continue
+		}
+		if diff := deep.Equal(hosts, expectedHosts); diff != nil {
+			t.Error(tt.format, diff)
+		}
+	}
+
+	if _, err := ParseHosts([]byte("hosts: [")); err == nil {
+		t.Error("invalid hosts parsed without error")
+	}
+}
+
 func TestHostPortString(t *testing.T) {
 	var tests = []struct {
 		in  HostPort
@@ -60,6 +277,9 @@ func TestHostPortString(t *testing.T) {
 		{HostPort{Address: "127.0.0.1", Port: 8080}, "127.0.0.1:8080"},
 		{HostPort{Address: "127.0.0.1"}, "127.0.0.1:0"},
 		{HostPort{Port: 8081}, ":8081"},
+		{HostPort{Address: "::1", Port: 8080}, "[::1]:8080"},
+		{HostPort{Address: "2001:db8::1", Port: 443}, "[2001:db8::1]:443"},
+		{HostPort{Address: "unix:///run/app.sock"}, "unix:///run/app.sock"},
 	}
 
 	for _, tt := range tests {
@@ -70,6 +290,61 @@ func TestHostPortString(t *testing.T) {
 	}
 }
 
+func TestHostPortKind(t *testing.T) {
+	var tests = []struct {
+		in       HostPort
+		unix     bool
+		hostname bool
+		path     string
+	}{
+		{HostPort{Address: "127.0.0.1", Port: 8080}, false, false, ""},
+		{HostPort{Address: "::1", Port: 8080}, false, false, ""},
+		{HostPort{Address: "backend.example.com", Port: 8080}, false, true, ""},
+		{HostPort{Address: "unix:///run/app.sock"}, true, false, "/run/app.sock"},
+		{HostPort{}, false, false, ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.in.IsUnix(); got != tt.unix {
+			t.Errorf("%v: IsUnix() got %t, want %t", tt.in, got, tt.unix)
+		}
+		if got := tt.in.IsHostname(); got != tt.hostname {
+			t.Errorf("%v: IsHostname() got %t, want %t", tt.in, got, tt.hostname)
+		}
+		if got := tt.in.SocketPath(); got != tt.path {
+			t.Errorf("%v: SocketPath() got %q, want %q", tt.in, got, tt.path)
+		}
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"10.1.2.3/8", "10.0.0.0/8", false},
+		{"10.1.2.3", "10.1.2.3/32", false},
+		{"::ffff:10.1.2.3", "10.1.2.3/32", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"::1", "::1/128", false},
+		{"10.0.0.0/33", "", true},
+		{"internal", "", true},
+	}
+
+	for _, tt := range tests {
+		p, err := ParsePrefix(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: got error %v, want error %t", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && p.String() != tt.out {
+			t.Errorf("%q: got %q, want %q", tt.in, p.String(), tt.out)
+		}
+	}
+}
+
 func TestValidateConfig(t *testing.T) {
 	goldenConfig := ProxyConfig{
 		Proxy{
@@ -121,6 +396,113 @@ func TestValidateConfig(t *testing.T) {
 	errs = ValidateConfig(&testConfig)
 	checkErr(errs, 1, "Listen Port is not set")
 
+	goldenConfig.Copy(&testConfig)
+	testConfig.Admin.Listen = testConfig.Listen
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "Admin Listen is the same as Listen")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Shutdown = Shutdown{DrainPeriod: -1, Timeout: -1}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 2, "Shutdown drainPeriod is negative")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Tracing = Tracing{Endpoint: "otel-collector", SampleRatio: 2}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 2, "Tracing endpoint (\"otel-collector\") is not a host:port pair")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.RequestID = RequestID{Header: "X Request Id", Format: "uuidv4"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 2, "Request ID format \"uuidv4\" is unknown")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.AccessLog = &AccessLog{Format: "xml", Output: AccessLogFile, MaxBackups: -1}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 3, "Access log file has no path")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Logging = Logging{Level: "verbose", Format: "xml"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 2, "Logging level \"verbose\" is unknown")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.ClientStats = &ClientStats{Key: "ip", IPv6PrefixBits: 129, TopK: -1}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 3, "Client stats ipv6PrefixBits is not between 0 and 128")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Geo = &Geo{Regions: []string{"BR", "br", "US-CAL1"}}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 3, "Geo region \"br\" is not a region code")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].RegionServices = map[string]string{"BR": "my-service"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 2, "Service my-service has regionServices without a geo database")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].SLO = &SLO{}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "SLO for service my-service has no objectives")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].SLO = &SLO{Availability: 1, Latency: &LatencySLO{Percentile: 99}, Window: -1}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 4, "SLO for service my-service has a latency percentile that is not between 0 and 1")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].SLO = &SLO{Availability: 0.999, Window: 24 * time.Hour}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "SLO for service my-service has a window shorter than 72h0m0s")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Metrics.StatsD = &StatsD{Address: "localhost", Format: "graphite", FlushInterval: -1}
+	testConfig.Metrics.OTLP = &OTLPMetrics{Endpoint: "otel-collector:4317", Interval: -1}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 4, "Metrics statsd format \"graphite\" is unknown")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Capture = &Capture{Size: -1, RedactHeaders: []string{"X-Api-Key", "X Api Key"}}
+	testConfig.Services[0].SlowThreshold = -time.Second
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 3, "Capture redactHeaders \"X Api Key\" is not a valid header name")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.ACL = &ACL{Allow: []string{"10.0.0.0/8", "2001:db8::/32", "127.0.0.1"}, Deny: []string{"10.0.0.0/33"}}
+	testConfig.Admin.ACL = &ACL{Allow: []string{"internal"}}
+	testConfig.Services[0].ACL = &ACL{Deny: []string{"10.1.2.3/8", "10.1.2.x"}}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 3, "Service my-service ACL deny \"10.1.2.x\" is not a CIDR or IP address")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Geo = &Geo{Database: "GeoLite2-Country.mmdb"}
+	testConfig.Services[0].RegionServices = map[string]string{"Brazil": "other-service"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 2, "Service my-service sends region Brazil to \"other-service\", which is not another service")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].AccessLog = &ServiceAccessLog{SampleRatio: -1, Redact: []string{"status"}}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 2, "Service my-service redacts unknown access log field \"status\"")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Admin.Listen = HostPort{Address: "127.0.0.1", Port: 8081}
+	testConfig.Admin.GRPCListen = testConfig.Admin.Listen
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "Admin GRPCListen is the same as another listener")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Admin.Listen = HostPort{}
+	testConfig.Admin.GRPCListen = HostPort{Address: "127.0.0.1", Port: 8082}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "Admin GRPCListen is set without Admin Listen")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts[0].Weight = -1
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "The 0 host in service my-service has a negative weight")
+
 	goldenConfig.Copy(&testConfig)
 	testConfig.Services = []Service{}
 	errs = ValidateConfig(&testConfig)
@@ -151,6 +533,73 @@ func TestValidateConfig(t *testing.T) {
 	errs = ValidateConfig(&testConfig)
 	checkErr(errs, 1, "The 0 host in service my-service has no port")
 
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts[0] = HostPort{Address: "unix:///run/app.sock"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 0, "")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts[0] = HostPort{Address: "unix://run/app.sock"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "The 0 host in service my-service has no absolute socket path")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts[0] = HostPort{Address: "unix:///run/app.sock", Port: 80}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "The 0 host in service my-service is a Unix socket and has a port")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Resolvers = []string{"127.0.0.1"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, `Resolver 0 ("127.0.0.1") is not a host:port pair`)
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = nil
+	testConfig.Services[0].Discovery = &Discovery{Type: DiscoveryDNSSRV, Name: "_http._tcp.my-service"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 0, "")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Discovery = &Discovery{Type: DiscoveryDNSSRV, Name: "_http._tcp.my-service"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "Service my-service has both hosts and discovery")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = nil
+	testConfig.Services[0].Discovery = &Discovery{Type: "zookeeper", Name: "my-service"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, `Discovery for service my-service has unknown type "zookeeper"`)
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = nil
+	testConfig.Services[0].Discovery = &Discovery{Type: DiscoveryDNS}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 2, "Discovery for service my-service has no port")
+	checkErr(errs, 2, "Discovery for service my-service has no name")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = nil
+	testConfig.Services[0].Discovery = &Discovery{Type: DiscoveryDNSSRV, Name: "_http._tcp.my-service", Interval: -time.Second}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "Discovery for service my-service has a negative interval")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = nil
+	testConfig.Services[0].Discovery = &Discovery{Type: DiscoveryKubernetes, Name: "my-service"}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "Discovery for service my-service has no namespace")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = nil
+	testConfig.Services[0].Discovery = &Discovery{Type: DiscoveryFile}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "Discovery for service my-service has no path")
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Readiness = Readiness{Critical: true, MinHealthyHosts: -1}
+	errs = ValidateConfig(&testConfig)
+	checkErr(errs, 1, "Service my-service has a negative minHealthyHosts")
+
 	// Check multiple errors are reported
 	goldenConfig.Copy(&testConfig)
 	testConfig.Listen.Port = 0
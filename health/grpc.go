@@ -0,0 +1,107 @@
+package health
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultWatchInterval is how often a GRPCServer re-runs checks for
+// Watch calls.
+const DefaultWatchInterval = 5 * time.Second
+
+// A GRPCServer implements the standard gRPC health service,
+// grpc.health.v1.Health, reporting the status of a Registry for each
+// service name. The empty service name is the server's overall health,
+// as the protocol requires.
+type GRPCServer struct {
+	healthpb.UnimplementedHealthServer
+
+	services map[string]*Registry
+	// WatchInterval is how often checks are re-run to detect status
+	// changes for Watch, DefaultWatchInterval if not set
+	WatchInterval time.Duration
+}
+
+// NewGRPCServer returns a GRPCServer that reports the health of each
+// registry in services under its service name.
+func NewGRPCServer(services map[string]*Registry) *GRPCServer {
+	return &GRPCServer{services: services}
+}
+
+// Register registers the health service with s.
+func (h *GRPCServer) Register(s grpc.ServiceRegistrar) {
+	healthpb.RegisterHealthServer(s, h)
+}
+
+// servingStatus runs the registry's checks and returns its status.
+func servingStatus(ctx context.Context, r *Registry) healthpb.HealthCheckResponse_ServingStatus {
+	if err := r.Check(ctx); err != nil {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+// Check implements grpc.health.v1.Health.Check.
+func (h *GRPCServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	r, ok := h.services[req.GetService()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+	return &healthpb.HealthCheckResponse{Status: servingStatus(ctx, r)}, nil
+}
+
+// List implements grpc.health.v1.Health.List.
+func (h *GRPCServer) List(ctx context.Context, req *healthpb.HealthListRequest) (*healthpb.HealthListResponse, error) {
+	resp := &healthpb.HealthListResponse{
+		Statuses: make(map[string]*healthpb.HealthCheckResponse),
+	}
+	for name, r := range h.services {
+		resp.Statuses[name] = &healthpb.HealthCheckResponse{Status: servingStatus(ctx, r)}
+	}
+	return resp, nil
+}
+
+// Watch implements grpc.health.v1.Health.Watch. It sends the current
+// status, and then the new status each time it changes, until the client
+// goes away. The set of services is fixed, so an unknown service is
+// reported as SERVICE_UNKNOWN once.
+func (h *GRPCServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ctx := stream.Context()
+
+	r, ok := h.services[req.GetService()]
+	if !ok {
+		if err := stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVICE_UNKNOWN}); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+
+	interval := h.WatchInterval
+	if interval == 0 {
+		interval = DefaultWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		if s := servingStatus(ctx, r); s != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: s}); err != nil {
+				return err
+			}
+			last = s
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-ticker.C:
+		}
+	}
+}
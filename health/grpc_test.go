@@ -0,0 +1,116 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startGRPCServer serves h over an in-memory connection and returns a
+// client for it, and a function to stop both.
+func startGRPCServer(t *testing.T, h *GRPCServer) (healthpb.HealthClient, func()) {
+	l := bufconn.Listen(1 << 16)
+	s := grpc.NewServer()
+	h.Register(s)
+	go s.Serve(l)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return healthpb.NewHealthClient(conn), func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+// TestGRPCServer verifies Check, List and Watch.
+func TestGRPCServer(t *testing.T) {
+	var failing atomic.Bool
+	overall := NewRegistry()
+	overall.MustRegister(Check{Name: "toggle", Func: func(context.Context) error {
+		if failing.Load() {
+			return errors.New("toggle is failing")
+		}
+		return nil
+	}})
+	live := NewRegistry()
+	live.MustRegister(Check{Name: "ping", Func: ok})
+
+	h := NewGRPCServer(map[string]*Registry{"": overall, "liveness": live})
+	h.WatchInterval = 10 * time.Millisecond
+	client, stop := startGRPCServer(t, h)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var tests = []struct {
+		service string
+		failing bool
+		want    healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{"", false, healthpb.HealthCheckResponse_SERVING},
+		{"", true, healthpb.HealthCheckResponse_NOT_SERVING},
+		{"liveness", true, healthpb.HealthCheckResponse_SERVING},
+	}
+
+	for _, tt := range tests {
+		failing.Store(tt.failing)
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: tt.service})
+		if err != nil {
+			t.Fatalf("%q: %v", tt.service, err)
+		}
+		if resp.Status != tt.want {
+			t.Errorf("%q failing=%v: got %v, want %v", tt.service, tt.failing, resp.Status, tt.want)
+		}
+	}
+
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("unknown service: got %v, want NotFound", err)
+	}
+
+	list, err := client.List(ctx, &healthpb.HealthListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Statuses) != 2 || list.Statuses[""].Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("got list %v", list.Statuses)
+	}
+
+	// Watch reports the current status, then each change
+	failing.Store(false)
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []healthpb.HealthCheckResponse_ServingStatus{
+		healthpb.HealthCheckResponse_SERVING,
+		healthpb.HealthCheckResponse_NOT_SERVING,
+	} {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != want {
+			t.Errorf("watch: got %v, want %v", resp.Status, want)
+		}
+		failing.Store(true)
+	}
+}
@@ -0,0 +1,205 @@
+// Package health provides named health checks that can be composed in to
+// a registry and served over HTTP or as a gRPC health service.
+//
+// A server typically has two registries. Liveness checks fail only if
+// the process is so broken that restarting it is the best course of
+// action. Readiness checks fail if the process should not be sent
+// traffic at the moment, e.g., because a dependency is unavailable.
+package health
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout bounds a check that doesn't set its own Timeout.
+const DefaultTimeout = 5 * time.Second
+
+// A CheckFunc determines whether something is healthy, and returns a
+// non-nil error if it is not. It should return promptly once ctx is
+// done.
+type CheckFunc func(ctx context.Context) error
+
+// A Check is a named CheckFunc.
+//
+// Timeout bounds each run of the check, DefaultTimeout if not set. A
+// check that runs for longer fails, even if Func ignores its context.
+//
+// CacheFor is how long a result is reused before the check is run again.
+// Expensive checks should set it so that frequent probes don't overload
+// whatever they check. Results are not cached if it is not set.
+type Check struct {
+	Name     string
+	Func     CheckFunc
+	Timeout  time.Duration
+	CacheFor time.Duration
+}
+
+// A Result is the result of running a Check.
+type Result struct {
+	Name     string        `json:"name"`
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Checked  time.Time     `json:"checked"`
+	Duration time.Duration `json:"duration"`
+}
+
+// A registered is a Check in a Registry, with its cached result.
+type registered struct {
+	Check
+
+	// mu serialises runs of the check, so that concurrent callers share
+	// a cached result rather than each running the check
+	mu   sync.Mutex
+	last *Result
+}
+
+// A Registry is a set of checks that are composed in to a single check,
+// which passes only if every check in the set passes. It is safe for
+// concurrent use.
+type Registry struct {
+	mu     sync.Mutex
+	checks []*registered
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds c to the registry. It returns an error if c has no name
+// or function, or its name is already registered.
+func (r *Registry) Register(c Check) error {
+	if c.Name == "" {
+		return errors.New("health check has no name")
+	}
+	if c.Func == nil {
+		return errors.Errorf("health check %s has no function", c.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rc := range r.checks {
+		if rc.Name == c.Name {
+			return errors.Errorf("health check %s is already registered", c.Name)
+		}
+	}
+	r.checks = append(r.checks, &registered{Check: c})
+	return nil
+}
+
+// MustRegister registers each check and panics if any registration
+// fails.
+func (r *Registry) MustRegister(checks ...Check) {
+	for _, c := range checks {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Names returns the names of the registered checks, in the order they
+// were registered.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var names []string
+	for _, rc := range r.checks {
+		names = append(names, rc.Name)
+	}
+	return names
+}
+
+// Run runs every check concurrently, or reuses its cached result, and
+// returns the results in the order the checks were registered.
+func (r *Registry) Run(ctx context.Context) []Result {
+	r.mu.Lock()
+	checks := append([]*registered(nil), r.checks...)
+	r.mu.Unlock()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, rc := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = rc.run(ctx)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Check runs every check, and fails if any of them fail, with an error
+// that lists each failure.
+func (r *Registry) Check(ctx context.Context) error {
+	return Err(r.Run(ctx))
+}
+
+// Err returns an error listing the failed results, one per line, or nil
+// if none failed.
+func Err(results []Result) error {
+	var msgs []string
+	for _, res := range results {
+		if !res.OK {
+			msgs = append(msgs, res.Error)
+		}
+	}
+	if msgs == nil {
+		return nil
+	}
+	sort.Strings(msgs)
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// run returns the check's cached result, if it is fresh, or runs the
+// check.
+func (rc *registered) run(ctx context.Context) Result {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.last != nil && time.Since(rc.last.Checked) < rc.CacheFor {
+		return *rc.last
+	}
+
+	timeout := rc.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	res := Result{Name: rc.Name, Checked: time.Now()}
+
+	// The check runs in its own goroutine so that one that ignores its
+	// context can't hold up the caller. It is left to finish in the
+	// background.
+	done := make(chan error, 1)
+	go func() { done <- rc.Func(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.Errorf("%s: timed out after %v", rc.Name, timeout)
+	}
+
+	res.Duration = time.Since(res.Checked)
+	res.OK = err == nil
+	if err != nil {
+		res.Error = err.Error()
+	}
+	// A result cut short by the caller going away says nothing about
+	// the check, so isn't cached
+	if parent.Err() == nil {
+		rc.last = &res
+	}
+	return res
+}
@@ -0,0 +1,181 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ok is a CheckFunc that always passes.
+func ok(context.Context) error { return nil }
+
+// TestRegister verifies that invalid and duplicate checks are rejected.
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+
+	var tests = []struct {
+		check Check
+		err   string
+	}{
+		{Check{Name: "a", Func: ok}, ""},
+		{Check{Name: "b", Func: ok}, ""},
+		{Check{Name: "a", Func: ok}, "health check a is already registered"},
+		{Check{Func: ok}, "health check has no name"},
+		{Check{Name: "c"}, "health check c has no function"},
+	}
+
+	for _, tt := range tests {
+		err := r.Register(tt.check)
+		if tt.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tt.check, err)
+		}
+		if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%+v: got error '%v', want '%s'", tt.check, err, tt.err)
+		}
+	}
+
+	if got := strings.Join(r.Names(), ","); got != "a,b" {
+		t.Errorf("got names %s, want a,b", got)
+	}
+}
+
+// TestRun verifies that every check's result is reported, in order, and
+// that the registry fails if any check fails.
+func TestRun(t *testing.T) {
+	r := NewRegistry()
+	r.MustRegister(
+		Check{Name: "pass", Func: ok},
+		Check{Name: "fail", Func: func(context.Context) error { return errors.New("broken") }},
+	)
+
+	results := r.Run(context.Background())
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if results[0].Name != "pass" || !results[0].OK {
+		t.Errorf("got %+v, want pass to pass", results[0])
+	}
+	if results[1].Name != "fail" || results[1].OK || results[1].Error != "broken" {
+		t.Errorf("got %+v, want fail to fail with 'broken'", results[1])
+	}
+
+	if err := r.Check(context.Background()); err == nil || err.Error() != "broken" {
+		t.Errorf("got error '%v', want 'broken'", err)
+	}
+	if err := NewRegistry().Check(context.Background()); err != nil {
+		t.Errorf("empty registry: unexpected error: %v", err)
+	}
+}
+
+// TestTimeout verifies that a check that doesn't return in time fails,
+// even if it ignores its context.
+func TestTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	r := NewRegistry()
+	r.MustRegister(Check{
+		Name:    "slow",
+		Func:    func(context.Context) error { <-block; return nil },
+		Timeout: 10 * time.Millisecond,
+	})
+
+	start := time.Now()
+	err := r.Check(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got error '%v', want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("check took %v, want it to time out after 10ms", elapsed)
+	}
+}
+
+// TestCache verifies that results are reused for CacheFor.
+func TestCache(t *testing.T) {
+	var runs atomic.Int32
+	count := func(context.Context) error {
+		runs.Add(1)
+		return nil
+	}
+
+	r := NewRegistry()
+	r.MustRegister(
+		Check{Name: "cached", Func: count, CacheFor: time.Hour},
+		Check{Name: "uncached", Func: count},
+	)
+
+	for i := 0; i < 3; i++ {
+		r.Run(context.Background())
+	}
+	// cached runs once, uncached every time
+	if got := runs.Load(); got != 4 {
+		t.Errorf("got %d runs, want 4", got)
+	}
+}
+
+// TestHandler verifies the terse and verbose HTTP responses.
+func TestHandler(t *testing.T) {
+	var failing atomic.Bool
+	r := NewRegistry()
+	r.MustRegister(
+		Check{Name: "pass", Func: ok},
+		Check{Name: "toggle", Func: func(context.Context) error {
+			if failing.Load() {
+				return errors.New("toggle is failing")
+			}
+			return nil
+		}},
+	)
+
+	ts := httptest.NewServer(Handler(r))
+	defer ts.Close()
+
+	var tests = []struct {
+		failing bool
+		path    string
+		code    int
+		body    string
+	}{
+		{false, "/", http.StatusOK, "ok"},
+		{true, "/", http.StatusServiceUnavailable, "toggle is failing"},
+	}
+
+	for _, tt := range tests {
+		failing.Store(tt.failing)
+		resp, err := http.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("failing=%v: got %d, want %d", tt.failing, resp.StatusCode, tt.code)
+		}
+		if strings.TrimSpace(string(body)) != tt.body {
+			t.Errorf("failing=%v: got '%s', want '%s'", tt.failing, body, tt.body)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/?verbose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got response
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || got.Status != "failed" {
+		t.Errorf("got %d %s, want %d failed", resp.StatusCode, got.Status, http.StatusServiceUnavailable)
+	}
+	if len(got.Checks) != 2 || !got.Checks[0].OK || got.Checks[1].Error != "toggle is failing" {
+		t.Errorf("got checks %+v", got.Checks)
+	}
+}
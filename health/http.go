@@ -0,0 +1,49 @@
+package health
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// A response is the verbose response from Handler.
+type response struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// Handler returns an http.Handler that runs the checks in r. It responds
+// "ok" if they pass, and 503 with the failures, one per line, if not. If
+// the "verbose" query parameter is present the result of every check is
+// returned as JSON instead.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		results := r.Run(req.Context())
+		err := Err(results)
+
+		if _, verbose := req.URL.Query()["verbose"]; verbose {
+			resp := response{Status: "ok", Checks: results}
+			code := http.StatusOK
+			if err != nil {
+				resp.Status = "failed"
+				code = http.StatusServiceUnavailable
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(resp); err != nil {
+				slog.Warn("writing health check response failed", "err", err)
+			}
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"afe/config"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// redacted replaces the value of a redacted access log field.
+const redacted = "REDACTED"
+
+// clfTimeFormat is the time format of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// An accessRecord is the access log record of one request.
+type accessRecord struct {
+	Time      time.Time
+	RequestID string
+	ClientIP  string
+	Method    string
+	Path      string
+	Query     string
+	Proto     string
+	UserAgent string
+	Referer   string
+	Service   string
+	Backend   string
+	Status    int
+	Bytes     int64
+	Duration  time.Duration
+	// Phases are the phases of the request to the backend, if it was
+	// sent to one
+	Phases []namedPhase
+}
+
+// newAccessRecord returns the access log record of req, received at
+// start, with the fields known before it is handled.
+func newAccessRecord(req *http.Request, start time.Time) *accessRecord {
+	id, _ := requestIDFromContext(req.Context())
+
+	return &accessRecord{
+		Time:      start,
+		RequestID: id,
+		ClientIP:  remoteIP(req),
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Query:     req.URL.RawQuery,
+		Proto:     req.Proto,
+		UserAgent: req.UserAgent(),
+		Referer:   req.Referer(),
+	}
+}
+
+// remoteIP returns the IP address req was received from.
+func remoteIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
+
+// redact replaces the values of fields, which are AccessLogRedactable.
+func (r *accessRecord) redact(fields []string) {
+	for _, field := range fields {
+		switch field {
+		case "client_ip":
+			r.ClientIP = redacted
+		case "path":
+			r.Path = redacted
+		case "query":
+			if r.Query != "" {
+				r.Query = redacted
+			}
+		case "user_agent":
+			r.UserAgent = redacted
+		case "referer":
+			r.Referer = redacted
+		}
+	}
+}
+
+// uri returns the request's path and query, as in its request line.
+func (r *accessRecord) uri() string {
+	if r.Query == "" {
+		return r.Path
+	}
+	return r.Path + "?" + r.Query
+}
+
+// An accessField is a field of a structured access log record.
+type accessField struct {
+	Key   string
+	Value interface{}
+}
+
+// fields returns the record's fields in the order they are logged. Empty
+// fields are left out, as are phases that didn't happen.
+func (r *accessRecord) fields() []accessField {
+	fields := []accessField{
+		{"time", r.Time.UTC().Format(time.RFC3339Nano)},
+		{"request_id", r.RequestID},
+		{"client_ip", r.ClientIP},
+		{"method", r.Method},
+		{"path", r.Path},
+		{"query", r.Query},
+		{"proto", r.Proto},
+		{"user_agent", r.UserAgent},
+		{"referer", r.Referer},
+		{"service", r.Service},
+		{"backend", r.Backend},
+		{"status", r.Status},
+		{"bytes", r.Bytes},
+		{"duration_ms", milliseconds(r.Duration)},
+	}
+	for _, p := range r.Phases {
+		if p.Valid {
+			fields = append(fields, accessField{p.Name + "_ms", milliseconds(p.Duration)})
+		}
+	}
+
+	nonEmpty := fields[:0]
+	for _, f := range fields {
+		if f.Value != "" {
+			nonEmpty = append(nonEmpty, f)
+		}
+	}
+	return nonEmpty
+}
+
+// milliseconds returns d in milliseconds, to the microsecond.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// An accessFormatter appends a record to buf, without a trailing newline.
+type accessFormatter func(buf *bytes.Buffer, r *accessRecord)
+
+// accessFormatters maps each access log format to its formatter.
+var accessFormatters = map[string]accessFormatter{
+	config.AccessLogJSON:     formatJSON,
+	config.AccessLogLogfmt:   formatLogfmt,
+	config.AccessLogCommon:   formatCommon,
+	config.AccessLogCombined: formatCombined,
+}
+
+func formatJSON(buf *bytes.Buffer, r *accessRecord) {
+	buf.WriteByte('{')
+	for i, f := range r.fields() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.Key)
+		value, _ := json.Marshal(f.Value)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
+
+func formatLogfmt(buf *bytes.Buffer, r *accessRecord) {
+	for i, f := range r.fields() {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		value := fmt.Sprint(f.Value)
+		if strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, isControl) >= 0 {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
+
+// formatCommon formats r in the Common Log Format. There are no fields
+// for the proxy's own details, such as the service and backend.
+func formatCommon(buf *bytes.Buffer, r *accessRecord) {
+	size := "-"
+	if r.Bytes > 0 {
+		size = strconv.FormatInt(r.Bytes, 10)
+	}
+	fmt.Fprintf(buf, "%s - - [%s] %s %d %s",
+		clfValue(r.ClientIP), r.Time.Format(clfTimeFormat),
+		strconv.Quote(r.Method+" "+r.uri()+" "+r.Proto), r.Status, size)
+}
+
+// formatCombined formats r in the Combined Log Format.
+func formatCombined(buf *bytes.Buffer, r *accessRecord) {
+	formatCommon(buf, r)
+	fmt.Fprintf(buf, " %s %s", strconv.Quote(clfValue(r.Referer)), strconv.Quote(clfValue(r.UserAgent)))
+}
+
+// clfValue returns s, or "-" if it is empty.
+func clfValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// An accessLogger writes access log records.
+type accessLogger struct {
+	format accessFormatter
+	// mu serialises writes to w, so records aren't interleaved
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// newAccessLogger returns an accessLogger configured by cfg.
+func newAccessLogger(cfg *config.AccessLog) (*accessLogger, error) {
+	format := cfg.Format
+	if format == "" {
+		format = config.AccessLogJSON
+	}
+	l := &accessLogger{format: accessFormatters[format]}
+
+	var err error
+	switch cfg.Output {
+	case "", config.AccessLogStdout:
+		l.w = nopCloser{os.Stdout}
+	case config.AccessLogFile:
+		maxSize, maxBackups := cfg.MaxSizeMB, cfg.MaxBackups
+		if maxSize == 0 {
+			maxSize = config.DefaultAccessLogMaxSizeMB
+		}
+		if maxBackups == 0 {
+			maxBackups = config.DefaultAccessLogMaxBackups
+		}
+		l.w, err = newRotatingFile(cfg.Path, int64(maxSize)<<20, maxBackups)
+	case config.AccessLogSyslog:
+		l.w, err = syslog.Dial(cfg.SyslogNetwork, cfg.SyslogAddress, syslog.LOG_INFO|syslog.LOG_LOCAL0, "afe-lb")
+		err = errors.Wrap(err, "connecting to syslog failed")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// log writes r to the access log.
+func (l *accessLogger) log(r *accessRecord) {
+	var buf bytes.Buffer
+	l.format(&buf, r)
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(buf.Bytes()); err != nil {
+		slog.Error("writing access log record failed", "err", err)
+	}
+}
+
+// Close closes the access log's output.
+func (l *accessLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+// logAccess logs the request described by r to the access log, if there
+// is one and the request is sampled. svc is the service it was for and b
+// the backend it was sent to, either of which may be nil.
+func (proxy *Proxy) logAccess(r *accessRecord, rec *responseRecorder, svc *service, b *backendState, stats *httpTraceStats) {
+	if proxy.accessLog == nil {
+		return
+	}
+
+	r.Status = rec.status
+	r.Bytes = rec.written
+	r.Duration = time.Since(r.Time)
+
+	var policy *config.ServiceAccessLog
+	if svc != nil {
+		r.Service = svc.name
+		policy = svc.accessLog
+	}
+	if b != nil {
+		r.Backend = b.backend.String()
+		r.Phases = stats.namedPhases()
+	}
+
+	if policy != nil {
+		// Server errors are always logged
+		if policy.SampleRatio != 0 && r.Status < 500 && rand.Float64() >= policy.SampleRatio {
+			return
+		}
+		r.redact(policy.Redact)
+	}
+
+	proxy.accessLog.log(r)
+}
+
+// A rotatingFile is a file that is rotated when it would grow beyond
+// maxSize bytes. The file at path is renamed path.1, the previous path.1
+// renamed path.2, and so on, keeping maxBackups previous files.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+// newRotatingFile opens the file at path for appending, creating it if
+// necessary.
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s failed", r.path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "stat of %s failed", r.path)
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file to path.1, shifting the previous files
+// along, and opens a new file.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return errors.Wrapf(err, "closing %s failed", r.path)
+	}
+	for i := r.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return errors.Wrapf(err, "rotating %s failed", r.path)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// nopCloser is an io.WriteCloser whose Close does nothing, so that
+// standard output isn't closed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"afe/config"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	r := &accessRecord{
+		Time:      time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC),
+		RequestID: "req-1",
+		ClientIP:  "192.0.2.1",
+		Method:    "GET",
+		Path:      "/a b",
+		Query:     "s=my-service.my-company.com",
+		Proto:     "HTTP/1.1",
+		UserAgent: "curl/8.0",
+		Service:   "my-service",
+		Backend:   "127.0.0.1:9090",
+		Status:    200,
+		Bytes:     42,
+		Duration:  1500 * time.Microsecond,
+		Phases: []namedPhase{
+			{"dns", tracePhase{}},
+			{"connect", tracePhase{Duration: 250 * time.Microsecond, Valid: true}},
+		},
+	}
+
+	var tests = []struct {
+		format string
+		want   string
+	}{
+		{config.AccessLogJSON, `{"time":"2024-03-01T12:30:45Z","request_id":"req-1","client_ip":"192.0.2.1","method":"GET","path":"/a b","query":"s=my-service.my-company.com","proto":"HTTP/1.1","user_agent":"curl/8.0","service":"my-service","backend":"127.0.0.1:9090","status":200,"bytes":42,"duration_ms":1.5,"connect_ms":0.25}`},
+		{config.AccessLogLogfmt, `time=2024-03-01T12:30:45Z request_id=req-1 client_ip=192.0.2.1 method=GET path="/a b" query="s=my-service.my-company.com" proto=HTTP/1.1 user_agent=curl/8.0 service=my-service backend=127.0.0.1:9090 status=200 bytes=42 duration_ms=1.5 connect_ms=0.25`},
+		{config.AccessLogCommon, `192.0.2.1 - - [01/Mar/2024:12:30:45 +0000] "GET /a b?s=my-service.my-company.com HTTP/1.1" 200 42`},
+		{config.AccessLogCombined, `192.0.2.1 - - [01/Mar/2024:12:30:45 +0000] "GET /a b?s=my-service.my-company.com HTTP/1.1" 200 42 "-" "curl/8.0"`},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		accessFormatters[tt.format](&buf, r)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.format, got, tt.want)
+		}
+	}
+}
+
+// TestAccessLogPolicy verifies that a service's requests are sampled and
+// redacted as configured.
+func TestAccessLogPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(w, "body")
+	}))
+	defer backend.Close()
+
+	var tests = []struct {
+		name   string
+		policy *config.ServiceAccessLog
+		query  string
+		// want is the logged query, or empty if nothing should be logged
+		want string
+	}{
+		{"all", nil, "s=my-service.my-company.com&x=1", "s=my-service.my-company.com&x=1"},
+		{"redacted", &config.ServiceAccessLog{Redact: []string{"client_ip", "query"}}, "s=my-service.my-company.com&x=1", redacted},
+		{"sampled out", &config.ServiceAccessLog{SampleRatio: 1e-9}, "s=my-service.my-company.com&x=1", ""},
+		{"server error", &config.ServiceAccessLog{SampleRatio: 1e-9}, "s=my-service.my-company.com&fail=1", "s=my-service.my-company.com&fail=1"},
+	}
+
+	for _, tt := range tests {
+		testConfig := config.ProxyConfig{}
+		goldenConfig.Copy(&testConfig)
+		testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+		testConfig.Services[0].AccessLog = tt.policy
+		proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		var buf bytes.Buffer
+		proxy.accessLog = &accessLogger{format: formatJSON, w: nopCloser{&buf}}
+		ts := httptest.NewServer(proxy)
+
+		resp, err := http.Get(ts.URL + "/?" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		ts.Close()
+		proxy.Close()
+
+		if tt.want == "" {
+			if buf.Len() != 0 {
+				t.Errorf("%s: got %s, want nothing logged", tt.name, buf.String())
+			}
+			continue
+		}
+
+		var got map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Errorf("%s: got %s, %v", tt.name, buf.String(), err)
+			continue
+		}
+		if got["query"] != tt.want {
+			t.Errorf("%s: got query %v, want %s", tt.name, got["query"], tt.want)
+		}
+		if got["service"] != "my-service" || got["backend"] != backendHostPort(t, backend).String() {
+			t.Errorf("%s: got service %v, backend %v", tt.name, got["service"], got["backend"])
+		}
+		if got["bytes"] != 4.0 {
+			t.Errorf("%s: got %v bytes, want 4", tt.name, got["bytes"])
+		}
+		if _, ok := got["total_ms"]; !ok {
+			t.Errorf("%s: got no total_ms in %v", tt.name, got)
+		}
+		wantIP := "127.0.0.1"
+		if tt.policy != nil && len(tt.policy.Redact) > 0 {
+			wantIP = redacted
+		}
+		if got["client_ip"] != wantIP {
+			t.Errorf("%s: got client_ip %v, want %s", tt.name, got["client_ip"], wantIP)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := newRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	var tests = []struct {
+		path string
+		want string
+	}{
+		{path, "fourth\n"},
+		{path + ".1", "third\n"},
+		{path + ".2", "second\n"},
+	}
+	for _, tt := range tests {
+		got, err := ioutil.ReadFile(tt.path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", filepath.Base(tt.path), got, tt.want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("got %s.3, want only 2 backups", filepath.Base(path))
+	}
+
+	// Reopening appends to the existing file
+	f, err = newRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("fifth\n"))
+	f.Close()
+	if got, _ := ioutil.ReadFile(path); !strings.HasPrefix(string(got), "fourth\n") {
+		t.Errorf("got %q after reopening, want appended", got)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// adminForbidden counts the requests to the admin listeners refused by the
+// admin ACL. Requests to services are counted in proxyErrors.
+var adminForbidden = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_admin_forbidden_total",
+		Help: "Requests to the admin listeners refused by the admin ACL, by listener.",
+	},
+	[]string{"listener"},
+)
+
+// An acl is a parsed config.ACL. A nil acl allows every client.
+type acl struct {
+	allow, deny []netip.Prefix
+}
+
+// newACL returns the acl configured by cfg, nil if cfg is nil.
+func newACL(cfg *config.ACL) (*acl, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	a := &acl{}
+	for _, entry := range cfg.Allow {
+		p, err := config.ParsePrefix(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing ACL allow %q failed", entry)
+		}
+		a.allow = append(a.allow, p)
+	}
+	for _, entry := range cfg.Deny {
+		p, err := config.ParsePrefix(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing ACL deny %q failed", entry)
+		}
+		a.deny = append(a.deny, p)
+	}
+	return a, nil
+}
+
+// allows returns true if a client at remoteAddr, a "host:port" as in
+// http.Request.RemoteAddr, is allowed. A client whose address isn't an IP
+// address, such as one connected over a Unix socket, is in no CIDR.
+func (a *acl) allows(remoteAddr string) bool {
+	if a == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return len(a.allow) == 0
+	}
+	// An IPv4 client of a dual-stack listener has a mapped address
+	addr = addr.Unmap().WithZone("")
+
+	for _, p := range a.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, p := range a.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminACL returns the admin ACL of the current configuration.
+func (proxy *Proxy) adminACL() *acl {
+	table := proxy.routes()
+	if table == nil {
+		return nil
+	}
+	return table.adminACL
+}
+
+// withAdminACL returns a handler that refuses requests from clients the
+// admin ACL doesn't allow, and passes the others to h.
+func withAdminACL(proxy *Proxy, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !proxy.adminACL().allows(req.RemoteAddr) {
+			adminForbidden.WithLabelValues(adminListener).Inc()
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// grpcAdminACL returns the gRPC server options that refuse calls from
+// clients the admin ACL doesn't allow.
+func grpcAdminACL(proxy *Proxy) []grpc.ServerOption {
+	check := func(ctx context.Context) error {
+		var addr string
+		if p, ok := peer.FromContext(ctx); ok {
+			addr = p.Addr.String()
+		}
+		if !proxy.adminACL().allows(addr) {
+			adminForbidden.WithLabelValues(grpcListener).Inc()
+			return status.Error(codes.PermissionDenied, "forbidden")
+		}
+		return nil
+	}
+
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := check(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := check(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestACLAllows(t *testing.T) {
+	internal := &config.ACL{Allow: []string{"10.0.0.0/8", "2001:db8::/32"}, Deny: []string{"10.1.2.3"}}
+	blocked := &config.ACL{Deny: []string{"192.0.2.0/24"}}
+
+	var tests = []struct {
+		cfg        *config.ACL
+		remoteAddr string
+		want       bool
+	}{
+		{nil, "192.0.2.1:1234", true},
+		{internal, "10.0.0.1:1234", true},
+		{internal, "[::ffff:10.0.0.1]:1234", true},
+		{internal, "[2001:db8::1]:1234", true},
+		{internal, "[fe80::1%eth0]:1234", false},
+		{internal, "10.1.2.3:1234", false},
+		{internal, "192.0.2.1:1234", false},
+		// Not an IP address, e.g., a Unix socket client
+		{internal, "@", false},
+		{blocked, "192.0.2.1:1234", false},
+		{blocked, "10.0.0.1:1234", true},
+		{blocked, "@", true},
+		{&config.ACL{}, "192.0.2.1:1234", true},
+	}
+
+	for _, tt := range tests {
+		a, err := newACL(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.allows(tt.remoteAddr); got != tt.want {
+			t.Errorf("%+v allows %s: got %t, want %t", tt.cfg, tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+// TestProxyACL verifies that requests and health checks from clients the
+// proxy's ACL doesn't allow are refused, and that a reload changes the
+// ACL.
+func TestProxyACL(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+	testConfig.ACL = &config.ACL{Allow: []string{"192.0.2.0/24"}}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	get := func(healthCheck bool) int {
+		req, _ := http.NewRequest("GET", ts.URL+"/?s=my-service.my-company.com", nil)
+		if healthCheck {
+			req.Header.Set("health-check", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	forbidden := testutil.ToFloat64(proxyErrors.WithLabelValues("", reasonForbidden))
+	if code := get(false); code != http.StatusForbidden {
+		t.Errorf("got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := get(true); code != http.StatusForbidden {
+		t.Errorf("health check: got %d, want %d", code, http.StatusForbidden)
+	}
+	if got := testutil.ToFloat64(proxyErrors.WithLabelValues("", reasonForbidden)) - forbidden; got != 2 {
+		t.Errorf("got %v forbidden requests, want 2", got)
+	}
+
+	testConfig.ACL.Allow = append(testConfig.ACL.Allow, "127.0.0.0/8")
+	if errs := proxy.Reload(&testConfig); errs != nil {
+		t.Fatal(errs)
+	}
+	if code := get(false); code != http.StatusOK {
+		t.Errorf("after reload: got %d, want %d", code, http.StatusOK)
+	}
+	if code := get(true); code != http.StatusOK {
+		t.Errorf("health check after reload: got %d, want %d", code, http.StatusOK)
+	}
+}
+
+// TestAdminACL verifies that requests to the admin listeners from clients
+// the admin ACL doesn't allow are refused, other than liveness and
+// readiness checks.
+func TestAdminACL(t *testing.T) {
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Admin.ACL = &config.ACL{Deny: []string{"127.0.0.1"}}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	ts := httptest.NewServer(newAdminHandler(proxy, nil))
+	defer ts.Close()
+
+	forbidden := testutil.ToFloat64(adminForbidden.WithLabelValues(adminListener))
+	if code := adminRequest(t, ts, "GET", "/api/services", nil); code != http.StatusForbidden {
+		t.Errorf("got %d, want %d", code, http.StatusForbidden)
+	}
+	if got := testutil.ToFloat64(adminForbidden.WithLabelValues(adminListener)) - forbidden; got != 1 {
+		t.Errorf("got %v forbidden admin requests, want 1", got)
+	}
+	// The kubelet's probes aren't subject to the ACL
+	for _, path := range []string{"/livez", "/readyz"} {
+		if code := adminRequest(t, ts, "GET", path, nil); code != http.StatusOK {
+			t.Errorf("%s: got %d, want %d", path, code, http.StatusOK)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newGRPCHealthServer(proxy)
+	go s.Serve(l)
+	defer s.Stop()
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if got := status.Code(err); got != codes.PermissionDenied {
+		t.Errorf("gRPC: got %v, want %v", got, codes.PermissionDenied)
+	}
+
+	testConfig.Admin.ACL = nil
+	if errs := proxy.Reload(&testConfig); errs != nil {
+		t.Fatal(errs)
+	}
+	// The configuration reported is the one enforced
+	if got := proxy.routes().config.Admin.ACL; got != nil {
+		t.Errorf("after reload: got admin ACL %+v, want none", got)
+	}
+	if code := adminRequest(t, ts, "GET", "/api/services", nil); code != http.StatusOK {
+		t.Errorf("after reload: got %d, want %d", code, http.StatusOK)
+	}
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Errorf("gRPC after reload: %v", err)
+	}
+}
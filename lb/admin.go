@@ -0,0 +1,329 @@
+package main
+
+import (
+	"afe/health"
+	"afe/logging"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var adminActions = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_admin_actions_total",
+		Help: "Changes requested through the admin API by action and result, \"ok\" or \"error\".",
+	},
+	[]string{"action", "result"},
+)
+
+var (
+	backendWeightDesc = prometheus.NewDesc(
+		"proxy_backend_weight",
+		"Effective weight of each backend.",
+		[]string{"service", "backend"}, nil,
+	)
+	backendDrainedDesc = prometheus.NewDesc(
+		"proxy_backend_drained",
+		"1 if the backend has been drained through the admin API, 0 otherwise.",
+		[]string{"service", "backend"}, nil,
+	)
+	backendHealthyDesc = prometheus.NewDesc(
+		"proxy_backend_healthy",
+		"1 if the backend is healthy, 0 if a recent request to it failed.",
+		[]string{"service", "backend"}, nil,
+	)
+	backendInFlightDesc = prometheus.NewDesc(
+		"proxy_backend_in_flight_requests",
+		"Requests currently being proxied to the backend.",
+		[]string{"service", "backend"}, nil,
+	)
+)
+
+// A backendCollector is a prometheus.Collector that reports the state of
+// every backend in the proxy's current routing table when scraped.
+type backendCollector struct {
+	proxy *Proxy
+}
+
+func (c backendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendWeightDesc
+	ch <- backendDrainedDesc
+	ch <- backendHealthyDesc
+	ch <- backendInFlightDesc
+}
+
+func (c backendCollector) Collect(ch chan<- prometheus.Metric) {
+	boolValue := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	for _, svc := range c.proxy.routes().services {
+		for _, b := range svc.pool.list() {
+			labels := []string{svc.name, b.backend.String()}
+			ch <- prometheus.MustNewConstMetric(backendWeightDesc, prometheus.GaugeValue, float64(b.weight()), labels...)
+			ch <- prometheus.MustNewConstMetric(backendDrainedDesc, prometheus.GaugeValue, boolValue(b.drained.Load()), labels...)
+			ch <- prometheus.MustNewConstMetric(backendHealthyDesc, prometheus.GaugeValue, boolValue(b.healthy()), labels...)
+			ch <- prometheus.MustNewConstMetric(backendInFlightDesc, prometheus.GaugeValue, float64(b.inFlight.Load()), labels...)
+		}
+	}
+}
+
+// An adminServer serves the admin API, which reports and changes the
+// proxy's runtime state as JSON. Every change is logged, with the
+// address of the client that made it, and counted in adminActions.
+type adminServer struct {
+	proxy *Proxy
+	// reload reloads the proxy's configuration from its source
+	reload func() []error
+}
+
+// An adminBackend is the admin API's view of a backend.
+type adminBackend struct {
+	Address          string `json:"address"`
+	Healthy          bool   `json:"healthy"`
+	Drained          bool   `json:"drained"`
+	Weight           int    `json:"weight"`
+	ConfiguredWeight int    `json:"configuredWeight"`
+	InFlight         int64  `json:"inFlight"`
+}
+
+// An adminService is the admin API's view of a service.
+type adminService struct {
+	Name     string         `json:"name"`
+	Domain   string         `json:"domain"`
+	Backends []adminBackend `json:"backends"`
+}
+
+// newAdminHandler returns an http.Handler for the admin listener. It
+// serves the control-plane endpoints (metrics, liveness and readiness
+// checks, pprof profiles, and the log level), the dashboard, and the
+// admin API for proxy, which calls reload to reload the configuration.
+// Clients the admin ACL doesn't allow are refused, except from the
+// liveness and readiness checks, which the kubelet probes from the node.
+func newAdminHandler(proxy *Proxy, reload func() []error) http.Handler {
+	a := &adminServer{proxy: proxy, reload: reload}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.Handle("/api/log/level", logging.LevelHandler(&logLevel))
+
+	d := &dashboard{proxy: proxy, gatherer: prometheus.DefaultGatherer, interval: dashboardInterval}
+	mux.HandleFunc("GET /dashboard", d.handlePage)
+	mux.HandleFunc("GET /api/dashboard/events", d.handleEvents)
+
+	mux.HandleFunc("GET /api/config", a.handleConfig)
+	mux.HandleFunc("GET /api/services", a.handleServices)
+	mux.HandleFunc("POST /api/backends/drain", a.handleDrain)
+	mux.HandleFunc("POST /api/backends/enable", a.handleEnable)
+	mux.HandleFunc("POST /api/backends/weight", a.handleWeight)
+	mux.HandleFunc("POST /api/reload", a.handleReload)
+	mux.HandleFunc("GET /api/clients", a.handleClients)
+	mux.HandleFunc("GET /api/captures", a.handleCaptures)
+
+	probes := http.NewServeMux()
+	probes.Handle("GET /livez", health.Handler(proxy.liveness))
+	probes.Handle("GET /readyz", health.Handler(proxy.readiness))
+	probes.Handle("/", withAdminACL(proxy, mux))
+	return probes
+}
+
+// writeJSON writes v to w as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Warn("writing admin response failed", "err", err)
+	}
+}
+
+// writeError writes err to w as a JSON object with the given status
+// code.
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// handleConfig returns the configuration in use.
+func (a *adminServer) handleConfig(w http.ResponseWriter, req *http.Request) {
+	table := a.proxy.routes()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"generation": table.generation,
+		"config":     table.config,
+	})
+}
+
+// handleServices returns each service and the state of its backends.
+func (a *adminServer) handleServices(w http.ResponseWriter, req *http.Request) {
+	table := a.proxy.routes()
+
+	services := []adminService{}
+	for _, svc := range table.services {
+		services = append(services, newAdminService(svc))
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"generation": table.generation,
+		"services":   services,
+	})
+}
+
+// newAdminService returns the admin API's view of svc.
+func newAdminService(svc *service) adminService {
+	as := adminService{Name: svc.name, Domain: svc.domain, Backends: []adminBackend{}}
+	for _, b := range svc.pool.list() {
+		as.Backends = append(as.Backends, newAdminBackend(b))
+	}
+	return as
+}
+
+// newAdminBackend returns the admin API's view of b.
+func newAdminBackend(b *backendState) adminBackend {
+	return adminBackend{
+		Address:          b.backend.String(),
+		Healthy:          b.healthy(),
+		Drained:          b.drained.Load(),
+		Weight:           b.weight(),
+		ConfiguredWeight: int(b.configWeight.Load()),
+		InFlight:         b.inFlight.Load(),
+	}
+}
+
+// findBackend returns the backend named by the request's "service" and
+// "backend" query parameters.
+func (a *adminServer) findBackend(req *http.Request) (*backendState, string, error) {
+	q := req.URL.Query()
+	name, address := q.Get("service"), q.Get("backend")
+
+	svc, ok := a.proxy.routes().service(name)
+	if !ok {
+		return nil, name, errors.Errorf("no service named %q", name)
+	}
+	b, ok := svc.pool.find(address)
+	if !ok {
+		return nil, name, errors.Errorf("service %s has no backend %q", name, address)
+	}
+	return b, name, nil
+}
+
+// changeBackend applies change to the backend named by the request and
+// returns its new state. The change is logged and counted as action. An
+// unknown service or backend is not found, and change returns an error
+// for a bad request.
+func (a *adminServer) changeBackend(w http.ResponseWriter, req *http.Request, action string, change func(*backendState) error) {
+	status := http.StatusNotFound
+	b, name, err := a.findBackend(req)
+	if err == nil {
+		status = http.StatusBadRequest
+		err = change(b)
+	}
+	if err != nil {
+		adminActions.WithLabelValues(action, "error").Inc()
+		slog.Warn("admin action failed", "client", req.RemoteAddr, "action", action, "err", err)
+		writeError(w, status, err)
+		return
+	}
+
+	adminActions.WithLabelValues(action, "ok").Inc()
+	state := newAdminBackend(b)
+	slog.Info("admin action applied", "client", req.RemoteAddr, "action", action,
+		"service", name, "backend", b.backend.String(), "state", fmt.Sprintf("%+v", state))
+	writeJSON(w, http.StatusOK, state)
+}
+
+// handleDrain stops new requests being sent to a backend.
+func (a *adminServer) handleDrain(w http.ResponseWriter, req *http.Request) {
+	a.changeBackend(w, req, "drain", func(b *backendState) error {
+		b.drained.Store(true)
+		return nil
+	})
+}
+
+// handleEnable undoes handleDrain.
+func (a *adminServer) handleEnable(w http.ResponseWriter, req *http.Request) {
+	a.changeBackend(w, req, "enable", func(b *backendState) error {
+		b.drained.Store(false)
+		return nil
+	})
+}
+
+// handleWeight sets a backend's weight from the "weight" query
+// parameter. A weight of 0 restores the configured weight.
+func (a *adminServer) handleWeight(w http.ResponseWriter, req *http.Request) {
+	a.changeBackend(w, req, "weight", func(b *backendState) error {
+		weight, err := strconv.Atoi(req.URL.Query().Get("weight"))
+		if err != nil || weight < 0 {
+			return errors.Errorf("weight %q is not a non-negative integer", req.URL.Query().Get("weight"))
+		}
+		b.weightOverride.Store(int64(weight))
+		return nil
+	})
+}
+
+// handleReload reloads the configuration.
+func (a *adminServer) handleReload(w http.ResponseWriter, req *http.Request) {
+	slog.Info("admin reload requested", "client", req.RemoteAddr)
+
+	if errs := a.reload(); errs != nil {
+		adminActions.WithLabelValues("reload", "error").Inc()
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": msgs})
+		return
+	}
+
+	adminActions.WithLabelValues("reload", "ok").Inc()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"generation": a.proxy.routes().generation})
+}
+
+// handleClients reports the top clients in the last complete window of
+// client statistics.
+func (a *adminServer) handleClients(w http.ResponseWriter, req *http.Request) {
+	if a.proxy.clientStats == nil {
+		writeError(w, http.StatusNotFound, errors.New("client statistics are not configured"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.clientStats.report(time.Now()))
+}
+
+// handleCaptures returns the captured requests, most recent first,
+// optionally only those for the "service" query parameter, or captured
+// for the "reason" query parameter.
+func (a *adminServer) handleCaptures(w http.ResponseWriter, req *http.Request) {
+	if a.proxy.captures == nil {
+		writeError(w, http.StatusNotFound, errors.New("the capture log is not configured"))
+		return
+	}
+
+	q := req.URL.Query()
+	service, reason := q.Get("service"), q.Get("reason")
+	captures := []*capturedRequest{}
+	for _, r := range a.proxy.captures.list() {
+		if (service == "" || r.Service == service) && (reason == "" || r.Reason == reason) {
+			captures = append(captures, r)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"captures": captures})
+}
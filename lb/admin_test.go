@@ -0,0 +1,273 @@
+package main
+
+import (
+	"afe/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// adminServices is the response to GET /api/services.
+type adminServices struct {
+	Generation uint64         `json:"generation"`
+	Services   []adminService `json:"services"`
+}
+
+// adminRequest makes a request to the admin API at ts and decodes the
+// JSON response in to v, returning the status code.
+func adminRequest(t *testing.T, ts *httptest.Server, method, path string, v interface{}) int {
+	req, _ := http.NewRequest(method, ts.URL+path, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("could not decode %s response: %+v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// adminTestProxy returns a proxy with two backends for my-service.
+func adminTestProxy(t *testing.T) *Proxy {
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{
+		{Address: "127.0.0.1", Port: 9090},
+		{Address: "127.0.0.1", Port: 9091, Weight: 2},
+	}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	return proxy
+}
+
+// TestAdminServices verifies that services and backend state are
+// reported.
+func TestAdminServices(t *testing.T) {
+	proxy := adminTestProxy(t)
+	defer proxy.Close()
+
+	ts := httptest.NewServer(newAdminHandler(proxy, nil))
+	defer ts.Close()
+
+	var got adminServices
+	if code := adminRequest(t, ts, "GET", "/api/services", &got); code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+
+	want := adminServices{
+		Generation: 1,
+		Services: []adminService{{
+			Name:   "my-service",
+			Domain: "my-service.my-company.com",
+			Backends: []adminBackend{
+				{Address: "127.0.0.1:9090", Healthy: true, Weight: 1},
+				{Address: "127.0.0.1:9091", Healthy: true, Weight: 2, ConfiguredWeight: 2},
+			},
+		}},
+	}
+	if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	var cfg struct {
+		Generation uint64             `json:"generation"`
+		Config     config.ProxyConfig `json:"config"`
+	}
+	if code := adminRequest(t, ts, "GET", "/api/config", &cfg); code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+	if cfg.Config.Services[0].Hosts[1].Weight != 2 {
+		t.Errorf("got config %+v, want the proxy's config", cfg.Config)
+	}
+}
+
+// TestAdminBackendChanges verifies that backends can be drained,
+// re-enabled, and reweighted, that changes affect routing, and that
+// they are reflected in metrics.
+func TestAdminBackendChanges(t *testing.T) {
+	proxy := adminTestProxy(t)
+	defer proxy.Close()
+
+	ts := httptest.NewServer(newAdminHandler(proxy, nil))
+	defer ts.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(backendCollector{proxy})
+
+	backend := url.QueryEscape("127.0.0.1:9090")
+	path := func(action string) string {
+		return fmt.Sprintf("/api/backends/%s?service=my-service&backend=%s", action, backend)
+	}
+
+	drains := testutil.ToFloat64(adminActions.WithLabelValues("drain", "ok"))
+	var state adminBackend
+	if code := adminRequest(t, ts, "POST", path("drain"), &state); code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+	if !state.Drained {
+		t.Errorf("got %+v, want drained", state)
+	}
+	if got := testutil.ToFloat64(adminActions.WithLabelValues("drain", "ok")) - drains; got != 1 {
+		t.Errorf("got %v drain actions, want 1", got)
+	}
+
+	// Only the other backend may be picked.
+	pool := proxy.routes().services["my-service.my-company.com"].pool
+	for i := 0; i < 100; i++ {
+		if b, _ := pool.pick(); b.backend.String() != "127.0.0.1:9091" {
+			t.Fatalf("picked drained backend %s", b.backend)
+		}
+	}
+
+	expected := `
+# HELP proxy_backend_drained 1 if the backend has been drained through the admin API, 0 otherwise.
+# TYPE proxy_backend_drained gauge
+proxy_backend_drained{backend="127.0.0.1:9090",service="my-service"} 1
+proxy_backend_drained{backend="127.0.0.1:9091",service="my-service"} 0
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "proxy_backend_drained"); err != nil {
+		t.Error(err)
+	}
+
+	if code := adminRequest(t, ts, "POST", path("enable"), &state); code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+	if state.Drained {
+		t.Errorf("got %+v, want not drained", state)
+	}
+
+	if code := adminRequest(t, ts, "POST", path("weight")+"&weight=5", &state); code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+	if state.Weight != 5 || state.ConfiguredWeight != 0 {
+		t.Errorf("got %+v, want weight 5, configured weight 0", state)
+	}
+
+	expected = `
+# HELP proxy_backend_weight Effective weight of each backend.
+# TYPE proxy_backend_weight gauge
+proxy_backend_weight{backend="127.0.0.1:9090",service="my-service"} 5
+proxy_backend_weight{backend="127.0.0.1:9091",service="my-service"} 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "proxy_backend_weight"); err != nil {
+		t.Error(err)
+	}
+
+	if code := adminRequest(t, ts, "POST", path("weight")+"&weight=-1", nil); code != http.StatusBadRequest {
+		t.Errorf("got %d for a negative weight, want %d", code, http.StatusBadRequest)
+	}
+	if code := adminRequest(t, ts, "POST", "/api/backends/drain?service=my-service&backend=nope", nil); code != http.StatusNotFound {
+		t.Errorf("got %d for an unknown backend, want %d", code, http.StatusNotFound)
+	}
+	if code := adminRequest(t, ts, "POST", "/api/backends/weight?service=nope&backend=nope&weight=1", nil); code != http.StatusNotFound {
+		t.Errorf("got %d for an unknown service, want %d", code, http.StatusNotFound)
+	}
+
+	// Changes survive a reload.
+	testConfig := proxy.routes().config
+	if errs := proxy.Reload(&testConfig); errs != nil {
+		t.Fatal(errs)
+	}
+	b, _ := proxy.routes().services["my-service.my-company.com"].pool.find("127.0.0.1:9090")
+	if b.weight() != 5 {
+		t.Errorf("got weight %d after reload, want 5", b.weight())
+	}
+}
+
+// TestAdminReload verifies that a reload can be triggered.
+func TestAdminReload(t *testing.T) {
+	proxy := adminTestProxy(t)
+	defer proxy.Close()
+
+	cfg := proxy.routes().config
+	ts := httptest.NewServer(newAdminHandler(proxy, func() []error {
+		return proxy.Reload(&cfg)
+	}))
+	defer ts.Close()
+
+	var got struct {
+		Generation uint64 `json:"generation"`
+	}
+	if code := adminRequest(t, ts, "POST", "/api/reload", &got); code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+	if got.Generation != 2 {
+		t.Errorf("got generation %d, want 2", got.Generation)
+	}
+
+	cfg.Services = nil
+	var failed struct {
+		Errors []string `json:"errors"`
+	}
+	if code := adminRequest(t, ts, "POST", "/api/reload", &failed); code != http.StatusBadRequest {
+		t.Fatalf("got %d, want %d", code, http.StatusBadRequest)
+	}
+	if len(failed.Errors) != 1 || failed.Errors[0] != "No services have been defined" {
+		t.Errorf("got errors %v, want [No services have been defined]", failed.Errors)
+	}
+}
+
+// TestAdminControlPlane verifies that the metrics, liveness, readiness
+// and pprof endpoints are served.
+func TestAdminControlPlane(t *testing.T) {
+	proxy := adminTestProxy(t)
+	defer proxy.Close()
+
+	ts := httptest.NewServer(newAdminHandler(proxy, nil))
+	defer ts.Close()
+
+	var tests = []struct {
+		path     string
+		code     int
+		contains string
+	}{
+		{"/metrics", http.StatusOK, "proxy_config_generation"},
+		{"/livez", http.StatusOK, "ok"},
+		{"/readyz", http.StatusOK, "ok"},
+		{"/debug/pprof/", http.StatusOK, "goroutine"},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.path, resp.StatusCode, tt.code)
+		}
+		if !strings.Contains(string(body), tt.contains) {
+			t.Errorf("%s: response does not contain %q", tt.path, tt.contains)
+		}
+	}
+
+	checkErr := errors.New("failed health check")
+	proxy.healthChecker = func(*Proxy) error { return checkErr }
+	resp, err := http.Get(ts.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/readyz: got %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if strings.TrimSpace(string(body)) != checkErr.Error() {
+		t.Errorf("/readyz: got '%s', want '%s'", body, checkErr)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// unixHostSuffix marks a URL host that encodes the path of a Unix domain
+// socket. The transport's dialer recognises it and dials the socket
+// instead of a TCP address.
+const unixHostSuffix = ".unix"
+
+// unhealthyPeriod is how long a backend is avoided after a request to
+// it fails.
+const unhealthyPeriod = 10 * time.Second
+
+// A backend is a single balancing target for a service, either a TCP
+// "ip:port" address or the path of a Unix domain socket, with the weight
+// it was configured with.
+type backend struct {
+	network string // "tcp" or "unix"
+	address string
+	weight  int
+}
+
+// newBackend returns the backend for a HostPort that is an IP address
+// or a Unix domain socket. DNS names must be resolved first.
+func newBackend(hp config.HostPort) backend {
+	if hp.IsUnix() {
+		return backend{network: "unix", address: hp.SocketPath(), weight: hp.Weight}
+	}
+	return backend{network: "tcp", address: hp.String(), weight: hp.Weight}
+}
+
+// String returns the backend's address in a form suitable for logs.
+func (b backend) String() string {
+	if b.network == "unix" {
+		return "unix://" + b.address
+	}
+	return b.address
+}
+
+// urlHost returns the host to place in the URL of requests proxied to
+// the backend. Socket paths can't appear in a URL host, so they are hex
+// encoded and decoded again by dialBackend.
+func (b backend) urlHost() string {
+	if b.network == "unix" {
+		return hex.EncodeToString([]byte(b.address)) + unixHostSuffix
+	}
+	return b.address
+}
+
+// A backendState is the runtime state of a backend in a pool. It
+// survives the pool's backends being replaced for as long as the backend
+// stays in the pool, and is carried over to the same service's pool when
+// the configuration is reloaded, so that draining a backend or changing
+// its weight through the admin API is not undone by either.
+type backendState struct {
+	// backend identifies the backend. Its weight field is not updated,
+	// configWeight holds the current configured weight
+	backend backend
+
+	configWeight atomic.Int64
+	// weightOverride replaces configWeight if it is non-zero
+	weightOverride atomic.Int64
+	drained        atomic.Bool
+	inFlight       atomic.Int64
+	// unhealthyUntil is when, in Unix nanoseconds, the backend may be
+	// used again after a failed request
+	unhealthyUntil atomic.Int64
+}
+
+// weight returns the backend's effective weight.
+func (s *backendState) weight() int {
+	if w := s.weightOverride.Load(); w > 0 {
+		return int(w)
+	}
+	if w := s.configWeight.Load(); w > 0 {
+		return int(w)
+	}
+	return 1
+}
+
+// healthy returns true unless a request to the backend has failed in
+// the last unhealthyPeriod.
+func (s *backendState) healthy() bool {
+	return time.Now().UnixNano() >= s.unhealthyUntil.Load()
+}
+
+// markFailed records that a request to the backend failed.
+func (s *backendState) markFailed() {
+	s.unhealthyUntil.Store(time.Now().Add(unhealthyPeriod).UnixNano())
+}
+
+// markOK records that a request to the backend succeeded.
+func (s *backendState) markOK() {
+	s.unhealthyUntil.Store(0)
+}
+
+// A pool is the set of backends a service balances requests across. The
+// set may be replaced at any time, e.g., as DNS names are re-resolved,
+// without disturbing requests that have already picked a backend.
+type pool struct {
+	// mu serialises set, so concurrent updates can't lose state
+	mu     sync.Mutex
+	states atomic.Pointer[[]*backendState]
+	// carried holds the states of the previous configuration's pool for
+	// the same service, keyed by backend address, for reuse by set
+	carried map[string]*backendState
+}
+
+// newPool returns an empty pool that reuses the backend state in prev,
+// which may be nil.
+func newPool(prev *pool) *pool {
+	p := &pool{}
+	if prev != nil {
+		p.carried = make(map[string]*backendState)
+		for _, s := range prev.list() {
+			p.carried[s.backend.String()] = s
+		}
+	}
+	return p
+}
+
+// set atomically replaces the backends in the pool.
+func (p *pool) set(backends []backend) {
+	p.setUnlessDone(context.Background(), backends)
+}
+
+// setUnlessDone is set, unless ctx is done. It is checked with the pool
+// locked, so once ctx is cancelled no later set is undone by it.
+func (p *pool) setUnlessDone(ctx context.Context, backends []backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+
+	current := make(map[string]*backendState)
+	for _, s := range p.list() {
+		current[s.backend.String()] = s
+	}
+
+	states := make([]*backendState, 0, len(backends))
+	for _, b := range backends {
+		s, ok := current[b.String()]
+		if !ok {
+			s, ok = p.carried[b.String()]
+		}
+		if !ok {
+			s = &backendState{backend: b}
+		}
+		s.configWeight.Store(int64(b.weight))
+		states = append(states, s)
+	}
+	p.states.Store(&states)
+}
+
+// list returns the state of each backend currently in the pool.
+func (p *pool) list() []*backendState {
+	if s := p.states.Load(); s != nil {
+		return *s
+	}
+	return nil
+}
+
+// find returns the state of the backend in the pool with the given
+// address, as returned by backend.String.
+func (p *pool) find(address string) (*backendState, bool) {
+	for _, s := range p.list() {
+		if s.backend.String() == address {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// pick returns a backend selected at random, in proportion to the
+// backends' weights. Drained backends are never selected. Unhealthy
+// backends are only selected if every backend that isn't drained is
+// unhealthy, as an unhealthy backend is a better bet than certain
+// failure. Returns false if there is no backend to select.
+func (p *pool) pick() (*backendState, bool) {
+	states := p.list()
+
+	eligible := func(s *backendState, wantHealthy bool) bool {
+		return !s.drained.Load() && (!wantHealthy || s.healthy())
+	}
+
+	for _, wantHealthy := range []bool{true, false} {
+		total := 0
+		for _, s := range states {
+			if eligible(s, wantHealthy) {
+				total += s.weight()
+			}
+		}
+		if total == 0 {
+			continue
+		}
+
+		// Weights may change while picking, if so fall back to the last
+		// eligible backend.
+		var last *backendState
+		n := rand.Intn(total)
+		for _, s := range states {
+			if !eligible(s, wantHealthy) {
+				continue
+			}
+			last = s
+			if n -= s.weight(); n < 0 {
+				break
+			}
+		}
+		if last != nil {
+			return last, true
+		}
+	}
+
+	return nil, false
+}
+
+type backendKey struct{}
+
+// withBackend returns a copy of ctx carrying the backend a request
+// should be proxied to.
+func withBackend(ctx context.Context, s *backendState) context.Context {
+	return context.WithValue(ctx, backendKey{}, s)
+}
+
+// backendFromContext returns the backend stored by withBackend.
+func backendFromContext(ctx context.Context) (*backendState, bool) {
+	s, ok := ctx.Value(backendKey{}).(*backendState)
+	return s, ok
+}
+
+// newTransport returns an http.Transport that can reach both TCP and
+// Unix domain socket backends.
+func newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialBackend(ctx, dialer, network, addr)
+	}
+	return t
+}
+
+// dialBackend dials addr, which is either a TCP address or a URL host
+// produced by backend.urlHost for a Unix domain socket.
+func dialBackend(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || !strings.HasSuffix(host, unixHostSuffix) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	path, err := hex.DecodeString(strings.TrimSuffix(host, unixHostSuffix))
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding socket path from %s failed", host)
+	}
+	return dialer.DialContext(ctx, "unix", string(path))
+}
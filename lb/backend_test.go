@@ -0,0 +1,82 @@
+package main
+
+import (
+	"afe/config"
+	"testing"
+)
+
+func TestNewBackend(t *testing.T) {
+	var tests = []struct {
+		in      config.HostPort
+		network string
+		address string
+	}{
+		{config.HostPort{Address: "127.0.0.1", Port: 9090}, "tcp", "127.0.0.1:9090"},
+		{config.HostPort{Address: "::1", Port: 9090}, "tcp", "[::1]:9090"},
+		{config.HostPort{Address: "unix:///run/app.sock"}, "unix", "/run/app.sock"},
+	}
+
+	for _, tt := range tests {
+		b := newBackend(tt.in)
+		if b.network != tt.network || b.address != tt.address {
+			t.Errorf("%+v: got %s %s, want %s %s", tt.in, b.network, b.address, tt.network, tt.address)
+		}
+	}
+}
+
+// TestPoolPick verifies that backends are picked in proportion to their
+// weights, that drained backends are never picked, and that unhealthy
+// backends are only picked when there is no alternative.
+func TestPoolPick(t *testing.T) {
+	p := newPool(nil)
+	if _, ok := p.pick(); ok {
+		t.Fatal("picked a backend from an empty pool")
+	}
+
+	p.set([]backend{
+		{network: "tcp", address: "127.0.0.1:9090", weight: 1},
+		{network: "tcp", address: "127.0.0.1:9091", weight: 3},
+	})
+	a, _ := p.find("127.0.0.1:9090")
+	b, _ := p.find("127.0.0.1:9091")
+
+	counts := make(map[*backendState]int)
+	for i := 0; i < 4000; i++ {
+		s, _ := p.pick()
+		counts[s]++
+	}
+	if counts[b] < 2*counts[a] {
+		t.Errorf("got %d picks of weight 3 backend, %d of weight 1 backend, want roughly 3:1", counts[b], counts[a])
+	}
+
+	b.markFailed()
+	for i := 0; i < 100; i++ {
+		if s, _ := p.pick(); s != a {
+			t.Fatalf("picked unhealthy backend %s", s.backend)
+		}
+	}
+
+	a.markFailed()
+	if _, ok := p.pick(); !ok {
+		t.Error("no backend picked when all are unhealthy, want one anyway")
+	}
+
+	a.markOK()
+	a.drained.Store(true)
+	for i := 0; i < 100; i++ {
+		if s, _ := p.pick(); s != b {
+			t.Fatalf("picked drained backend %s", s.backend)
+		}
+	}
+
+	b.drained.Store(true)
+	if s, ok := p.pick(); ok {
+		t.Errorf("picked %s when all backends are drained", s.backend)
+	}
+
+	// State survives the backends being replaced.
+	p.set([]backend{{network: "tcp", address: "127.0.0.1:9091", weight: 2}})
+	if s, _ := p.find("127.0.0.1:9091"); s != b || !s.drained.Load() || s.weight() != 2 {
+		t.Errorf("state for 127.0.0.1:9091 not kept when backends replaced")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a request is captured.
+const (
+	captureError = "error"
+	captureSlow  = "slow"
+)
+
+// capturedRequests counts the requests kept in the capture log.
+var capturedRequests = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_captured_requests_total",
+		Help: "Requests kept in the capture log, by service and reason, \"error\" or \"slow\".",
+	},
+	[]string{"service", "reason"},
+)
+
+// A capturedRequest is a request kept in the capture log, and what
+// happened to it.
+type capturedRequest struct {
+	Time            time.Time   `json:"time"`
+	RequestID       string      `json:"requestId"`
+	Reason          string      `json:"reason"`
+	ClientIP        string      `json:"clientIp"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	Proto           string      `json:"proto"`
+	RequestHeaders  http.Header `json:"requestHeaders"`
+	Service         string      `json:"service,omitempty"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"responseHeaders"`
+	DurationMs      float64     `json:"durationMs"`
+	// Attempts are the requests sent to backends, in order. The proxy
+	// doesn't retry, so there is at most one
+	Attempts []captureAttempt `json:"attempts"`
+}
+
+// A captureAttempt is a request sent to a backend for a captured request.
+// Status is the backend's response status, 0 if it didn't respond, in
+// which case Reason is why, as counted in proxyErrors, and Error the
+// error.
+type captureAttempt struct {
+	Backend    string         `json:"backend"`
+	Status     int            `json:"status,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Reused     bool           `json:"reused"`
+	WasIdle    bool           `json:"wasIdle"`
+	IdleTimeMs float64        `json:"idleTimeMs"`
+	ConnectErr string         `json:"connectError,omitempty"`
+	Phases     []capturePhase `json:"phases"`
+}
+
+// A capturePhase is the duration of a phase of an attempt that happened.
+type capturePhase struct {
+	Name string  `json:"name"`
+	Ms   float64 `json:"ms"`
+}
+
+// A captureLog keeps the most recent requests that failed or were slow.
+type captureLog struct {
+	// redact holds the canonical names of the headers whose values are
+	// redacted
+	redact  map[string]bool
+	dumpDir string
+
+	mu sync.Mutex
+	// requests is a ring of the captured requests, next the index the
+	// next one is stored at
+	requests []*capturedRequest
+	next     int
+}
+
+// newCaptureLog returns the capture log configured by cfg.
+func newCaptureLog(cfg *config.Capture) *captureLog {
+	size := cfg.Size
+	if size == 0 {
+		size = config.DefaultCaptureSize
+	}
+	c := &captureLog{
+		redact:   make(map[string]bool),
+		dumpDir:  cfg.DumpDir,
+		requests: make([]*capturedRequest, size),
+	}
+	for _, list := range [][]string{config.CaptureRedactedHeaders, cfg.RedactHeaders} {
+		for _, header := range list {
+			c.redact[http.CanonicalHeaderKey(header)] = true
+		}
+	}
+	return c
+}
+
+// add keeps r, replacing the oldest captured request if the log is full.
+func (c *captureLog) add(r *capturedRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests[c.next] = r
+	c.next = (c.next + 1) % len(c.requests)
+}
+
+// list returns the captured requests, most recent first.
+func (c *captureLog) list() []*capturedRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	requests := []*capturedRequest{}
+	for i := 1; i <= len(c.requests); i++ {
+		r := c.requests[(c.next-i+len(c.requests))%len(c.requests)]
+		if r == nil {
+			break
+		}
+		requests = append(requests, r)
+	}
+	return requests
+}
+
+// redactHeaders returns a copy of h with the values of redacted headers
+// replaced.
+func (c *captureLog) redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for name, values := range h {
+		if c.redact[name] {
+			for i := range values {
+				values[i] = redacted
+			}
+		}
+	}
+	return h
+}
+
+// dump writes the captured requests to a new file in the dump directory,
+// and returns its path.
+func (c *captureLog) dump() (string, error) {
+	dir := c.dumpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	f, err := os.CreateTemp(dir, "lb-captures-*.json")
+	if err != nil {
+		return "", errors.Wrapf(err, "creating a capture dump in %s failed", dir)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(map[string]interface{}{"captures": c.list()}); err != nil {
+		return "", errors.Wrapf(err, "writing %s failed", f.Name())
+	}
+	return f.Name(), f.Close()
+}
+
+// dumpCapturesOnSignal dumps the captured requests each time the process
+// receives SIGUSR1.
+func dumpCapturesOnSignal(c *captureLog) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+
+	go func() {
+		for range ch {
+			path, err := c.dump()
+			if err != nil {
+				slog.Error("dumping captured requests failed", "err", err)
+				continue
+			}
+			slog.Info("captured requests dumped", "signal", "SIGUSR1", "file", path)
+		}
+	}()
+}
+
+// A backendError is why proxying a request to a backend failed, as set
+// by the reverse proxy's error handler.
+type backendError struct {
+	reason string
+	err    error
+}
+
+type backendErrorKey struct{}
+
+// withBackendError returns a copy of ctx carrying e, for the reverse
+// proxy's error handler to set.
+func withBackendError(ctx context.Context, e *backendError) context.Context {
+	return context.WithValue(ctx, backendErrorKey{}, e)
+}
+
+// backendErrorFromContext returns the backendError stored by
+// withBackendError.
+func backendErrorFromContext(ctx context.Context) (*backendError, bool) {
+	e, ok := ctx.Value(backendErrorKey{}).(*backendError)
+	return e, ok
+}
+
+// capture keeps req in the capture log, if there is one, and if it failed
+// with a server error or took longer than its service's slow threshold.
+// entry is its access log record, with the URL as received. svc is the
+// service it was for and b the backend it was sent to, either of which
+// may be nil.
+func (proxy *Proxy) capture(req *http.Request, entry *accessRecord, rec *responseRecorder, start time.Time, svc *service, b *backendState, stats *httpTraceStats, berr *backendError) {
+	if proxy.captures == nil {
+		return
+	}
+
+	duration := time.Since(start)
+	var reason string
+	switch {
+	case rec.status >= 500:
+		reason = captureError
+	case svc != nil && svc.slowThreshold > 0 && duration > svc.slowThreshold:
+		reason = captureSlow
+	default:
+		return
+	}
+
+	// The URL is redacted as it would be in the service's access log
+	target := accessRecord{Path: entry.Path, Query: entry.Query}
+	if svc != nil && svc.accessLog != nil {
+		target.redact(svc.accessLog.Redact)
+	}
+
+	id, _ := requestIDFromContext(req.Context())
+	r := &capturedRequest{
+		Time:            start,
+		RequestID:       id,
+		Reason:          reason,
+		ClientIP:        remoteIP(req),
+		Method:          req.Method,
+		URL:             target.uri(),
+		Proto:           req.Proto,
+		RequestHeaders:  proxy.captures.redactHeaders(req.Header),
+		Status:          rec.status,
+		ResponseHeaders: proxy.captures.redactHeaders(rec.Header()),
+		DurationMs:      milliseconds(duration),
+		Attempts:        []captureAttempt{},
+	}
+	if svc != nil {
+		r.Service = svc.name
+	}
+	if b != nil {
+		r.Attempts = append(r.Attempts, newCaptureAttempt(b, rec.status, stats, berr))
+	}
+
+	proxy.captures.add(r)
+	capturedRequests.WithLabelValues(r.Service, reason).Inc()
+}
+
+// newCaptureAttempt returns the attempt to send a request to b, which
+// got a response with status unless berr is set.
+func newCaptureAttempt(b *backendState, status int, stats *httpTraceStats, berr *backendError) captureAttempt {
+	a := captureAttempt{Backend: b.backend.String(), Phases: []capturePhase{}}
+	if berr.err != nil {
+		a.Reason, a.Error = berr.reason, berr.err.Error()
+	} else {
+		a.Status = status
+	}
+
+	for _, p := range stats.namedPhases() {
+		if p.Valid {
+			a.Phases = append(a.Phases, capturePhase{p.Name, milliseconds(p.Duration)})
+		}
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	a.Reused, a.WasIdle, a.IdleTimeMs = stats.Reused, stats.WasIdle, milliseconds(stats.IdleTime)
+	if stats.ConnectErr != nil {
+		a.ConnectErr = stats.ConnectErr.Error()
+	}
+	return a
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"afe/config"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCaptureLog(t *testing.T) {
+	c := newCaptureLog(&config.Capture{Size: 3, RedactHeaders: []string{"x-api-key"}})
+	if got := c.list(); len(got) != 0 {
+		t.Errorf("got %d captures in an empty log, want 0", len(got))
+	}
+
+	// The oldest requests are replaced once the log is full
+	for i := 0; i < 5; i++ {
+		c.add(&capturedRequest{RequestID: fmt.Sprint(i)})
+	}
+	var ids []string
+	for _, r := range c.list() {
+		ids = append(ids, r.RequestID)
+	}
+	if fmt.Sprint(ids) != "[4 3 2]" {
+		t.Errorf("got %v, want [4 3 2]", ids)
+	}
+
+	h := http.Header{}
+	h.Set("Authorization", "Bearer secret")
+	h.Set("X-Api-Key", "secret")
+	h.Set("Accept", "text/html")
+	got := c.redactHeaders(h)
+	for name, want := range map[string]string{"Authorization": redacted, "X-Api-Key": redacted, "Accept": "text/html"} {
+		if got.Get(name) != want {
+			t.Errorf("%s: got %q, want %q", name, got.Get(name), want)
+		}
+	}
+	if h.Get("Authorization") != "Bearer secret" {
+		t.Errorf("redacting changed the request's headers")
+	}
+}
+
+func TestCaptureDump(t *testing.T) {
+	c := newCaptureLog(&config.Capture{DumpDir: t.TempDir()})
+	c.add(&capturedRequest{RequestID: "first", Reason: captureSlow})
+
+	path, err := c.dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump struct {
+		Captures []capturedRequest `json:"captures"`
+	}
+	if err := json.Unmarshal(content, &dump); err != nil {
+		t.Fatalf("got %s, %v", content, err)
+	}
+	if len(dump.Captures) != 1 || dump.Captures[0].RequestID != "first" {
+		t.Errorf("got %+v, want the first request", dump.Captures)
+	}
+}
+
+// TestCaptureRequests verifies that failed and slow requests are
+// captured, with their backend attempts, and reported by the admin API.
+func TestCaptureRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+	testConfig.Services[0].SlowThreshold = 20 * time.Millisecond
+	testConfig.Services[0].AccessLog = &config.ServiceAccessLog{Redact: []string{"query"}}
+	testConfig.Services = append(testConfig.Services, config.Service{
+		Name:   "down-service",
+		Domain: "down-service.my-company.com",
+		Hosts:  []config.HostPort{backendHostPort(t, down)},
+	})
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	admin := httptest.NewServer(newAdminHandler(proxy, nil))
+	defer admin.Close()
+	if code := adminRequest(t, admin, "GET", "/api/captures", nil); code != http.StatusNotFound {
+		t.Errorf("got %d without a capture log, want %d", code, http.StatusNotFound)
+	}
+
+	proxy.captures = newCaptureLog(&config.Capture{})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	for _, target := range []string{
+		"/ok?s=my-service.my-company.com",
+		"/slow?s=my-service.my-company.com",
+		"/fail?s=my-service.my-company.com&token=secret",
+		"/?s=down-service.my-company.com",
+	} {
+		req, _ := http.NewRequest("GET", ts.URL+target, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	var report struct {
+		Captures []capturedRequest `json:"captures"`
+	}
+	if code := adminRequest(t, admin, "GET", "/api/captures", &report); code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+
+	var tests = []struct {
+		service string
+		reason  string
+		status  int
+		url     string
+		attempt captureAttempt
+	}{
+		{"down-service", captureError, http.StatusBadGateway, "/?s=down-service.my-company.com", captureAttempt{Reason: reasonConnectError}},
+		// The query is redacted as in my-service's access log
+		{"my-service", captureError, http.StatusInternalServerError, "/fail?" + redacted, captureAttempt{Status: http.StatusInternalServerError}},
+		{"my-service", captureSlow, http.StatusOK, "/slow?" + redacted, captureAttempt{Status: http.StatusOK}},
+	}
+	if len(report.Captures) != len(tests) {
+		t.Fatalf("got %d captures, want %d: %+v", len(report.Captures), len(tests), report.Captures)
+	}
+	for i, tt := range tests {
+		r := report.Captures[i]
+		if r.Service != tt.service || r.Reason != tt.reason || r.Status != tt.status {
+			t.Errorf("%d: got %s %s %d, want %s %s %d", i, r.Service, r.Reason, r.Status, tt.service, tt.reason, tt.status)
+		}
+		if r.URL != tt.url {
+			t.Errorf("%d: got URL %q, want %q", i, r.URL, tt.url)
+		}
+		if r.RequestHeaders.Get("Authorization") != redacted || r.RequestID == "" {
+			t.Errorf("%d: got headers %v, want a request ID and Authorization redacted", i, r.RequestHeaders)
+		}
+		if len(r.Attempts) != 1 {
+			t.Errorf("%d: got %d attempts, want 1", i, len(r.Attempts))
+			continue
+		}
+		a := r.Attempts[0]
+		if a.Status != tt.attempt.Status || a.Reason != tt.attempt.Reason || len(a.Phases) == 0 {
+			t.Errorf("%d: got attempt %+v, want status %d, reason %q, and phases", i, a, tt.attempt.Status, tt.attempt.Reason)
+		}
+	}
+
+	if code := adminRequest(t, admin, "GET", "/api/captures?reason=slow", &report); code != http.StatusOK || len(report.Captures) != 1 {
+		t.Errorf("got %d, %d slow captures, want %d, 1", code, len(report.Captures), http.StatusOK)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"afe/config"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sketchFactor is how many counters a heavy-hitters sketch keeps for each
+// client it reports. The more counters, the less a count can be
+// overestimated.
+const sketchFactor = 4
+
+// A heavyHitters sketch counts the most frequent keys in bounded memory,
+// with the Space-Saving algorithm. It keeps a fixed number of counters.
+// When a key without one is counted the smallest counter is taken over
+// by the new key, which inherits its count as a possible overestimate.
+// Every key counted more than n/capacity times, of n counted in total,
+// is guaranteed to have a counter.
+type heavyHitters struct {
+	capacity int
+	counters map[string]*hitCounter
+}
+
+// A hitCounter is a key's count in a heavyHitters sketch. Count is at
+// most Overestimate more than the key's true count.
+type hitCounter struct {
+	Key          string
+	Count        int64
+	Overestimate int64
+}
+
+func newHeavyHitters(capacity int) *heavyHitters {
+	return &heavyHitters{
+		capacity: capacity,
+		counters: make(map[string]*hitCounter, capacity),
+	}
+}
+
+// add counts key.
+func (h *heavyHitters) add(key string) {
+	if c, ok := h.counters[key]; ok {
+		c.Count++
+		return
+	}
+	if len(h.counters) < h.capacity {
+		h.counters[key] = &hitCounter{Key: key, Count: 1}
+		return
+	}
+
+	// The sketch is small, so a linear search for the smallest counter
+	// is cheap enough
+	var min *hitCounter
+	for _, c := range h.counters {
+		if min == nil || c.Count < min.Count {
+			min = c
+		}
+	}
+	delete(h.counters, min.Key)
+	h.counters[key] = &hitCounter{Key: key, Count: min.Count + 1, Overestimate: min.Count}
+}
+
+// top returns the k largest counters, largest first.
+func (h *heavyHitters) top(k int) []hitCounter {
+	top := make([]hitCounter, 0, len(h.counters))
+	for _, c := range h.counters {
+		top = append(top, *c)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > k {
+		top = top[:k]
+	}
+	return top
+}
+
+// A clientStats tracks the clients sending the most requests, and those
+// getting the most errors, in each window. Clients are identified by a
+// key that doesn't reveal their address.
+type clientStats struct {
+	keyFunc func(netip.Addr) string
+	topK    int
+	window  time.Duration
+
+	mu       sync.Mutex
+	start    time.Time
+	requests *heavyHitters
+	errors   *heavyHitters
+	// last is the report of the last complete window
+	last clientReport
+}
+
+// A clientReport is the top clients in a window.
+type clientReport struct {
+	Start      time.Time     `json:"start"`
+	Window     string        `json:"window"`
+	ByRequests []clientCount `json:"byRequests"`
+	ByErrors   []clientCount `json:"byErrors"`
+}
+
+// A clientCount is a client's count in a window, which may be up to
+// Overestimate more than its true count.
+type clientCount struct {
+	Client       string  `json:"client"`
+	Count        int64   `json:"count"`
+	PerSecond    float64 `json:"perSecond"`
+	Overestimate int64   `json:"overestimate"`
+}
+
+// newClientStats returns the client statistics configured by cfg,
+// starting its first window at now.
+func newClientStats(cfg *config.ClientStats, now time.Time) (*clientStats, error) {
+	topK, window := cfg.TopK, cfg.Window
+	if topK == 0 {
+		topK = config.DefaultClientStatsTopK
+	}
+	if window == 0 {
+		window = config.DefaultClientStatsWindow
+	}
+
+	var keyFunc func(netip.Addr) string
+	if cfg.Key == config.ClientKeyPrefix {
+		v4Bits, v6Bits := cfg.IPv4PrefixBits, cfg.IPv6PrefixBits
+		if v4Bits == 0 {
+			v4Bits = config.DefaultClientStatsIPv4PrefixBits
+		}
+		if v6Bits == 0 {
+			v6Bits = config.DefaultClientStatsIPv6PrefixBits
+		}
+		keyFunc = prefixClientKey(v4Bits, v6Bits)
+	} else {
+		key := []byte(cfg.HashKey)
+		if len(key) == 0 {
+			key = make([]byte, sha256.Size)
+			if _, err := rand.Read(key); err != nil {
+				return nil, err
+			}
+		}
+		keyFunc = hashClientKey(key)
+	}
+
+	s := &clientStats{keyFunc: keyFunc, topK: topK, window: window}
+	s.reset(now)
+	s.last = clientReport{Start: now.Add(-window), Window: window.String()}
+	return s, nil
+}
+
+// hashClientKey returns a function that identifies a client by an HMAC
+// of its address, truncated to 64 bits.
+func hashClientKey(key []byte) func(netip.Addr) string {
+	return func(addr netip.Addr) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(addr.AsSlice())
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+}
+
+// prefixClientKey returns a function that identifies a client by the
+// network prefix of its address.
+func prefixClientKey(v4Bits, v6Bits int) func(netip.Addr) string {
+	return func(addr netip.Addr) string {
+		bits := v6Bits
+		if addr.Is4() {
+			bits = v4Bits
+		}
+		p, err := addr.Prefix(bits)
+		if err != nil {
+			return "unknown"
+		}
+		return p.String()
+	}
+}
+
+// reset starts a new window at now.
+func (s *clientStats) reset(now time.Time) {
+	s.start = now
+	s.requests = newHeavyHitters(s.topK * sketchFactor)
+	s.errors = newHeavyHitters(s.topK * sketchFactor)
+}
+
+// rotate finishes the current window if it has ended by now. If a whole
+// window has passed since, with nothing recorded, the last window is
+// reported as empty.
+func (s *clientStats) rotate(now time.Time) {
+	elapsed := now.Sub(s.start)
+	if elapsed < s.window {
+		return
+	}
+
+	if elapsed < 2*s.window {
+		s.last = clientReport{
+			Start:      s.start,
+			Window:     s.window.String(),
+			ByRequests: s.counts(s.requests),
+			ByErrors:   s.counts(s.errors),
+		}
+		s.reset(s.start.Add(s.window))
+		return
+	}
+
+	windows := elapsed / s.window
+	s.last = clientReport{Start: s.start.Add((windows - 1) * s.window), Window: s.window.String()}
+	s.reset(s.start.Add(windows * s.window))
+}
+
+// counts returns the top clients in h, with their rates over the window.
+func (s *clientStats) counts(h *heavyHitters) []clientCount {
+	top := h.top(s.topK)
+	counts := make([]clientCount, len(top))
+	for i, c := range top {
+		counts[i] = clientCount{
+			Client:       c.Key,
+			Count:        c.Count,
+			PerSecond:    float64(c.Count) / s.window.Seconds(),
+			Overestimate: c.Overestimate,
+		}
+	}
+	return counts
+}
+
+// record counts a request from addr, received at now, which failed if
+// failed is true.
+func (s *clientStats) record(addr netip.Addr, failed bool, now time.Time) {
+	key := s.keyFunc(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotate(now)
+	s.requests.add(key)
+	if failed {
+		s.errors.add(key)
+	}
+}
+
+// report returns the top clients in the last complete window at now.
+func (s *clientStats) report(now time.Time) clientReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotate(now)
+	return s.last
+}
+
+// recordClient counts req in the proxy's client statistics, if there are
+// any. A request failed if its response has a status of 400 or more.
+func (proxy *Proxy) recordClient(req *http.Request, status int) {
+	if proxy.clientStats == nil {
+		return
+	}
+	addr, err := netip.ParseAddr(remoteIP(req))
+	if err != nil {
+		return
+	}
+	proxy.clientStats.record(addr.Unmap(), status >= 400, time.Now())
+}
+
+var (
+	topClientRequestsDesc = prometheus.NewDesc(
+		"proxy_top_client_requests_per_second",
+		"Request rate of the top clients in the last complete window, by rank from 1.",
+		[]string{"rank"}, nil,
+	)
+	topClientErrorsDesc = prometheus.NewDesc(
+		"proxy_top_client_errors_per_second",
+		"Error rate of the clients getting the most errors in the last complete window, by rank from 1.",
+		[]string{"rank"}, nil,
+	)
+)
+
+// A clientStatsCollector is a prometheus.Collector that reports the rates
+// of the top clients by rank, rather than by client, so that the number
+// of series is bounded.
+type clientStatsCollector struct {
+	stats *clientStats
+}
+
+func (c clientStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- topClientRequestsDesc
+	ch <- topClientErrorsDesc
+}
+
+func (c clientStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	report := c.stats.report(time.Now())
+	for i, count := range report.ByRequests {
+		ch <- prometheus.MustNewConstMetric(topClientRequestsDesc, prometheus.GaugeValue, count.PerSecond, strconv.Itoa(i+1))
+	}
+	for i, count := range report.ByErrors {
+		ch <- prometheus.MustNewConstMetric(topClientErrorsDesc, prometheus.GaugeValue, count.PerSecond, strconv.Itoa(i+1))
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"afe/config"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHeavyHitters(t *testing.T) {
+	h := newHeavyHitters(8)
+
+	// Two heavy hitters among many keys seen once each. Both are counted
+	// more than 250/8 times, so are guaranteed to be kept
+	for i := 0; i < 100; i++ {
+		h.add("heavy")
+		if i%2 == 0 {
+			h.add("medium")
+		}
+		h.add(fmt.Sprintf("light-%d", i))
+	}
+
+	if got := len(h.counters); got != 8 {
+		t.Errorf("got %d counters, want 8", got)
+	}
+
+	top := h.top(2)
+	if len(top) != 2 || top[0].Key != "heavy" || top[1].Key != "medium" {
+		t.Fatalf("got %+v, want heavy then medium", top)
+	}
+	for i, want := range []int64{100, 50} {
+		if c := top[i]; c.Count < want || c.Count-c.Overestimate > want {
+			t.Errorf("%s: got count %d, overestimate %d, want %d within them", c.Key, c.Count, c.Overestimate, want)
+		}
+	}
+}
+
+func TestClientKeys(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.123")
+	v6 := netip.MustParseAddr("2001:db8:1234:5678::1")
+
+	prefix := prefixClientKey(24, 48)
+	var tests = []struct {
+		addr netip.Addr
+		want string
+	}{
+		{v4, "192.0.2.0/24"},
+		{v6, "2001:db8:1234::/48"},
+	}
+	for _, tt := range tests {
+		if got := prefix(tt.addr); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+
+	hash := hashClientKey([]byte("secret"))
+	if got := hash(v4); got != hash(v4) || len(got) != 16 {
+		t.Errorf("got %s, want the same 16 hex digits each time", got)
+	}
+	if hash(v4) == hash(netip.MustParseAddr("192.0.2.124")) {
+		t.Errorf("got the same key for different addresses")
+	}
+	if hash(v4) == hashClientKey([]byte("other"))(v4) {
+		t.Errorf("got the same key with different hash keys")
+	}
+}
+
+func TestClientStatsWindows(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s, err := newClientStats(&config.ClientStats{Key: config.ClientKeyPrefix, TopK: 2, Window: 10 * time.Second}, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("198.51.100.1")
+	for i := 0; i < 20; i++ {
+		s.record(a, false, start.Add(time.Second))
+	}
+	for i := 0; i < 5; i++ {
+		s.record(b, true, start.Add(2*time.Second))
+	}
+
+	if r := s.report(start.Add(5 * time.Second)); len(r.ByRequests) != 0 {
+		t.Errorf("got %+v before the first window ended, want nothing", r.ByRequests)
+	}
+
+	r := s.report(start.Add(15 * time.Second))
+	if !r.Start.Equal(start) {
+		t.Errorf("got window start %v, want %v", r.Start, start)
+	}
+	want := []clientCount{{"192.0.2.0/24", 20, 2, 0}, {"198.51.100.0/24", 5, 0.5, 0}}
+	if fmt.Sprint(r.ByRequests) != fmt.Sprint(want) {
+		t.Errorf("got %+v by requests, want %+v", r.ByRequests, want)
+	}
+	if fmt.Sprint(r.ByErrors) != fmt.Sprint(want[1:]) {
+		t.Errorf("got %+v by errors, want %+v", r.ByErrors, want[1:])
+	}
+
+	// A window with no requests is reported as empty
+	r = s.report(start.Add(35 * time.Second))
+	if len(r.ByRequests) != 0 || !r.Start.Equal(start.Add(20*time.Second)) {
+		t.Errorf("got %+v, want an empty window starting at 20s", r)
+	}
+}
+
+// TestAdminClients verifies that the proxy's requests are counted and
+// reported by the admin API.
+func TestAdminClients(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	admin := httptest.NewServer(newAdminHandler(proxy, nil))
+	defer admin.Close()
+	if code := adminRequest(t, admin, "GET", "/api/clients", nil); code != http.StatusNotFound {
+		t.Errorf("got %d without client stats, want %d", code, http.StatusNotFound)
+	}
+
+	proxy.clientStats, _ = newClientStats(&config.ClientStats{Key: config.ClientKeyPrefix}, time.Now())
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	for _, query := range []string{"s=my-service.my-company.com", "s=unknown"} {
+		resp, err := http.Get(ts.URL + "/?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// Finish the window the requests were counted in
+	proxy.clientStats.mu.Lock()
+	proxy.clientStats.start = proxy.clientStats.start.Add(-config.DefaultClientStatsWindow)
+	proxy.clientStats.mu.Unlock()
+
+	var report clientReport
+	if code := adminRequest(t, admin, "GET", "/api/clients", &report); code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+	if len(report.ByRequests) != 1 || report.ByRequests[0].Client != "127.0.0.0/24" || report.ByRequests[0].Count != 2 {
+		t.Errorf("got %+v by requests, want 2 from 127.0.0.0/24", report.ByRequests)
+	}
+	if len(report.ByErrors) != 1 || report.ByErrors[0].Count != 1 {
+		t.Errorf("got %+v by errors, want 1", report.ByErrors)
+	}
+}
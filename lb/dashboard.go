@@ -0,0 +1,318 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// dashboardPage is the dashboard's HTML, with its styles and script
+// inline, so that it needs nothing from outside the proxy.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// dashboardInterval is how often the dashboard is updated.
+const dashboardInterval = 2 * time.Second
+
+// dashboardQuantiles are the latency percentiles shown on the dashboard.
+var dashboardQuantiles = []struct {
+	name string
+	q    float64
+}{
+	{"p50", 0.5},
+	{"p95", 0.95},
+	{"p99", 0.99},
+}
+
+// A dashboard serves a live view of the proxy's services and backends.
+// Rates and latencies are computed from the proxy's metrics, as gathered
+// from gatherer, so that they match what Prometheus scrapes.
+type dashboard struct {
+	proxy    *Proxy
+	gatherer prometheus.Gatherer
+	interval time.Duration
+}
+
+// A dashboardUpdate is the state of the proxy sent to the dashboard.
+// Rates and latencies are over the IntervalSeconds before Time, and are
+// zero in the first update, which has no interval.
+type dashboardUpdate struct {
+	Time            time.Time          `json:"time"`
+	IntervalSeconds float64            `json:"intervalSeconds"`
+	Generation      uint64             `json:"generation"`
+	Services        []dashboardService `json:"services"`
+}
+
+// dashboardRates are the request rates and latencies of a service or
+// backend. Latencies are in milliseconds, by percentile, e.g., "p99",
+// and left out if there were no requests.
+type dashboardRates struct {
+	RequestsPerSecond float64            `json:"requestsPerSecond"`
+	ErrorsPerSecond   float64            `json:"errorsPerSecond"`
+	LatencyMs         map[string]float64 `json:"latencyMs,omitempty"`
+}
+
+// A dashboardService is the dashboard's view of a service. Errors are
+// server errors from its backends and the errors the proxy generated
+// itself. Latencies are of the requests sent to its backends.
+type dashboardService struct {
+	Name     string  `json:"name"`
+	Domain   string  `json:"domain"`
+	InFlight float64 `json:"inFlight"`
+	dashboardRates
+	Backends []dashboardBackend `json:"backends"`
+}
+
+// A dashboardBackend is the dashboard's view of a backend. Its rates are
+// of the requests sent to it, errors being those that got a server error.
+type dashboardBackend struct {
+	adminBackend
+	dashboardRates
+}
+
+// A latencyKey identifies the latencies of a service, with an empty
+// backend, or of one of its backends.
+type latencyKey struct {
+	service, backend string
+}
+
+// A bucketCounts is a histogram's cumulative count of observations at or
+// under each upper bound, as in the Prometheus exposition format.
+type bucketCounts struct {
+	upperBounds []float64
+	counts      []float64
+}
+
+// add adds the buckets of h to b.
+func (b *bucketCounts) add(h *dto.Histogram) {
+	if b.upperBounds == nil {
+		for _, bucket := range h.GetBucket() {
+			b.upperBounds = append(b.upperBounds, bucket.GetUpperBound())
+		}
+		b.counts = make([]float64, len(b.upperBounds))
+	}
+	for i, bucket := range h.GetBucket() {
+		if i < len(b.counts) {
+			b.counts[i] += float64(bucket.GetCumulativeCount())
+		}
+	}
+}
+
+// quantile estimates the q quantile of the total observations since prev,
+// which may be nil, as Prometheus' histogram_quantile does, by linear
+// interpolation within the bucket it falls in. Observations over the
+// highest bound are taken to be at it.
+func (b *bucketCounts) quantile(q, total float64, prev *bucketCounts) float64 {
+	rank := q * total
+	lower, below := 0.0, 0.0
+	for i, upper := range b.upperBounds {
+		count := b.counts[i]
+		if prev != nil && i < len(prev.counts) {
+			count -= prev.counts[i]
+		}
+		if count >= rank {
+			if count == below {
+				return upper
+			}
+			return lower + (upper-lower)*(rank-below)/(count-below)
+		}
+		lower, below = upper, count
+	}
+	return lower
+}
+
+// A metricsSnapshot is the proxy's cumulative counts at a point in time,
+// from which the rates between snapshots are computed.
+type metricsSnapshot struct {
+	time time.Time
+	// requests, errors and inFlight are by service
+	requests map[string]float64
+	errors   map[string]float64
+	inFlight map[string]float64
+	// proxied, proxiedErrors and latencies are of the requests sent to
+	// backends, by service and backend
+	proxied       map[latencyKey]float64
+	proxiedErrors map[latencyKey]float64
+	latencies     map[latencyKey]*bucketCounts
+}
+
+// labelValue returns the value of m's label called name.
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// snapshot gathers the proxy's metrics at now.
+func (d *dashboard) snapshot(now time.Time) (*metricsSnapshot, error) {
+	families, err := d.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &metricsSnapshot{
+		time:          now,
+		requests:      make(map[string]float64),
+		errors:        make(map[string]float64),
+		inFlight:      make(map[string]float64),
+		proxied:       make(map[latencyKey]float64),
+		proxiedErrors: make(map[latencyKey]float64),
+		latencies:     make(map[latencyKey]*bucketCounts),
+	}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			service := labelValue(m, "service")
+			switch mf.GetName() {
+			case "proxy_requests_total":
+				s.requests[service] += m.GetCounter().GetValue()
+			case "proxy_in_flight_requests":
+				s.inFlight[service] += m.GetGauge().GetValue()
+			case "proxy_errors_total":
+				s.errors[service] += m.GetCounter().GetValue()
+			case "proxy_backend_responses_total":
+				if strings.HasPrefix(labelValue(m, "code"), "5") {
+					s.errors[service] += m.GetCounter().GetValue()
+				}
+			case "proxy_backend_total_seconds":
+				h := m.GetHistogram()
+				for _, key := range []latencyKey{{service, ""}, {service, labelValue(m, "backend")}} {
+					s.proxied[key] += float64(h.GetSampleCount())
+					if labelValue(m, "status") == "5xx" {
+						s.proxiedErrors[key] += float64(h.GetSampleCount())
+					}
+					if s.latencies[key] == nil {
+						s.latencies[key] = &bucketCounts{}
+					}
+					s.latencies[key].add(h)
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// rates returns the rates of the requests counted by requests and errors
+// between prev and s, and the latency percentiles of those counted by
+// key. prev is nil for the first update, which has no rates.
+func (s *metricsSnapshot) rates(prev *metricsSnapshot, requests, errors func(*metricsSnapshot) float64, key latencyKey) dashboardRates {
+	if prev == nil {
+		return dashboardRates{}
+	}
+	seconds := s.time.Sub(prev.time).Seconds()
+	r := dashboardRates{
+		RequestsPerSecond: (requests(s) - requests(prev)) / seconds,
+		ErrorsPerSecond:   (errors(s) - errors(prev)) / seconds,
+	}
+
+	total := s.proxied[key] - prev.proxied[key]
+	if b := s.latencies[key]; b != nil && total > 0 {
+		r.LatencyMs = make(map[string]float64)
+		for _, q := range dashboardQuantiles {
+			ms := b.quantile(q.q, total, prev.latencies[key]) * 1000
+			r.LatencyMs[q.name] = math.Round(ms*1000) / 1000
+		}
+	}
+	return r
+}
+
+// update returns the state of the proxy, with rates since prev, which is
+// nil for the first update.
+func (d *dashboard) update(s, prev *metricsSnapshot) dashboardUpdate {
+	table := d.proxy.routes()
+	u := dashboardUpdate{Time: s.time, Generation: table.generation, Services: []dashboardService{}}
+	if prev != nil {
+		u.IntervalSeconds = s.time.Sub(prev.time).Seconds()
+	}
+
+	for _, svc := range table.services {
+		name := svc.name
+		ds := dashboardService{
+			Name:     name,
+			Domain:   svc.domain,
+			InFlight: s.inFlight[name],
+			dashboardRates: s.rates(prev,
+				func(s *metricsSnapshot) float64 { return s.requests[name] },
+				func(s *metricsSnapshot) float64 { return s.errors[name] },
+				latencyKey{name, ""}),
+			Backends: []dashboardBackend{},
+		}
+		for _, b := range svc.pool.list() {
+			key := latencyKey{name, b.backend.String()}
+			ds.Backends = append(ds.Backends, dashboardBackend{
+				adminBackend: newAdminBackend(b),
+				dashboardRates: s.rates(prev,
+					func(s *metricsSnapshot) float64 { return s.proxied[key] },
+					func(s *metricsSnapshot) float64 { return s.proxiedErrors[key] },
+					key),
+			})
+		}
+		u.Services = append(u.Services, ds)
+	}
+	sort.Slice(u.Services, func(i, j int) bool { return u.Services[i].Name < u.Services[j].Name })
+	return u
+}
+
+// handlePage serves the dashboard.
+func (d *dashboard) handlePage(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+// handleEvents streams dashboardUpdates as Server-Sent Events, the first
+// straight away and then every interval, until the client goes away.
+func (d *dashboard) handleEvents(w http.ResponseWriter, req *http.Request) {
+	prev, err := d.snapshot(time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	send := func(u dashboardUpdate) error {
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("event: update\ndata: " + string(data) + "\n\n")); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if err := send(d.update(prev, nil)); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case now := <-ticker.C:
+			s, err := d.snapshot(now)
+			if err != nil {
+				slog.Warn("gathering dashboard metrics failed", "err", err)
+				continue
+			}
+			if err := send(d.update(s, prev)); err != nil {
+				return
+			}
+			prev = s
+		}
+	}
+}
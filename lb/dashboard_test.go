@@ -0,0 +1,132 @@
+package main
+
+import (
+	"afe/config"
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestBucketQuantile(t *testing.T) {
+	b := &bucketCounts{upperBounds: []float64{1, 2, 4}, counts: []float64{10, 20, 20}}
+	since := &bucketCounts{upperBounds: b.upperBounds, counts: []float64{10, 10, 10}}
+	over := &bucketCounts{upperBounds: b.upperBounds, counts: []float64{1, 1, 1}}
+
+	var tests = []struct {
+		b     *bucketCounts
+		prev  *bucketCounts
+		q     float64
+		total float64
+		want  float64
+	}{
+		{b, nil, 0.5, 20, 1},
+		{b, nil, 0.75, 20, 1.5},
+		// Only the observations since prev, all in the second bucket
+		{b, since, 0.5, 10, 1.5},
+		// Observations over the highest bound are taken to be at it
+		{over, nil, 0.99, 2, 4},
+	}
+
+	for _, tt := range tests {
+		if got := tt.b.quantile(tt.q, tt.total, tt.prev); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%v of %v since %v: got %v, want %v", tt.q, tt.b.counts, tt.prev, got, tt.want)
+		}
+	}
+}
+
+// TestDashboard verifies that the dashboard page is served, and that its
+// events report the requests proxied while it is open.
+func TestDashboard(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	d := &dashboard{proxy: proxy, gatherer: prometheus.DefaultGatherer, interval: 20 * time.Millisecond}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dashboard", d.handlePage)
+	mux.HandleFunc("GET /api/dashboard/events", d.handleEvents)
+	admin := httptest.NewServer(mux)
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(page), "api/dashboard/events") {
+		t.Errorf("got %s page %.40q, want the dashboard", resp.Header.Get("Content-Type"), page)
+	}
+
+	resp, err = http.Get(admin.URL + "/api/dashboard/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("got Content-Type %s, want text/event-stream", got)
+	}
+	events := bufio.NewScanner(resp.Body)
+	next := func() dashboardUpdate {
+		for events.Scan() {
+			if data, ok := strings.CutPrefix(events.Text(), "data: "); ok {
+				var u dashboardUpdate
+				if err := json.Unmarshal([]byte(data), &u); err != nil {
+					t.Fatalf("got %s, %v", data, err)
+				}
+				return u
+			}
+		}
+		t.Fatalf("events ended: %v", events.Err())
+		return dashboardUpdate{}
+	}
+
+	first := next()
+	if first.IntervalSeconds != 0 || len(first.Services) != 1 || len(first.Services[0].Backends) != 1 {
+		t.Fatalf("got first update %+v, want my-service's backend without rates", first)
+	}
+	if b := first.Services[0].Backends[0]; !b.Healthy || b.Weight != 1 {
+		t.Errorf("got backend %+v, want healthy with weight 1", b)
+	}
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(ts.URL + "/?s=my-service.my-company.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// The requests are counted in the updates that follow them
+	var requests, proxied float64
+	var latency bool
+	for i := 0; i < 50 && (math.Round(requests) < 4 || math.Round(proxied) < 4); i++ {
+		u := next()
+		s := u.Services[0]
+		requests += s.RequestsPerSecond * u.IntervalSeconds
+		proxied += s.Backends[0].RequestsPerSecond * u.IntervalSeconds
+		latency = latency || s.LatencyMs["p99"] > 0
+	}
+	if math.Abs(requests-4) > 1e-6 || math.Abs(proxied-4) > 1e-6 || !latency {
+		t.Errorf("got %v requests, %v proxied, latency %t, want 4, 4 and a latency", requests, proxied, latency)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultDiscoveryInterval is how often a polled discovery source is
+// checked if the configuration does not say.
+const defaultDiscoveryInterval = 30 * time.Second
+
+var discoveryUpdates = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_discovery_updates_total",
+		Help: "Backend discovery updates by service and result, \"ok\" or \"error\".",
+	},
+	[]string{"service", "result"},
+)
+
+// recordDiscovery counts a discovery update for service, successful if
+// err is nil.
+func recordDiscovery(service string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	discoveryUpdates.WithLabelValues(service, result).Inc()
+}
+
+// A discoverer keeps a service's pool in sync with a dynamic source of
+// backends.
+type discoverer interface {
+	// start populates the pool from the source, then keeps it up to
+	// date in the background until ctx is done. Failures are logged, and
+	// leave the pool holding the last known good set of backends.
+	start(ctx context.Context)
+}
+
+// newDiscoverer returns the discoverer for the service's discovery
+// configuration, which keeps p up to date.
+func newDiscoverer(svc config.Service, p *pool, r *resolver) (discoverer, error) {
+	switch svc.Discovery.Type {
+	case config.DiscoveryDNSSRV, config.DiscoveryDNS:
+		return &dnsDiscoverer{
+			service:  svc.Name,
+			cfg:      *svc.Discovery,
+			pool:     p,
+			resolver: r,
+		}, nil
+	case config.DiscoveryKubernetes:
+		client, err := newKubernetesClient()
+		if err != nil {
+			return nil, errors.Wrapf(err, "service %s", svc.Name)
+		}
+		return &kubernetesDiscoverer{
+			service: svc.Name,
+			cfg:     *svc.Discovery,
+			pool:    p,
+			client:  client,
+		}, nil
+	case config.DiscoveryFile:
+		return &fileDiscoverer{
+			service:  svc.Name,
+			cfg:      *svc.Discovery,
+			pool:     p,
+			resolver: r,
+		}, nil
+	}
+	return nil, errors.Errorf("service %s: unknown discovery type %q", svc.Name, svc.Discovery.Type)
+}
+
+// A dnsDiscoverer polls DNS for SRV, or A and AAAA, records and replaces
+// the pool with the backends they name.
+type dnsDiscoverer struct {
+	service  string
+	cfg      config.Discovery
+	pool     *pool
+	resolver *resolver
+}
+
+func (d *dnsDiscoverer) start(ctx context.Context) {
+	if err := d.refresh(ctx); err != nil {
+		slog.Error("discovery failed", "service", d.service, "err", err)
+	}
+
+	interval := d.cfg.Interval
+	if interval == 0 {
+		interval = defaultDiscoveryInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := d.refresh(ctx); err != nil {
+				slog.Warn("discovery failed, keeping last known backends", "service", d.service, "err", err)
+			}
+		}
+	}()
+}
+
+// refresh looks up the backends and, if that succeeds, atomically
+// replaces the pool's backends with them.
+func (d *dnsDiscoverer) refresh(ctx context.Context) error {
+	backends, err := d.lookup(ctx)
+	recordDiscovery(d.service, err)
+	if err != nil {
+		return err
+	}
+
+	d.pool.set(backends)
+	return nil
+}
+
+// lookup returns the backends named by the discovery records.
+func (d *dnsDiscoverer) lookup(ctx context.Context) ([]backend, error) {
+	if d.cfg.Type == config.DiscoveryDNS {
+		return d.lookupIP(ctx, d.cfg.Name, d.cfg.Port, 0)
+	}
+
+	srvs, err := d.resolver.lookupSRV(ctx, d.cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// A weight of 0 is the pool's unset weight, 1, rather than the
+	// smallest share RFC 2782 gives it
+	var backends []backend
+	for _, srv := range srvs {
+		b, err := d.lookupIP(ctx, srv.Target, int(srv.Port), int(srv.Weight))
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, b...)
+	}
+	return backends, nil
+}
+
+// lookupIP returns a backend for each address of name, on port, with the
+// given weight.
+func (d *dnsDiscoverer) lookupIP(ctx context.Context, name string, port, weight int) ([]backend, error) {
+	ips, _, err := d.resolver.lookupIP(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return ipBackends(ips, port, weight), nil
+}
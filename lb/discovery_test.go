@@ -0,0 +1,119 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"sort"
+	"testing"
+)
+
+// backendAddrs returns the sorted addresses of the backends in p.
+func backendAddrs(p *pool) []string {
+	var addrs []string
+	for _, s := range p.list() {
+		addrs = append(addrs, s.backend.String())
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// checkBackends fails the test if p does not hold exactly want.
+func checkBackends(t *testing.T, p *pool, want ...string) {
+	t.Helper()
+	got := backendAddrs(p)
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("got backends %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got backends %v, want %v", got, want)
+		}
+	}
+}
+
+// TestDNSSRVDiscovery verifies that SRV discovery populates the pool
+// from the lowest priority records, replaces it when the records change,
+// and keeps the last known backends when resolution fails.
+func TestDNSSRVDiscovery(t *testing.T) {
+	server := startDNSServer(t,
+		"_http._tcp.svc.test. 30 IN SRV 10 1 9090 a.svc.test.",
+		"_http._tcp.svc.test. 30 IN SRV 10 1 9091 b.svc.test.",
+		"_http._tcp.svc.test. 30 IN SRV 20 1 9092 c.svc.test.",
+		"a.svc.test. 30 IN A 127.0.0.1",
+		"b.svc.test. 30 IN A 127.0.0.2",
+		"c.svc.test. 30 IN A 127.0.0.3",
+	)
+	defer server.stop()
+
+	r, _ := newResolver([]string{server.addr})
+	svc := config.Service{
+		Name: "my-service",
+		Discovery: &config.Discovery{
+			Type: config.DiscoveryDNSSRV,
+			Name: "_http._tcp.svc.test",
+		},
+	}
+	p := &pool{}
+	d, err := newDiscoverer(svc, p, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.start(ctx)
+	checkBackends(t, p, "127.0.0.1:9090", "127.0.0.2:9091")
+
+	server.setRecords(t,
+		"_http._tcp.svc.test. 30 IN SRV 10 1 9093 c.svc.test.",
+		"c.svc.test. 30 IN A 127.0.0.3",
+	)
+	if err := d.(*dnsDiscoverer).refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkBackends(t, p, "127.0.0.3:9093")
+
+	server.setFail(true)
+	if err := d.(*dnsDiscoverer).refresh(ctx); err == nil {
+		t.Fatal("refresh succeeded, want an error")
+	}
+	checkBackends(t, p, "127.0.0.3:9093")
+
+	server.setFail(false)
+	server.setRecords(t)
+	if err := d.(*dnsDiscoverer).refresh(ctx); err == nil {
+		t.Fatal("refresh with no records succeeded, want an error")
+	}
+	checkBackends(t, p, "127.0.0.3:9093")
+}
+
+// TestDNSDiscovery verifies that A/AAAA discovery creates a backend for
+// each address on the configured port.
+func TestDNSDiscovery(t *testing.T) {
+	server := startDNSServer(t,
+		"svc.test. 30 IN A 127.0.0.1",
+		"svc.test. 30 IN AAAA ::1",
+	)
+	defer server.stop()
+
+	r, _ := newResolver([]string{server.addr})
+	svc := config.Service{
+		Name: "my-service",
+		Discovery: &config.Discovery{
+			Type: config.DiscoveryDNS,
+			Name: "svc.test",
+			Port: 8080,
+		},
+	}
+	p := &pool{}
+	d, err := newDiscoverer(svc, p, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.start(ctx)
+	checkBackends(t, p, "127.0.0.1:8080", "[::1]:8080")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"afe/config"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// A fileDiscoverer reads a service's hosts from a JSON or YAML hosts
+// file, and re-reads it whenever it changes. Hosts in the file are
+// validated with the same rules as hosts in the configuration file, and
+// an invalid file is rejected, keeping the previous backends.
+type fileDiscoverer struct {
+	service  string
+	cfg      config.Discovery
+	pool     *pool
+	resolver *resolver
+
+	// last is the content of the file when it was last read, so
+	// unrelated events in the directory don't cause a reload.
+	last []byte
+	// cancelResolve stops re-resolving DNS names from the previously
+	// applied file.
+	cancelResolve context.CancelFunc
+}
+
+func (f *fileDiscoverer) start(ctx context.Context) {
+	if err := f.load(ctx); err != nil {
+		slog.Error("discovery failed", "service", f.service, "err", err)
+	}
+
+	// Watch the directory rather than the file, as deployment tools
+	// typically replace the file by renaming a new one over it (or, in
+	// Kubernetes, by swapping a symlink) which a watch on the file
+	// itself would not survive.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("watching hosts file failed", "service", f.service, "file", f.cfg.Path, "err", err)
+		return
+	}
+	if err := watcher.Add(filepath.Dir(f.cfg.Path)); err != nil {
+		slog.Error("watching hosts file failed", "service", f.service, "file", f.cfg.Path, "err", err)
+		watcher.Close()
+		return
+	}
+
+	go f.watch(ctx, watcher)
+}
+
+// watch reloads the hosts file after each event in its directory, until
+// ctx is done.
+func (f *fileDiscoverer) watch(ctx context.Context, watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if f.cancelResolve != nil {
+				f.cancelResolve()
+			}
+			return
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("watching hosts file failed", "service", f.service, "file", f.cfg.Path, "err", err)
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if err := f.load(ctx); err != nil {
+				slog.Warn("discovery failed, keeping last known backends", "service", f.service, "err", err)
+			}
+		}
+	}
+}
+
+// load reads, validates, and applies the hosts file if it has changed
+// since it was last read.
+func (f *fileDiscoverer) load(ctx context.Context) error {
+	content, err := ioutil.ReadFile(f.cfg.Path)
+	if err != nil {
+		if f.last == nil {
+			recordDiscovery(f.service, err)
+			return errors.Wrapf(err, "read from %s failed", f.cfg.Path)
+		}
+		return nil // Probably mid-replacement, wait for the next event
+	}
+	if f.last != nil && bytes.Equal(content, f.last) {
+		return nil
+	}
+	f.last = content
+
+	err = f.apply(ctx, content)
+	recordDiscovery(f.service, err)
+	return err
+}
+
+// apply replaces the pool's backends with the hosts in content.
+func (f *fileDiscoverer) apply(ctx context.Context, content []byte) error {
+	hosts, err := config.ParseHosts(content)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s failed", f.cfg.Path)
+	}
+
+	if len(hosts) == 0 {
+		return errors.Errorf("%s has no hosts", f.cfg.Path)
+	}
+
+	if errs := config.ValidateHosts(f.service, hosts); errs != nil {
+		for _, err := range errs {
+			slog.Warn("invalid host in hosts file", "service", f.service, "file", f.cfg.Path, "err", err)
+		}
+		return errors.Errorf("%s has %d host errors", f.cfg.Path, len(errs))
+	}
+
+	if f.cancelResolve != nil {
+		f.cancelResolve()
+	}
+	var resolveCtx context.Context
+	resolveCtx, f.cancelResolve = context.WithCancel(ctx)
+	resolveHosts(resolveCtx, f.service, hosts, f.pool, f.resolver)
+
+	slog.Info("hosts file loaded", "service", f.service, "file", f.cfg.Path, "hosts", len(hosts))
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeFile replaces the file at path with content, the way deployment
+// tools do, by renaming a new file over it.
+func writeFile(t *testing.T, path, content string) {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForCount waits for the discovery update counter for service and
+// result to reach want, failing the test if it does not within a few
+// seconds.
+func waitForCount(t *testing.T, service, result string, want float64) {
+	t.Helper()
+	c := discoveryUpdates.WithLabelValues(service, result)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && testutil.ToFloat64(c) < want {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(c); got != want {
+		t.Fatalf("got %v %s discovery updates, want %v", got, result, want)
+	}
+}
+
+// TestFileDiscovery verifies that the pool follows changes to the hosts
+// file, and that invalid files are rejected, counted, and leave the
+// previous backends in place.
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts.yaml")
+	writeFile(t, path, `hosts:
+  - address: "127.0.0.1"
+    port: 9090
+`)
+
+	p := &pool{}
+	d := &fileDiscoverer{
+		service: "file-service",
+		cfg:     config.Discovery{Type: config.DiscoveryFile, Path: path},
+		pool:    p,
+	}
+
+	// The counters are shared by every run of the test
+	ok := testutil.ToFloat64(discoveryUpdates.WithLabelValues("file-service", "ok"))
+	failed := testutil.ToFloat64(discoveryUpdates.WithLabelValues("file-service", "error"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.start(ctx)
+	checkBackends(t, p, "127.0.0.1:9090")
+	waitForCount(t, "file-service", "ok", ok+1)
+
+	writeFile(t, path, `{"hosts": [{"address": "127.0.0.2", "port": 9091}, {"address": "127.0.0.3", "port": 9091}]}`)
+	waitForBackends(t, p, "127.0.0.2:9091", "127.0.0.3:9091")
+	waitForCount(t, "file-service", "ok", ok+2)
+
+	// A host with no port fails validation.
+	writeFile(t, path, `hosts:
+  - address: "127.0.0.4"
+`)
+	waitForCount(t, "file-service", "error", failed+1)
+	checkBackends(t, p, "127.0.0.2:9091", "127.0.0.3:9091")
+
+	// As does a file that doesn't parse, or lists no hosts.
+	writeFile(t, path, `hosts: [`)
+	waitForCount(t, "file-service", "error", failed+2)
+	writeFile(t, path, `hosts: []`)
+	waitForCount(t, "file-service", "error", failed+3)
+	checkBackends(t, p, "127.0.0.2:9091", "127.0.0.3:9091")
+
+	writeFile(t, path, `hosts:
+  - address: "unix:///run/app.sock"
+`)
+	waitForBackends(t, p, "unix:///run/app.sock")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"afe/config"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Label values for clients outside the configured regions and ASNs, and
+// for clients whose location or network isn't known.
+const (
+	geoOther   = "other"
+	geoUnknown = "unknown"
+)
+
+// requestGeoDuration is the latency of each request by the client's
+// region and network.
+var requestGeoDuration = newLatencyHistogram(
+	"proxy_request_geo_seconds",
+	"Time taken to handle each request for a service, by the client's region and ASN.",
+	[]string{"service", "region", "asn"},
+)
+
+// geoInfo is where a client is, and the network it is on. Fields that
+// aren't known are empty.
+type geoInfo struct {
+	// Country is the ISO 3166-1 country code
+	Country string
+	// Subdivision is the ISO 3166-2 code of the country's largest
+	// subdivision, without the country, e.g., "CA" in the US
+	Subdivision string
+	// ASN is the autonomous system number
+	ASN uint32
+}
+
+// regions returns the regions the client is in, the most specific first,
+// e.g., "US-CA" then "US".
+func (g geoInfo) regions() []string {
+	if g.Country == "" {
+		return nil
+	}
+	if g.Subdivision == "" {
+		return []string{g.Country}
+	}
+	return []string{g.Country + "-" + g.Subdivision, g.Country}
+}
+
+// A geoDatabase is a MaxMind-format database, as implemented by
+// maxminddb.Reader.
+type geoDatabase interface {
+	Lookup(ip net.IP, result interface{}) error
+	Close() error
+}
+
+// mmdbCity is the part of a GeoIP2 Country or City record used.
+type mmdbCity struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+// mmdbASN is the part of a GeoIP2 ASN record used.
+type mmdbASN struct {
+	Number uint32 `maxminddb:"autonomous_system_number"`
+}
+
+// A geoLocator finds the location and network of clients, and groups them
+// into the configured regions and ASNs.
+type geoLocator struct {
+	city    geoDatabase
+	asn     geoDatabase
+	regions map[string]bool
+	asns    map[uint32]bool
+}
+
+// newGeoLocator opens the databases configured by cfg.
+func newGeoLocator(cfg *config.Geo) (*geoLocator, error) {
+	var city, asn geoDatabase
+	if cfg.Database != "" {
+		r, err := maxminddb.Open(cfg.Database)
+		if err != nil {
+			return nil, errors.Wrapf(err, "opening %s failed", cfg.Database)
+		}
+		city = r
+	}
+	if cfg.ASNDatabase != "" {
+		r, err := maxminddb.Open(cfg.ASNDatabase)
+		if err != nil {
+			if city != nil {
+				city.Close()
+			}
+			return nil, errors.Wrapf(err, "opening %s failed", cfg.ASNDatabase)
+		}
+		asn = r
+	}
+	return newGeoLocatorFromDatabases(cfg, city, asn), nil
+}
+
+// newGeoLocatorFromDatabases returns a geoLocator using the given
+// databases, either of which may be nil, grouping clients by the regions
+// and ASNs in cfg.
+func newGeoLocatorFromDatabases(cfg *config.Geo, city, asn geoDatabase) *geoLocator {
+	g := &geoLocator{
+		city:    city,
+		asn:     asn,
+		regions: make(map[string]bool),
+		asns:    make(map[uint32]bool),
+	}
+	for _, region := range cfg.Regions {
+		g.regions[region] = true
+	}
+	for _, n := range cfg.ASNs {
+		g.asns[n] = true
+	}
+	return g
+}
+
+// lookup returns what is known of where addr is. Lookup errors leave the
+// fields unknown, as they only happen for corrupt databases.
+func (g *geoLocator) lookup(addr netip.Addr) geoInfo {
+	var info geoInfo
+	ip := net.IP(addr.AsSlice())
+
+	if g.city != nil {
+		var rec mmdbCity
+		if err := g.city.Lookup(ip, &rec); err == nil {
+			info.Country = rec.Country.ISOCode
+			if len(rec.Subdivisions) > 0 {
+				info.Subdivision = rec.Subdivisions[0].ISOCode
+			}
+		}
+	}
+	if g.asn != nil {
+		var rec mmdbASN
+		if err := g.asn.Lookup(ip, &rec); err == nil {
+			info.ASN = rec.Number
+		}
+	}
+	return info
+}
+
+// labels returns the region and ASN label values for info. Regions and
+// ASNs that aren't configured are grouped as geoOther.
+func (g *geoLocator) labels(info geoInfo) (region, asn string) {
+	region, asn = geoUnknown, geoUnknown
+	if info.Country != "" {
+		region = geoOther
+		for _, r := range info.regions() {
+			if g.regions[r] {
+				region = r
+				break
+			}
+		}
+	}
+	if info.ASN != 0 {
+		asn = geoOther
+		if g.asns[info.ASN] {
+			asn = strconv.FormatUint(uint64(info.ASN), 10)
+		}
+	}
+	return region, asn
+}
+
+// Close closes the databases.
+func (g *geoLocator) Close() error {
+	for _, db := range []geoDatabase{g.city, g.asn} {
+		if db != nil {
+			db.Close()
+		}
+	}
+	return nil
+}
+
+// locate returns where req's client is, if the proxy has a geoLocator.
+func (proxy *Proxy) locate(req *http.Request) geoInfo {
+	if proxy.geo == nil {
+		return geoInfo{}
+	}
+	addr, err := netip.ParseAddr(remoteIP(req))
+	if err != nil {
+		return geoInfo{}
+	}
+	return proxy.geo.lookup(addr.Unmap())
+}
+
+// observeGeo observes the latency of a request for svc, received at
+// start, from a client at info.
+func (proxy *Proxy) observeGeo(svc *service, info geoInfo, start time.Time) {
+	if proxy.geo == nil || svc == nil {
+		return
+	}
+	region, asn := proxy.geo.labels(info)
+	requestGeoDuration.With(prometheus.Labels{"service": svc.name, "region": region, "asn": asn}).Observe(time.Since(start).Seconds())
+}
+
+// regionService returns the name of the service requests for s from a
+// client at info are sent to, if it isn't s, and the region that chose it.
+func (s *service) regionService(info geoInfo) (name, region string, ok bool) {
+	for _, region := range info.regions() {
+		if name, ok := s.regionServices[region]; ok {
+			return name, region, true
+		}
+	}
+	return "", "", false
+}
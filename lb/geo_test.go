@@ -0,0 +1,137 @@
+package main
+
+import (
+	"afe/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeGeoDatabase maps IP addresses to the country, subdivision and ASN
+// in a geoInfo, in place of a MaxMind database.
+type fakeGeoDatabase map[string]geoInfo
+
+func (db fakeGeoDatabase) Lookup(ip net.IP, result interface{}) error {
+	info, ok := db[ip.String()]
+	if !ok {
+		return nil // Not found leaves result unchanged
+	}
+	switch rec := result.(type) {
+	case *mmdbCity:
+		rec.Country.ISOCode = info.Country
+		if info.Subdivision != "" {
+			rec.Subdivisions = make([]struct {
+				ISOCode string `maxminddb:"iso_code"`
+			}, 1)
+			rec.Subdivisions[0].ISOCode = info.Subdivision
+		}
+	case *mmdbASN:
+		rec.Number = info.ASN
+	default:
+		return errors.Errorf("unexpected record %T", result)
+	}
+	return nil
+}
+
+func (db fakeGeoDatabase) Close() error { return nil }
+
+func TestGeoLabels(t *testing.T) {
+	db := fakeGeoDatabase{
+		"192.0.2.1":   {Country: "BR", ASN: 64496},
+		"192.0.2.2":   {Country: "US", Subdivision: "CA", ASN: 64497},
+		"192.0.2.3":   {Country: "US", Subdivision: "NY"},
+		"2001:db8::1": {Country: "BR", Subdivision: "SP"},
+	}
+	g := newGeoLocatorFromDatabases(&config.Geo{Regions: []string{"BR", "US-CA"}, ASNs: []uint32{64496}}, db, db)
+
+	var tests = []struct {
+		addr   string
+		region string
+		asn    string
+	}{
+		{"192.0.2.1", "BR", "64496"},
+		{"192.0.2.2", "US-CA", geoOther},
+		{"192.0.2.3", geoOther, geoUnknown},
+		{"2001:db8::1", "BR", geoUnknown},
+		{"198.51.100.1", geoUnknown, geoUnknown},
+	}
+
+	for _, tt := range tests {
+		region, asn := g.labels(g.lookup(netip.MustParseAddr(tt.addr)))
+		if region != tt.region || asn != tt.asn {
+			t.Errorf("%s: got region %s, asn %s, want %s, %s", tt.addr, region, asn, tt.region, tt.asn)
+		}
+	}
+}
+
+// TestGeoRouting verifies that requests are sent to the service for
+// their client's region, and their latency observed by region.
+func TestGeoRouting(t *testing.T) {
+	newBackend := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+	}
+	home, brazil := newBackend("home"), newBackend("brazil")
+	defer home.Close()
+	defer brazil.Close()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Geo = &config.Geo{Database: "unused.mmdb", Regions: []string{"BR"}}
+	testConfig.Services[0].Name = "geo-service"
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, home)}
+	testConfig.Services = append(testConfig.Services, config.Service{
+		Name:   "geo-service-br",
+		Domain: "geo-service-br.my-company.com",
+		Hosts:  []config.HostPort{backendHostPort(t, brazil)},
+	})
+
+	var tests = []struct {
+		country        string
+		regionServices map[string]string
+		want           string
+	}{
+		{"", nil, "home"},
+		{"BR", nil, "home"},
+		{"BR", map[string]string{"BR": "geo-service-br"}, "brazil"},
+		{"BR", map[string]string{"BR-SP": "geo-service-br"}, "home"},
+		{"AR", map[string]string{"BR": "geo-service-br"}, "home"},
+	}
+
+	for _, tt := range tests {
+		testConfig.Services[0].RegionServices = tt.regionServices
+		proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		db := fakeGeoDatabase{"127.0.0.1": {Country: tt.country}}
+		proxy.geo = newGeoLocatorFromDatabases(testConfig.Geo, db, nil)
+		ts := httptest.NewServer(proxy)
+
+		resp, err := http.Get(ts.URL + "/?s=my-service.my-company.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		ts.Close()
+		proxy.Close()
+
+		if string(body) != tt.want {
+			t.Errorf("%s %v: got %q, want %q", tt.country, tt.regionServices, body, tt.want)
+		}
+	}
+
+	// geo-service from unknown, BR and other regions, and geo-service-br
+	// from BR
+	if got := testutil.CollectAndCount(requestGeoDuration); got != 4 {
+		t.Errorf("got %d region series, want 4", got)
+	}
+}
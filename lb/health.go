@@ -0,0 +1,112 @@
+package main
+
+import (
+	"afe/health"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// proxyCheck returns a health.Check that runs check against proxy.
+func proxyCheck(proxy *Proxy, name string, check HealthChecker) health.Check {
+	return health.Check{
+		Name: name,
+		Func: func(context.Context) error { return check(proxy) },
+	}
+}
+
+// newLivenessChecks returns the checks that determine whether the process
+// is alive. They never depend on backends, as restarting the proxy won't
+// fix them.
+func newLivenessChecks(proxy *Proxy) *health.Registry {
+	r := health.NewRegistry()
+	r.MustRegister(proxyCheck(proxy, "ping", func(*Proxy) error { return nil }))
+	return r
+}
+
+// newReadinessChecks returns the checks that determine whether the proxy
+// should be sent traffic: it must have loaded a configuration, it must
+// not be draining, each critical service must have enough healthy hosts,
+// and the proxy's own HealthChecker must pass.
+func newReadinessChecks(proxy *Proxy) *health.Registry {
+	r := health.NewRegistry()
+	r.MustRegister(
+		proxyCheck(proxy, "config", checkConfigLoaded),
+		proxyCheck(proxy, "draining", checkNotDraining),
+		proxyCheck(proxy, "backends", checkCriticalBackends),
+		proxyCheck(proxy, "health-checker", func(proxy *Proxy) error { return proxy.healthChecker(proxy) }),
+	)
+	return r
+}
+
+// checkConfigLoaded fails if the proxy has no routing table.
+func checkConfigLoaded(proxy *Proxy) error {
+	if proxy.routes() == nil {
+		return errors.New("no configuration loaded")
+	}
+	return nil
+}
+
+// checkNotDraining fails if the proxy is draining ahead of shutting down.
+func checkNotDraining(proxy *Proxy) error {
+	if proxy.draining.Load() {
+		return errors.New("proxy is draining")
+	}
+	return nil
+}
+
+// checkCriticalBackends fails if any critical service has fewer healthy
+// hosts than its readiness policy requires. A host is healthy if it has
+// not been drained and requests to it are not failing.
+func checkCriticalBackends(proxy *Proxy) error {
+	table := proxy.routes()
+	if table == nil {
+		return nil // Reported by checkConfigLoaded
+	}
+
+	var msgs []string
+	for _, s := range table.config.Services {
+		if !s.Readiness.Critical {
+			continue
+		}
+		want := s.Readiness.MinHealthyHosts
+		if want == 0 {
+			want = 1
+		}
+
+		svc, ok := table.service(s.Name)
+		if !ok {
+			continue
+		}
+		healthy := 0
+		for _, b := range svc.pool.list() {
+			if !b.drained.Load() && b.healthy() {
+				healthy++
+			}
+		}
+		if healthy < want {
+			msgs = append(msgs, fmt.Sprintf("service %s has %d healthy hosts, needs %d", s.Name, healthy, want))
+		}
+	}
+	if msgs == nil {
+		return nil
+	}
+	sort.Strings(msgs)
+	return errors.New(strings.Join(msgs, ", "))
+}
+
+// newGRPCHealthServer returns a gRPC server for the gRPC health service.
+// The empty service name reports the proxy's readiness, "liveness" its
+// liveness. Clients the admin ACL doesn't allow are refused.
+func newGRPCHealthServer(proxy *Proxy) *grpc.Server {
+	s := grpc.NewServer(grpcAdminACL(proxy)...)
+	health.NewGRPCServer(map[string]*health.Registry{
+		"":         proxy.readiness,
+		"liveness": proxy.liveness,
+	}).Register(s)
+	return s
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"afe/config"
+	"afe/health"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// healthResponse is the verbose response from a health endpoint.
+type healthResponse struct {
+	Status string          `json:"status"`
+	Checks []health.Result `json:"checks"`
+}
+
+// TestReadiness verifies that readiness fails if a critical service has
+// too few healthy hosts, or if the proxy is draining, and that the
+// verbose response reports each check.
+func TestReadiness(t *testing.T) {
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{
+		{Address: "127.0.0.1", Port: 9090},
+		{Address: "127.0.0.1", Port: 9091},
+	}
+	testConfig.Services[0].Readiness = config.Readiness{Critical: true, MinHealthyHosts: 2}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	ts := httptest.NewServer(newAdminHandler(proxy, nil))
+	defer ts.Close()
+
+	svc, _ := proxy.routes().service("my-service")
+	failing, _ := svc.pool.find("127.0.0.1:9091")
+
+	var tests = []struct {
+		name     string
+		setup    func()
+		code     int
+		failures map[string]string
+	}{
+		{"ready", func() {}, http.StatusOK, nil},
+		{"unhealthy host", failing.markFailed, http.StatusServiceUnavailable, map[string]string{
+			"backends": "service my-service has 1 healthy hosts, needs 2",
+		}},
+		{"drained host", func() {
+			failing.markOK()
+			failing.drained.Store(true)
+		}, http.StatusServiceUnavailable, map[string]string{
+			"backends": "service my-service has 1 healthy hosts, needs 2",
+		}},
+		{"draining", func() {
+			failing.drained.Store(false)
+			proxy.draining.Store(true)
+		}, http.StatusServiceUnavailable, map[string]string{
+			"draining": "proxy is draining",
+		}},
+	}
+
+	for _, tt := range tests {
+		tt.setup()
+
+		resp, err := http.Get(ts.URL + "/readyz?verbose")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got healthResponse
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: could not decode response: %v", tt.name, err)
+		}
+
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, resp.StatusCode, tt.code)
+		}
+		if len(got.Checks) != len(proxy.readiness.Names()) {
+			t.Errorf("%s: got %d checks, want %d", tt.name, len(got.Checks), len(proxy.readiness.Names()))
+		}
+		for _, c := range got.Checks {
+			want, failed := tt.failures[c.Name]
+			if c.OK == failed || c.Error != want {
+				t.Errorf("%s: check %s got %+v, want error '%s'", tt.name, c.Name, c, want)
+			}
+		}
+
+		// The terse response lists the failures
+		resp, err = http.Get(ts.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, resp.StatusCode, tt.code)
+		}
+		for _, want := range tt.failures {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("%s: response '%s' does not contain '%s'", tt.name, body, want)
+			}
+		}
+	}
+
+	// Liveness is unaffected by readiness
+	resp, err := http.Get(ts.URL + "/livez")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/livez: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// kubernetesResync is how often the EndpointSlice informer re-lists
+	// from its cache, as a safety net against missed events.
+	kubernetesResync = 10 * time.Minute
+
+	// kubernetesSyncTimeout bounds how long start waits for the first
+	// list of EndpointSlices before leaving the watch to catch up in the
+	// background.
+	kubernetesSyncTimeout = 30 * time.Second
+)
+
+// newKubernetesClient returns a client for the cluster the proxy is
+// running in, or, outside a cluster, the cluster named by the usual
+// kubeconfig rules ($KUBECONFIG, ~/.kube/config).
+func newKubernetesClient() (kubernetes.Interface, error) {
+	cfg, err := rest.InClusterConfig()
+	if err == rest.ErrNotInCluster {
+		cfg, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			clientcmd.NewDefaultClientConfigLoadingRules(),
+			&clientcmd.ConfigOverrides{},
+		).ClientConfig()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "loading Kubernetes client configuration failed")
+	}
+
+	return kubernetes.NewForConfig(cfg)
+}
+
+// A kubernetesDiscoverer watches the EndpointSlices of a Kubernetes
+// Service and replaces the pool with their endpoints as they change.
+type kubernetesDiscoverer struct {
+	service string
+	cfg     config.Discovery
+	pool    *pool
+	client  kubernetes.Interface
+
+	// mu serialises syncs, so an older view of the slices can't
+	// overwrite a newer one.
+	mu     sync.Mutex
+	lister discoverylisters.EndpointSliceLister
+}
+
+func (k *kubernetesDiscoverer) start(ctx context.Context) {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.client, kubernetesResync,
+		informers.WithNamespace(k.cfg.Namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = discoveryv1.LabelServiceName + "=" + k.cfg.Name
+		}),
+	)
+
+	slices := factory.Discovery().V1().EndpointSlices()
+	k.lister = slices.Lister()
+	_, err := slices.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { k.sync() },
+		UpdateFunc: func(interface{}, interface{}) { k.sync() },
+		DeleteFunc: func(interface{}) { k.sync() },
+	})
+	if err != nil {
+		slog.Error("watching EndpointSlices failed", "service", k.service, "err", err)
+		return
+	}
+
+	factory.Start(ctx.Done())
+
+	syncCtx, cancel := context.WithTimeout(ctx, kubernetesSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), slices.Informer().HasSynced) {
+		slog.Warn("EndpointSlices not listed in time, continuing to watch", "service", k.service,
+			"namespace", k.cfg.Namespace, "name", k.cfg.Name, "timeout", kubernetesSyncTimeout)
+		return
+	}
+	k.sync()
+}
+
+// sync replaces the pool with the backends from the current set of
+// EndpointSlices.
+func (k *kubernetesDiscoverer) sync() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: k.cfg.Name})
+	slices, err := k.lister.EndpointSlices(k.cfg.Namespace).List(selector)
+	recordDiscovery(k.service, err)
+	if err != nil {
+		slog.Warn("listing EndpointSlices failed, keeping last known backends", "service", k.service, "err", err)
+		return
+	}
+
+	k.pool.set(endpointSliceBackends(slices, k.cfg.PortName))
+}
+
+// endpointSliceBackends returns a backend for each ready endpoint in
+// slices, on the port named portName. If no endpoint is ready, endpoints
+// that are terminating but still serving are used instead, so that a
+// Service whose pods are all shutting down keeps receiving traffic until
+// they stop serving.
+func endpointSliceBackends(slices []*discoveryv1.EndpointSlice, portName string) []backend {
+	var ready, terminating []backend
+	seen := make(map[string]bool)
+
+	for _, slice := range slices {
+		if slice.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+
+		port, ok := endpointSlicePort(slice, portName)
+		if !ok {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			if len(ep.Addresses) == 0 {
+				continue // All addresses are equivalent, so use the first
+			}
+			b := backend{
+				network: "tcp",
+				address: net.JoinHostPort(ep.Addresses[0], strconv.Itoa(port)),
+			}
+
+			// Per the API, unset conditions are treated as true, except
+			// terminating.
+			c := ep.Conditions
+			isReady := c.Ready == nil || *c.Ready
+			isServing := c.Serving == nil || *c.Serving
+			isTerminating := c.Terminating != nil && *c.Terminating
+
+			switch {
+			case isReady && !seen[b.address]:
+				seen[b.address] = true
+				ready = append(ready, b)
+			case isServing && isTerminating:
+				terminating = append(terminating, b)
+			}
+		}
+	}
+
+	if len(ready) > 0 {
+		return ready
+	}
+	return terminating
+}
+
+// endpointSlicePort returns the number of the port named portName in
+// slice. If portName is empty and the slice has a single port, that port
+// is used.
+func endpointSlicePort(slice *discoveryv1.EndpointSlice, portName string) (int, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		name := ""
+		if p.Name != nil {
+			name = *p.Name
+		}
+		if name == portName || (portName == "" && len(slice.Ports) == 1) {
+			return int(*p.Port), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"testing"
+	"time"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func boolPtr(b bool) *bool       { return &b }
+func int32Ptr(i int32) *int32    { return &i }
+func stringPtr(s string) *string { return &s }
+
+// endpoint returns an EndpointSlice endpoint for addr with the given
+// conditions.
+func endpoint(addr string, ready, serving, terminating bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses: []string{addr},
+		Conditions: discoveryv1.EndpointConditions{
+			Ready:       boolPtr(ready),
+			Serving:     boolPtr(serving),
+			Terminating: boolPtr(terminating),
+		},
+	}
+}
+
+// endpointSlice returns an EndpointSlice for the Kubernetes Service
+// my-service, with an "http" port of 8080.
+func endpointSlice(name string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "my-service"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: stringPtr("metrics"), Port: int32Ptr(9100)},
+			{Name: stringPtr("http"), Port: int32Ptr(8080)},
+		},
+	}
+}
+
+// waitForBackends waits for p to hold exactly want, failing the test if
+// it does not within a few seconds.
+func waitForBackends(t *testing.T, p *pool, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		got := backendAddrs(p)
+		if len(got) == len(want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkBackends(t, p, want...)
+}
+
+// TestEndpointSliceBackends verifies that endpoint conditions are
+// honoured when choosing backends.
+func TestEndpointSliceBackends(t *testing.T) {
+	slices := []*discoveryv1.EndpointSlice{
+		endpointSlice("a",
+			endpoint("10.0.0.1", true, true, false),
+			endpoint("10.0.0.2", false, false, false),
+			endpoint("10.0.0.3", false, true, true),
+		),
+		endpointSlice("b",
+			endpoint("10.0.0.1", true, true, false),
+			endpoint("10.0.0.4", true, true, false),
+		),
+	}
+
+	p := &pool{}
+	p.set(endpointSliceBackends(slices, "http"))
+	checkBackends(t, p, "10.0.0.1:8080", "10.0.0.4:8080")
+
+	// With no ready endpoints, fall back to those terminating but serving.
+	slices = []*discoveryv1.EndpointSlice{
+		endpointSlice("a",
+			endpoint("10.0.0.2", false, false, false),
+			endpoint("10.0.0.3", false, true, true),
+			endpoint("10.0.0.5", false, false, true),
+		),
+	}
+	p.set(endpointSliceBackends(slices, "http"))
+	checkBackends(t, p, "10.0.0.3:8080")
+
+	// Unknown port names match nothing.
+	p.set(endpointSliceBackends(slices, "grpc"))
+	checkBackends(t, p)
+}
+
+// TestKubernetesDiscovery verifies that the pool follows changes to the
+// EndpointSlices of the watched Service.
+func TestKubernetesDiscovery(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		endpointSlice("my-service-a", endpoint("10.0.0.1", true, true, false)),
+	)
+
+	p := &pool{}
+	d := &kubernetesDiscoverer{
+		service: "my-service",
+		cfg: config.Discovery{
+			Type:      config.DiscoveryKubernetes,
+			Name:      "my-service",
+			Namespace: "default",
+			PortName:  "http",
+		},
+		pool:   p,
+		client: client,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.start(ctx)
+	checkBackends(t, p, "10.0.0.1:8080")
+
+	slices := client.DiscoveryV1().EndpointSlices("default")
+	_, err := slices.Create(ctx, endpointSlice("my-service-b",
+		endpoint("10.0.0.2", true, true, false),
+		endpoint("10.0.0.3", true, true, false),
+	), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForBackends(t, p, "10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080")
+
+	_, err = slices.Update(ctx, endpointSlice("my-service-b",
+		endpoint("10.0.0.2", true, true, false),
+		endpoint("10.0.0.3", false, true, true),
+	), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForBackends(t, p, "10.0.0.1:8080", "10.0.0.2:8080")
+
+	if err := slices.Delete(ctx, "my-service-a", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForBackends(t, p, "10.0.0.2:8080")
+
+	// Slices for other Services are ignored.
+	other := endpointSlice("other-service", endpoint("10.0.1.1", true, true, false))
+	other.Labels[discoveryv1.LabelServiceName] = "other-service"
+	if _, err := slices.Create(ctx, other, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	checkBackends(t, p, "10.0.0.2:8080")
+}
@@ -2,19 +2,24 @@ package main
 
 import (
 	"afe/config"
+	"afe/health"
+	"afe/logging"
+	"context"
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // A HealthChecker determines whether the service is healthy, and returns
@@ -26,29 +31,109 @@ type HealthChecker func(*Proxy) error
 // A Proxy implements the http.Handler interface and routes requests
 // to backends in its configuration.
 type Proxy struct {
-	config config.ProxyConfig
-	// reverseProxy maps a service domain to the ReverseProxy for that service
-	reverseProxy map[string]*httputil.ReverseProxy
+	// table holds the routing table built from the current
+	// configuration. It is replaced when the configuration is reloaded
+	table atomic.Pointer[routingTable]
+	// reloadMu serialises configuration reloads
+	reloadMu sync.Mutex
+	// transport is shared by every routing table, so connections to
+	// backends survive a reload
+	transport *http.Transport
 	// healthChecker determines whether the service is healthy or not
 	healthChecker HealthChecker
+	// liveness and readiness are the proxy's health checks, served on
+	// the admin listeners
+	liveness, readiness *health.Registry
+	// draining is set when the proxy is about to shut down, and fails
+	// its readiness checks so that it stops being sent traffic
+	draining atomic.Bool
+	// active counts the requests being handled, including upgraded
+	// connections, so that Shutdown can wait for them
+	active atomic.Int64
+	// serverCtx is the base context of requests served by NewServer's
+	// servers. Shutdown cancels it with cancelServer
+	serverCtx    context.Context
+	cancelServer context.CancelFunc
+	// tracer starts the spans of traced requests
+	tracer trace.Tracer
+	// accessLog records each request, if configured
+	accessLog *accessLogger
+	// clientStats tracks the top clients, if configured
+	clientStats *clientStats
+	// geo finds where clients are, if configured
+	geo *geoLocator
+	// captures keeps failed and slow requests, if configured
+	captures *captureLog
+}
+
+// A service is the runtime state of a configured service.
+type service struct {
+	name   string
+	domain string
+	// pool holds the backends requests are balanced across
+	pool *pool
+	// reverseProxy forwards requests to the backend picked from pool
+	reverseProxy *httputil.ReverseProxy
+	// accessLog is how the service's requests are recorded in the
+	// access log, nil to record them all
+	accessLog *config.ServiceAccessLog
+	// regionServices maps a client's region to the name of the service
+	// its requests are sent to instead
+	regionServices map[string]string
+	// slo measures the service's requests against its SLO, if it has one
+	slo *sloTracker
+	// slowThreshold is how long a request can take before it is
+	// captured, 0 to only capture failed requests
+	slowThreshold time.Duration
+	// acl restricts the clients of the service, if it has one
+	acl *acl
+	// discovery keeps the pool up to date, if the service's backends are
+	// discovered
+	discovery *discovery
 }
 
 var configPath = flag.String("config", "config.yaml", "full path to config file")
+var watchConfig = flag.Bool("watch-config", false, "reload the config file when it changes")
 
-var httpClientDurations = prometheus.NewSummaryVec(
-	prometheus.SummaryOpts{
-		Name:       "proxy_backend_duration_ms",
-		Help:       "Proxy latency distributions for backend requests.",
-		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1.0: 0.0},
-	},
-	[]string{"service"},
-)
+// logLevel is the level of the application log, which the admin API can
+// change.
+var logLevel slog.LevelVar
 
 func init() {
-	prometheus.MustRegister(httpClientDurations)
+	for _, h := range latencyHistograms {
+		prometheus.MustRegister(h)
+	}
+	for _, h := range connectionHistograms {
+		prometheus.MustRegister(h)
+	}
+	prometheus.MustRegister(backendConnections)
+	prometheus.MustRegister(requestsTotal)
+	prometheus.MustRegister(inFlightRequests)
+	prometheus.MustRegister(backendResponses)
+	prometheus.MustRegister(proxyErrors)
+	prometheus.MustRegister(adminForbidden)
+	prometheus.MustRegister(discoveryUpdates)
+	prometheus.MustRegister(configReloads)
+	prometheus.MustRegister(configGeneration)
+	prometheus.MustRegister(adminActions)
+	prometheus.MustRegister(requestGeoDuration)
+	prometheus.MustRegister(sloEventsTotal)
+	prometheus.MustRegister(capturedRequests)
 }
 
 func main() {
+	flag.Parse()
+
+	if flag.Arg(0) == sloRulesCommand {
+		if errs := writeSLORulesFromFile(*configPath, os.Stdout); errs != nil {
+			for _, err := range errs {
+				fmt.Printf("error: %v\n", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
 	proxy, errs := NewProxyFromFile(*configPath, okHealthCheck)
 	if errs != nil {
 		for _, err := range errs {
@@ -57,11 +142,159 @@ func main() {
 		os.Exit(1)
 	}
 
-	log.Printf("config: %+v", proxy.config)
+	defer proxy.Close()
+
+	cfg := proxy.routes().config
+	if err := logging.Setup(cfg.Logging, &logLevel); err != nil {
+		logging.Fatal("configuring logging failed", "err", err)
+	}
+	slog.Debug("configuration loaded", "config", fmt.Sprintf("%+v", cfg))
+
+	reloadOnSignal(proxy, *configPath)
+	if *watchConfig {
+		if err := reloadOnChange(proxy, *configPath); err != nil {
+			logging.Fatal("watching configuration failed", "err", err)
+		}
+	}
+
+	prometheus.MustRegister(backendCollector{proxy})
+	prometheus.MustRegister(sloCollector{proxy})
+
+	if cfg.Tracing.Endpoint != "" {
+		tp, err := newTracerProvider(context.Background(), cfg.Tracing)
+		if err != nil {
+			logging.Fatal("configuring tracing failed", "err", err)
+		}
+		otel.SetTracerProvider(tp)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tp.Shutdown(ctx); err != nil {
+				slog.Error("flushing spans failed", "err", err)
+			}
+		}()
+		slog.Info("exporting spans", "endpoint", cfg.Tracing.Endpoint)
+	}
+
+	if cfg.Metrics.StatsD != nil {
+		s, err := newStatsDSink(cfg.Metrics.StatsD)
+		if err != nil {
+			logging.Fatal("configuring StatsD failed", "err", err)
+		}
+		defer func() {
+			if err := s.Close(); err != nil {
+				slog.Error("flushing metrics to StatsD failed", "err", err)
+			}
+		}()
+		addMetricSink(s)
+		slog.Info("sending metrics to StatsD", "address", cfg.Metrics.StatsD.Address)
+	}
+	if cfg.Metrics.OTLP != nil {
+		s, err := newOTLPSink(context.Background(), cfg.Metrics.OTLP)
+		if err != nil {
+			logging.Fatal("configuring OTLP metrics failed", "err", err)
+		}
+		defer func() {
+			if err := s.Close(); err != nil {
+				slog.Error("flushing metrics to OTLP failed", "err", err)
+			}
+		}()
+		addMetricSink(s)
+		slog.Info("exporting metrics", "endpoint", cfg.Metrics.OTLP.Endpoint)
+	}
+
+	if cfg.AccessLog != nil {
+		accessLog, err := newAccessLogger(cfg.AccessLog)
+		if err != nil {
+			logging.Fatal("opening access log failed", "err", err)
+		}
+		defer accessLog.Close()
+		proxy.accessLog = accessLog
+	}
+
+	if cfg.ClientStats != nil {
+		clientStats, err := newClientStats(cfg.ClientStats, time.Now())
+		if err != nil {
+			logging.Fatal("configuring client statistics failed", "err", err)
+		}
+		proxy.clientStats = clientStats
+		prometheus.MustRegister(clientStatsCollector{clientStats})
+	}
+
+	if cfg.Geo != nil {
+		geo, err := newGeoLocator(cfg.Geo)
+		if err != nil {
+			logging.Fatal("opening geo databases failed", "err", err)
+		}
+		defer geo.Close()
+		proxy.geo = geo
+	}
+
+	if cfg.Capture != nil {
+		proxy.captures = newCaptureLog(cfg.Capture)
+		dumpCapturesOnSignal(proxy.captures)
+	}
+
+	listeners, err := newListenerSet()
+	if err != nil {
+		logging.Fatal("finding inherited listeners failed", "err", err)
+	}
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/", proxy)
-	log.Fatal(http.ListenAndServe(proxy.config.Listen.String(), nil))
+	// The control-plane servers are stopped once a new process has taken
+	// over their listeners
+	var controlPlane []func()
+
+	if cfg.Admin.Listen.Port != 0 {
+		l, err := listeners.listen(adminListener, cfg.Admin.Listen.String())
+		if err != nil {
+			logging.Fatal("listening failed", "listener", adminListener, "err", err)
+		}
+		admin := &http.Server{Handler: newAdminHandler(proxy, func() []error {
+			return proxy.ReloadFromFile(*configPath)
+		})}
+		go func() {
+			if err := admin.Serve(l); err != http.ErrServerClosed {
+				logging.Fatal("serving failed", "listener", adminListener, "err", err)
+			}
+		}()
+		controlPlane = append(controlPlane, func() { admin.Close() })
+
+		if cfg.Admin.GRPCListen.Port != 0 {
+			l, err := listeners.listen(grpcListener, cfg.Admin.GRPCListen.String())
+			if err != nil {
+				logging.Fatal("listening failed", "listener", grpcListener, "err", err)
+			}
+			s := newGRPCHealthServer(proxy)
+			go func() {
+				if err := s.Serve(l); err != nil {
+					logging.Fatal("serving failed", "listener", grpcListener, "err", err)
+				}
+			}()
+			controlPlane = append(controlPlane, s.Stop)
+		}
+	} else {
+		slog.Warn("no admin listen address, metrics and health endpoints are disabled")
+	}
+
+	// Every path is proxied, including /metrics, which is served on the
+	// admin listener instead.
+	l, err := listeners.listen(dataListener, cfg.Listen.String())
+	if err != nil {
+		logging.Fatal("listening failed", "listener", dataListener, "err", err)
+	}
+	server := proxy.NewServer(cfg.Listen.String())
+	done := shutdownOnSignal(proxy, server, listeners, func() {
+		for _, stop := range controlPlane {
+			stop()
+		}
+	})
+	go func() {
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			logging.Fatal("serving failed", "listener", dataListener, "err", err)
+		}
+	}()
+	listeners.serving()
+	<-done
 }
 
 // NewProxyFromFile returns a new Proxy initialised with the configuration
@@ -85,18 +318,34 @@ func NewProxyFromConfig(cfg *config.ProxyConfig, hc HealthChecker) (*Proxy, []er
 	}
 
 	p := &Proxy{
-		config:        *cfg,
+		transport:     newTransport(),
 		healthChecker: hc,
+		tracer:        otel.Tracer(tracerName),
 	}
+	p.serverCtx, p.cancelServer = context.WithCancel(context.Background())
+	p.liveness = newLivenessChecks(p)
+	p.readiness = newReadinessChecks(p)
 
-	p.reverseProxy = make(map[string]*httputil.ReverseProxy)
-	for _, service := range p.config.Proxy.Services {
-		p.reverseProxy[service.Domain] = NewRandomBackendReverseProxy(service.Hosts)
+	table, err := newRoutingTable(cfg, p.transport, nil)
+	if err != nil {
+		return nil, []error{err}
 	}
+	p.table.Store(table)
+	configGeneration.Set(float64(table.generation))
 
 	return p, nil
 }
 
+// routes returns the proxy's current routing table.
+func (proxy *Proxy) routes() *routingTable {
+	return proxy.table.Load()
+}
+
+// Close stops the proxy's background work.
+func (proxy *Proxy) Close() {
+	proxy.routes().close()
+}
+
 // ServeHTTP implements the generic proxy.
 //
 // If this was a real application requests would be proxied based on
@@ -107,50 +356,127 @@ func NewProxyFromConfig(cfg *config.ProxyConfig, hc HealthChecker) (*Proxy, []er
 // Handles health checks by looking for a "health-check" header. If
 // present then the request is not proxied, and an indication of the
 // server's health is returned.
-func (proxy Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	proxy.active.Add(1)
+	defer proxy.active.Add(-1)
+
+	// The request is identified to the backend, the client and in logs
+	table := proxy.routes()
+	idConfig := table.config.RequestID
+	id := requestID(req, idConfig)
+	req.Header.Set(idConfig.HeaderName(), id)
+	w.Header().Set(idConfig.HeaderName(), id)
+	req = req.WithContext(logging.NewContext(withRequestID(req.Context(), id), "request_id", id))
+
 	isHealthCheck := req.Header.Get("health-check")
 	if isHealthCheck != "" {
-		if err := proxy.healthChecker(&proxy); err != nil {
+		if !table.acl.allows(req.RemoteAddr) {
+			proxyError(w, req, "", reasonForbidden, http.StatusForbidden, "forbidden")
+			return
+		}
+		if err := proxy.healthChecker(proxy); err != nil {
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
 			return
 		}
-		_, err := io.WriteString(w, "ok")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Fatalf("writing health check response failed: %v", err)
+		if _, err := io.WriteString(w, "ok"); err != nil {
+			// The client has probably gone, there's no one to tell
+			slog.WarnContext(req.Context(), "writing health check response failed", "err", err)
 		}
 		return
 	}
 
+	ctx, span := proxy.startServerSpan(req)
+	span.SetAttributes(requestIDAttr.String(id))
+	req = req.WithContext(ctx)
+	rec := &responseRecorder{ResponseWriter: w}
+
+	// Set as the request is handled, for the access log
+	entry := newAccessRecord(req, start)
+	geo := proxy.locate(req)
+	var (
+		svc   *service
+		b     *backendState
+		stats httpTraceStats
+		berr  backendError
+	)
+	defer func() {
+		endSpan(span, rec.status)
+		proxy.capture(req, entry, rec, start, svc, b, &stats, &berr)
+		proxy.logAccess(entry, rec, svc, b, &stats)
+		proxy.recordClient(req, rec.status)
+		proxy.observeGeo(svc, geo, start)
+		recordSLO(svc, rec.status, time.Since(start))
+	}()
+
+	if !table.acl.allows(req.RemoteAddr) {
+		slog.InfoContext(ctx, "request forbidden by the proxy ACL")
+		requestsTotal.WithLabelValues("").Inc()
+		proxyError(rec, req, "", reasonForbidden, http.StatusForbidden, "forbidden")
+		return
+	}
+
 	q := req.URL.Query()
-	service := q.Get("s")
+	domain := q.Get("s")
 
-	if service == "" {
-		log.Printf("missing 's' parameter in URL %s\n", req.URL)
-		http.Error(w, "service not found", http.StatusNotFound)
+	if domain == "" {
+		slog.InfoContext(ctx, "request has no service", "url", req.URL.String())
+		requestsTotal.WithLabelValues("").Inc()
+		proxyError(rec, req, "", reasonUnknownService, http.StatusNotFound, "service not found")
 		return
 	}
 
-	backend, ok := proxy.reverseProxy[service]
+	svc, ok := proxy.route(ctx, domain, geo)
 	if !ok {
-		log.Printf("no reverse proxy for s=%s\n", service)
-		http.Error(w, "service not found", http.StatusNotFound)
+		slog.InfoContext(ctx, "request for unknown service", "domain", domain)
+		requestsTotal.WithLabelValues("").Inc()
+		proxyError(rec, req, "", reasonUnknownService, http.StatusNotFound, "service not found")
+		return
+	}
+	span.SetAttributes(serviceAttr.String(svc.name))
+
+	requestsTotal.WithLabelValues(svc.name).Inc()
+	inFlight := inFlightRequests.WithLabelValues(svc.name)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	if !svc.acl.allows(req.RemoteAddr) {
+		slog.InfoContext(ctx, "request forbidden by the service ACL", "service", svc.name)
+		proxyError(rec, req, svc.name, reasonForbidden, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	b, ok = proxy.pickBackend(ctx, svc)
+	if !ok {
+		slog.WarnContext(ctx, "no backends available", "service", svc.name)
+		proxyError(rec, req, svc.name, reasonNoBackend, http.StatusServiceUnavailable, "no backend available")
 		return
 	}
 
 	q.Del("s")
 	req.URL.RawQuery = q.Encode()
-	log.Printf("routing request for service %s\n", service)
+	slog.DebugContext(ctx, "routing request", "service", svc.name)
 
-	var stats httpTraceStats
-	ctx := WithHTTPTrace(req.Context(), &stats)
+	ctx, upstream := proxy.startUpstreamSpan(ctx, svc, b)
+	ctx = WithHTTPTrace(ctx, &stats)
+	ctx = withBackend(ctx, b)
+	ctx = withBackendError(ctx, &berr)
 	req = req.WithContext(ctx)
 
-	backend.ServeHTTP(w, req)
+	var body *timedBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &timedBody{ReadCloser: req.Body}
+		req.Body = body
+	}
+
+	b.inFlight.Add(1)
+	defer b.inFlight.Add(-1)
+	svc.reverseProxy.ServeHTTP(rec, req)
 
 	stats.Done()
-	log.Printf("Stats: Service(%s) %s\n", service, stats.String())
-	httpClientDurations.WithLabelValues(service).Observe(float64(stats.LatencyTotal / time.Millisecond))
+	endUpstreamSpan(upstream, &stats, rec.status)
+	slog.DebugContext(ctx, "request complete", "service", svc.name, "backend", b.backend.String(), "status", rec.status, "stats", stats.String())
+	observeRequest(svc, b.backend.String(), req, rec, body, start, &stats)
 }
 
 // okHealthChecker is a health checker that always returns no
@@ -159,16 +485,47 @@ func okHealthCheck(proxy *Proxy) error {
 	return nil
 }
 
-// NewRandomBackendReverseProxy returns a new httputil.ReverseProxy which will
-// direct each request to a randomly selected backend.
-func NewRandomBackendReverseProxy(backends []config.HostPort) *httputil.ReverseProxy {
+// newReverseProxy returns a new httputil.ReverseProxy which will direct
+// each request to the backend stored in the request's context by
+// withBackend. The backend's requestIDHeader is dropped from its
+// response, as ServeHTTP has already set it.
+func newReverseProxy(name, requestIDHeader string, transport http.RoundTripper) *httputil.ReverseProxy {
 	director := func(req *http.Request) {
-		i := rand.Intn(len(backends))
-		backend := backends[i]
+		b, _ := backendFromContext(req.Context())
 		req.URL.Scheme = "http" // TODO: In real code this would be https
-		req.URL.Host = backend.String()
-		log.Printf("final URL: %s", req.URL)
+		req.URL.Host = b.backend.urlHost()
+		injectTraceContext(req)
+		slog.DebugContext(req.Context(), "sending request to backend", "backend", b.backend.String(), "path", req.URL.RequestURI())
+	}
+
+	// Passively track backend health. A failure is only the backend's
+	// fault if the client didn't give up first.
+	modifyResponse := func(resp *http.Response) error {
+		if b, ok := backendFromContext(resp.Request.Context()); ok {
+			b.markOK()
+		}
+		resp.Header.Del(requestIDHeader)
+		backendResponses.WithLabelValues(name, strconv.Itoa(resp.StatusCode)).Inc()
+		return nil
+	}
+	errorHandler := func(w http.ResponseWriter, req *http.Request, err error) {
+		reason, code := backendErrorReason(req, err)
+		if b, ok := backendFromContext(req.Context()); ok && reason != reasonClientCancel {
+			b.markFailed()
+		}
+		if e, ok := backendErrorFromContext(req.Context()); ok {
+			e.reason, e.err = reason, err
+		}
+		slog.WarnContext(req.Context(), "proxying to backend failed", "service", name, "reason", reason, "err", err)
+		proxyErrors.WithLabelValues(name, reason).Inc()
+		recordSpanError(req.Context(), reason, err)
+		w.WriteHeader(code)
 	}
 
-	return &httputil.ReverseProxy{Director: director}
+	return &httputil.ReverseProxy{
+		Director:       director,
+		Transport:      transport,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+	}
 }
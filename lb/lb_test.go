@@ -5,9 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -198,3 +201,158 @@ func TestProxyFunctionality(t *testing.T) {
 		t.Fatalf("got '%s', want '%s' as response body", result, "service not found")
 	}
 }
+
+// TestProxyUnixSocket verifies that requests can be proxied to a backend
+// listening on a Unix domain socket.
+func TestProxyUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "backend.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backendResp := "this is the unix backend"
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, backendResp)
+	}))
+	backend.Listener = l
+	backend.Start()
+	defer backend.Close()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{{
+		Address: "unix://" + socket,
+	}}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/?s=my-service.my-company.com", ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response body: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if strings.TrimSpace(string(result)) != backendResp {
+		t.Fatalf("got '%s', want '%s' as response body", result, backendResp)
+	}
+}
+
+// TestProxyHostname verifies that a host given as a DNS name is resolved,
+// and that each resolved address becomes a separate backend.
+func TestProxyHostname(t *testing.T) {
+	backendResp := "this is the named backend"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, backendResp)
+	}))
+	defer backend.Close()
+
+	backendUrl, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatalf("could not parse '%s' as a URL: %+v", backend.URL, err)
+	}
+	parsedPort, err := strconv.ParseInt(backendUrl.Port(), 10, 0)
+	if err != nil {
+		t.Fatalf("could not parse '%s' as an int: %+v", backendUrl.Port(), err)
+	}
+
+	server := startDNSServer(t,
+		"backend.test. 30 IN A "+backendUrl.Hostname(),
+		"backends.test. 30 IN A 127.0.0.2",
+		"backends.test. 30 IN A 127.0.0.3",
+	)
+	defer server.stop()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Resolvers = []string{server.addr}
+	testConfig.Services[0].Hosts = []config.HostPort{{
+		Address: "backend.test",
+		Port:    int(parsedPort),
+	}}
+	testConfig.Services = append(testConfig.Services, config.Service{
+		Name:   "other-service",
+		Domain: "other-service.my-company.com",
+		Hosts:  []config.HostPort{{Address: "backends.test", Port: 80}},
+	})
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	if n := len(proxy.routes().services["other-service.my-company.com"].pool.list()); n != 2 {
+		t.Errorf("got %d backends for other-service, want 2", n)
+	}
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/?s=my-service.my-company.com", ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response body: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if strings.TrimSpace(string(result)) != backendResp {
+		t.Fatalf("got '%s', want '%s' as response body", result, backendResp)
+	}
+}
+
+// TestProxyForwardsAllPaths verifies that every path is proxied,
+// including those, like /metrics, that the proxy serves on its admin
+// listener.
+func TestProxyForwardsAllPaths(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	for _, path := range []string{"/", "/metrics", "/livez", "/debug/pprof/"} {
+		resp, err := http.Get(fmt.Sprintf("%s%s?s=my-service.my-company.com", ts.URL, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(result) != path {
+			t.Errorf("got '%s', want '%s' from the backend", result, path)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the proxy's listeners, as passed between processes.
+const (
+	dataListener  = "data"
+	adminListener = "admin"
+	grpcListener  = "grpc"
+)
+
+// listenerOrder is the order systemd sockets are assigned to listeners if
+// they aren't named.
+var listenerOrder = []string{dataListener, adminListener, grpcListener}
+
+// Environment variables used to pass listeners to a new process on
+// upgrade. listenFDNamesEnv lists the names of the listeners, colon
+// separated, which are passed as file descriptors from 3 on.
+// upgradeReadyFDEnv is the file descriptor the new process writes to
+// once it is serving.
+const (
+	listenFDNamesEnv  = "AFE_LISTEN_FDNAMES"
+	upgradeReadyFDEnv = "AFE_UPGRADE_READY_FD"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd, and on
+// upgrade.
+const listenFDsStart = 3
+
+// upgradeTimeout bounds how long the old process waits for the new one to
+// start serving.
+const upgradeTimeout = 30 * time.Second
+
+// A listenerSet is the proxy's named listeners. They can be inherited
+// from the process that started this one, either a previous lb process
+// handing them over on upgrade or systemd socket activation, and handed
+// over to a new process in turn, so the listening sockets are never
+// closed and no connection is refused.
+type listenerSet struct {
+	// inherited holds the listeners passed to the process that haven't
+	// been taken by listen
+	inherited map[string]net.Listener
+	// names and listeners are the listeners in use
+	names     []string
+	listeners []net.Listener
+	// ready is written to tell the old process this one is serving
+	ready *os.File
+	// command returns the command handOff starts
+	command func() *exec.Cmd
+}
+
+// newListenerSet returns a listenerSet holding the listeners passed to
+// the process, if any.
+func newListenerSet() (*listenerSet, error) {
+	ls := &listenerSet{
+		inherited: make(map[string]net.Listener),
+		command:   upgradeCommand,
+	}
+
+	names, err := passedListenerNames(os.Getenv, os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+
+	for i, name := range names {
+		fd := listenFDsStart + i
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "listener %s on file descriptor %d is not usable", name, fd)
+		}
+		ls.inherited[name] = l
+	}
+
+	if fd := os.Getenv(upgradeReadyFDEnv); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, errors.Errorf("%s=%q is not a file descriptor", upgradeReadyFDEnv, fd)
+		}
+		ls.ready = os.NewFile(uintptr(n), "upgrade-ready")
+	}
+
+	// Not passed on to processes this one starts
+	for _, env := range []string{listenFDNamesEnv, upgradeReadyFDEnv, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+	return ls, nil
+}
+
+// passedListenerNames returns the names of the listeners passed to the
+// process with the given pid, in file descriptor order, from the
+// environment read by getenv.
+//
+// Listeners from a previous lb process are named by listenFDNamesEnv.
+// Listeners from systemd are named with FileDescriptorName= in the socket
+// unit, or if they don't have one of the names lb uses, they are taken
+// to be the data, admin and gRPC listeners in that order.
+func passedListenerNames(getenv func(string) string, pid int) ([]string, error) {
+	if names := getenv(listenFDNamesEnv); names != "" {
+		return strings.Split(names, ":"), nil
+	}
+
+	if getenv("LISTEN_PID") == "" {
+		return nil, nil
+	}
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil // Meant for another process
+	}
+
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, errors.Errorf("LISTEN_FDS=%q is not a number of file descriptors", getenv("LISTEN_FDS"))
+	}
+	if n > len(listenerOrder) {
+		return nil, errors.Errorf("LISTEN_FDS=%d, at most %d sockets can be used", n, len(listenerOrder))
+	}
+
+	fdNames := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	named := len(fdNames) == n
+	for _, name := range fdNames {
+		if name != dataListener && name != adminListener && name != grpcListener {
+			named = false
+		}
+	}
+	if named {
+		return fdNames, nil
+	}
+	return listenerOrder[:n], nil
+}
+
+// listen returns the listener called name, inherited if possible, and
+// otherwise listening on address.
+func (ls *listenerSet) listen(name, address string) (net.Listener, error) {
+	l, ok := ls.inherited[name]
+	if ok {
+		delete(ls.inherited, name)
+		slog.Info("using inherited listener", "listener", name, "address", l.Addr().String())
+	} else {
+		var err error
+		if l, err = net.Listen("tcp", address); err != nil {
+			return nil, errors.Wrapf(err, "listening on %s failed", address)
+		}
+	}
+
+	ls.names = append(ls.names, name)
+	ls.listeners = append(ls.listeners, l)
+	return l, nil
+}
+
+// serving closes any inherited listeners that weren't used, and tells
+// the process that started this one, if it was an upgrade, that this
+// process is now serving.
+func (ls *listenerSet) serving() {
+	for name, l := range ls.inherited {
+		slog.Info("closing unused inherited listener", "listener", name, "address", l.Addr().String())
+		l.Close()
+	}
+	ls.inherited = nil
+
+	if ls.ready != nil {
+		if _, err := ls.ready.Write([]byte{1}); err != nil {
+			slog.Error("telling previous process this one is serving failed", "err", err)
+		}
+		ls.ready.Close()
+		ls.ready = nil
+	}
+}
+
+// upgradeCommand returns a command that runs the current binary with the
+// same arguments.
+func upgradeCommand() *exec.Cmd {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// handOff starts a new process, passing it the listeners, and waits for it
+// to start serving. Once it returns without error the new process accepts
+// connections on the listeners, and this process should stop.
+func (ls *listenerSet) handOff() error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, l := range ls.listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errors.Errorf("%s listener can't be passed to another process", ls.names[i])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return errors.Wrapf(err, "passing %s listener failed", ls.names[i])
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "creating upgrade pipe failed")
+	}
+	defer readyR.Close()
+
+	cmd := ls.command()
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		listenFDNamesEnv+"="+strings.Join(ls.names, ":"),
+		fmt.Sprintf("%s=%d", upgradeReadyFDEnv, listenFDsStart+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return errors.Wrap(err, "starting new process failed")
+	}
+	slog.Info("upgrade started new process", "pid", cmd.Process.Pid)
+
+	// The new process writes to the pipe when it is serving. If it exits
+	// first the read fails.
+	readyR.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	n, err := readyR.Read(make([]byte, 1))
+	if n == 0 {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return errors.Errorf("new process %d did not start serving within %v", cmd.Process.Pid, upgradeTimeout)
+		}
+		return errors.Errorf("new process %d exited before serving: %v", cmd.Process.Pid, cmd.Wait())
+	}
+	go cmd.Wait() // Reap the new process if this one outlives it
+
+	slog.Info("upgrade complete, new process is serving", "pid", cmd.Process.Pid)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handOffChildEnv is set when the test binary is run as the new process
+// by TestHandOff.
+const handOffChildEnv = "AFE_TEST_HANDOFF_CHILD"
+
+func TestPassedListenerNames(t *testing.T) {
+	var tests = []struct {
+		env  map[string]string
+		want string
+		err  bool
+	}{
+		{map[string]string{}, "", false},
+		{map[string]string{listenFDNamesEnv: "admin:data"}, "admin,data", false},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1"}, "data", false},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "3"}, "data,admin,grpc", false},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "admin:data"}, "admin,data", false},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "lb.socket:lb.socket"}, "data,admin", false},
+		{map[string]string{"LISTEN_PID": "7", "LISTEN_FDS": "1"}, "", false},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "x"}, "", true},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "4"}, "", true},
+	}
+
+	for _, tt := range tests {
+		names, err := passedListenerNames(func(k string) string { return tt.env[k] }, 42)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: got error %v, want error %t", tt.env, err, tt.err)
+		}
+		if got := strings.Join(names, ","); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
+
+// TestHandOff verifies that a new process can take over a listener, so
+// that connections are accepted throughout. The new process is this test
+// binary, running TestHandOffChild.
+func TestHandOff(t *testing.T) {
+	ls := &listenerSet{
+		inherited: make(map[string]net.Listener),
+		command: func() *exec.Cmd {
+			return exec.Command(os.Args[0], "-test.run=^TestHandOffChild$")
+		},
+	}
+	t.Setenv(handOffChildEnv, "1")
+
+	l, err := ls.listen(dataListener, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "parent")
+	})}
+	go server.Serve(l)
+
+	getBody := func(path string) (string, error) {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", addr, path))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if got, err := getBody("/"); err != nil || got != "parent" {
+		t.Fatalf("before hand off: got '%s', %v, want 'parent'", got, err)
+	}
+
+	if err := ls.handOff(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	http.DefaultClient.CloseIdleConnections()
+
+	if got, err := getBody("/"); err != nil || got != "child" {
+		t.Fatalf("after hand off: got '%s', %v, want 'child'", got, err)
+	}
+
+	getBody("/exit")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("new process did not exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestHandOffChild is the new process started by TestHandOff. It serves
+// the inherited listener until asked to exit.
+func TestHandOffChild(t *testing.T) {
+	if os.Getenv(handOffChildEnv) == "" {
+		t.Skip("only run by TestHandOff")
+	}
+
+	ls, err := newListenerSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ls.inherited[dataListener]; !ok {
+		t.Fatal("no data listener inherited")
+	}
+	l, err := ls.listen(dataListener, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exit := make(chan struct{})
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/exit" {
+			close(exit)
+			return
+		}
+		fmt.Fprint(w, "child")
+	}))
+	ls.serving()
+
+	select {
+	case <-exit:
+	case <-time.After(30 * time.Second):
+	}
+	l.Close()
+}
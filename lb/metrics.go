@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// requestLabels are the labels of the request latency histograms.
+var requestLabels = []string{"service", "backend", "method", "status"}
+
+// connectionLabels are the labels of the connection latency histograms.
+// Connections are made before a request's method or status matter.
+var connectionLabels = []string{"service", "backend"}
+
+// newLatencyHistogram returns a histogram of a request phase's latency in
+// seconds, with the given labels. It has classic buckets, from 0.5ms to
+// about 16s, and native buckets for scrapers that support them.
+func newLatencyHistogram(name, help string, labels []string) *histogramVec {
+	return newHistogramVec(
+		prometheus.HistogramOpts{
+			Name:                            name,
+			Help:                            help,
+			Buckets:                         prometheus.ExponentialBuckets(0.0005, 2, 16),
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  160,
+			NativeHistogramMinResetDuration: time.Hour,
+		},
+		labels,
+	)
+}
+
+// Request latency histograms, one for each phase of a proxied request.
+var (
+	clientRequestReadDuration = newLatencyHistogram(
+		"proxy_client_request_read_seconds",
+		"Time taken to read the body of the client's request, for requests with a body.",
+		requestLabels,
+	)
+	backendRequestDuration = newLatencyHistogram(
+		"proxy_backend_request_seconds",
+		"Time taken to send the request to the backend once connected.",
+		requestLabels,
+	)
+	backendProcessingDuration = newLatencyHistogram(
+		"proxy_backend_processing_seconds",
+		"Time from the request being sent to the first byte of the backend's response.",
+		requestLabels,
+	)
+	backendResponseDuration = newLatencyHistogram(
+		"proxy_backend_response_seconds",
+		"Time taken to receive the backend's response after its first byte.",
+		requestLabels,
+	)
+	backendTotalDuration = newLatencyHistogram(
+		"proxy_backend_total_seconds",
+		"Time taken to send the request to the backend and receive its response.",
+		requestLabels,
+	)
+	clientResponseWriteDuration = newLatencyHistogram(
+		"proxy_client_response_write_seconds",
+		"Time taken to write the response to the client, from its status line being written.",
+		requestLabels,
+	)
+)
+
+// latencyHistograms lists the request latency histograms, for
+// registration.
+var latencyHistograms = []*histogramVec{
+	clientRequestReadDuration,
+	backendRequestDuration,
+	backendProcessingDuration,
+	backendResponseDuration,
+	backendTotalDuration,
+	clientResponseWriteDuration,
+}
+
+// Connection latency histograms, one for each phase of getting a
+// connection to a backend. A phase is only observed if it happened, e.g.,
+// there is no DNS lookup for a backend addressed by IP, and nothing but
+// getting the connection for a reused one.
+var (
+	backendGetConnDuration = newLatencyHistogram(
+		"proxy_backend_get_conn_seconds",
+		"Time taken to get a connection to the backend, whether new or reused.",
+		connectionLabels,
+	)
+	backendDNSDuration = newLatencyHistogram(
+		"proxy_backend_dns_seconds",
+		"Time taken to look up the backend's address.",
+		connectionLabels,
+	)
+	backendConnectDuration = newLatencyHistogram(
+		"proxy_backend_connect_seconds",
+		"Time taken to connect to the backend.",
+		connectionLabels,
+	)
+	backendTLSDuration = newLatencyHistogram(
+		"proxy_backend_tls_seconds",
+		"Time taken by the TLS handshake with the backend.",
+		connectionLabels,
+	)
+)
+
+// connectionHistograms lists the connection latency histograms, for
+// registration.
+var connectionHistograms = []*histogramVec{
+	backendGetConnDuration,
+	backendDNSDuration,
+	backendConnectDuration,
+	backendTLSDuration,
+}
+
+// backendConnections counts the connections requests to backends were
+// sent on, by whether the connection was reused from the pool.
+var backendConnections = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_backend_connections_total",
+		Help: "Connections requests were sent to backends on, by service, backend and whether the connection was reused.",
+	},
+	[]string{"service", "backend", "reused"},
+)
+
+// Reasons the proxy responds to a request itself, rather than forwarding
+// the backend's response.
+const (
+	reasonUnknownService = "unknown_service"
+	reasonForbidden      = "forbidden"
+	reasonNoBackend      = "no_backend"
+	reasonConnectError   = "connect_error"
+	reasonTimeout        = "timeout"
+	reasonClientCancel   = "client_cancel"
+	reasonBackendError   = "backend_error"
+)
+
+// Request outcome metrics. Requests for an unknown service have an empty
+// service label, so clients can't create arbitrary label values.
+var (
+	requestsTotal = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_requests_total",
+			Help: "Requests received by service.",
+		},
+		[]string{"service"},
+	)
+	inFlightRequests = newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "proxy_in_flight_requests",
+			Help: "Requests currently being handled by service.",
+		},
+		[]string{"service"},
+	)
+	backendResponses = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_backend_responses_total",
+			Help: "Responses received from backends and forwarded to clients, by service and status code.",
+		},
+		[]string{"service", "code"},
+	)
+	proxyErrors = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_errors_total",
+			Help: "Requests the proxy responded to itself, without a backend response, by service and reason.",
+		},
+		[]string{"service", "reason"},
+	)
+)
+
+// proxyError responds to req with an error generated by the proxy, counts
+// it in proxyErrors, and records the reason on req's span.
+func proxyError(w http.ResponseWriter, req *http.Request, service, reason string, code int, msg string) {
+	proxyErrors.WithLabelValues(service, reason).Inc()
+	recordSpanError(req.Context(), reason, nil)
+	http.Error(w, msg, code)
+}
+
+// backendErrorReason classifies err, which occurred proxying req to a
+// backend, and returns the reason and the status code to respond with.
+func backendErrorReason(req *http.Request, err error) (string, int) {
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		// The client has gone, the status code is never seen
+		return reasonClientCancel, http.StatusBadGateway
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return reasonTimeout, http.StatusGatewayTimeout
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return reasonConnectError, http.StatusBadGateway
+	}
+
+	return reasonBackendError, http.StatusBadGateway
+}
+
+// methodClass returns the method label for a request method. Standard
+// methods are used as is, anything else is "OTHER", so clients can't
+// create arbitrary label values.
+func methodClass(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// statusClass returns the status label for a status code, e.g., "2xx".
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// A timedBody wraps a request body, recording when it has been read to
+// the end. It may be read by the transport on another goroutine.
+type timedBody struct {
+	io.ReadCloser
+	// done is when the body was read to the end, in Unix nanoseconds
+	done atomic.Int64
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done.CompareAndSwap(0, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// readDuration returns how long after start the body was read to the end,
+// or false if it hasn't been.
+func (b *timedBody) readDuration(start time.Time) (time.Duration, bool) {
+	done := b.done.Load()
+	if done == 0 {
+		return 0, false
+	}
+	return time.Unix(0, done).Sub(start), true
+}
+
+// A responseRecorder wraps an http.ResponseWriter, recording the final
+// status code of the response, when it started to be written and the
+// number of body bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	started time.Time
+	written int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.started.IsZero() {
+		r.started = time.Now()
+	}
+	// Informational responses precede the final one, except for 101
+	// Switching Protocols
+	if r.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, so that
+// http.ResponseController can flush and hijack through the recorder.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// observeRequest records the latency of each phase of a request proxied
+// to backend for svc.
+func observeRequest(svc *service, backend string, req *http.Request, rec *responseRecorder, body *timedBody, start time.Time, stats *httpTraceStats) {
+	labels := prometheus.Labels{
+		"service": svc.name,
+		"backend": backend,
+		"method":  methodClass(req.Method),
+		"status":  statusClass(rec.status),
+	}
+
+	if body != nil {
+		if d, ok := body.readDuration(start); ok {
+			clientRequestReadDuration.With(labels).Observe(d.Seconds())
+		}
+	}
+
+	observePhase(backendRequestDuration.With(labels), stats.LatencyRequest)
+	observePhase(backendProcessingDuration.With(labels), stats.LatencyBackend)
+	observePhase(backendResponseDuration.With(labels), stats.LatencyResponse)
+	observePhase(backendTotalDuration.With(labels), stats.LatencyTotal)
+
+	connLabels := prometheus.Labels{"service": svc.name, "backend": backend}
+	observePhase(backendGetConnDuration.With(connLabels), stats.LatencyGetConn)
+	observePhase(backendDNSDuration.With(connLabels), stats.LatencyDNS)
+	observePhase(backendConnectDuration.With(connLabels), stats.LatencyConnect)
+	observePhase(backendTLSDuration.With(connLabels), stats.LatencyTLS)
+	if stats.LatencyGetConn.Valid {
+		backendConnections.WithLabelValues(svc.name, backend, strconv.FormatBool(stats.Reused)).Inc()
+	}
+
+	if !rec.started.IsZero() {
+		clientResponseWriteDuration.With(labels).Observe(time.Since(rec.started).Seconds())
+	}
+}
+
+// observePhase observes the duration of phase in o, if the phase happened.
+func observePhase(o prometheus.Observer, phase tracePhase) {
+	if phase.Valid {
+		o.Observe(phase.Duration.Seconds())
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMethodClass(t *testing.T) {
+	var tests = []struct {
+		in   string
+		want string
+	}{
+		{"GET", "GET"},
+		{"DELETE", "DELETE"},
+		{"get", "OTHER"},
+		{"PROPFIND", "OTHER"},
+	}
+
+	for _, tt := range tests {
+		if got := methodClass(tt.in); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	var tests = []struct {
+		in   int
+		want string
+	}{
+		{101, "1xx"},
+		{200, "2xx"},
+		{404, "4xx"},
+		{502, "5xx"},
+		{0, "unknown"},
+		{600, "unknown"},
+	}
+
+	for _, tt := range tests {
+		if got := statusClass(tt.in); got != tt.want {
+			t.Errorf("%d: got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// sampleCount returns the number of observations in the histogram h with
+// the given labels.
+func sampleCount(t *testing.T, h *histogramVec, labels prometheus.Labels) uint64 {
+	var m dto.Metric
+	if err := h.HistogramVec.With(labels).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// TestRequestMetrics verifies that each phase of a proxied request is
+// observed with the service, backend, method and status labels.
+func TestRequestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "created")
+	}))
+	defer backend.Close()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Name = "metrics-service"
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	labels := prometheus.Labels{
+		"service": "metrics-service",
+		"backend": backendHostPort(t, backend).String(),
+		"method":  "POST",
+		"status":  "2xx",
+	}
+	before := make(map[*histogramVec]uint64)
+	for _, h := range latencyHistograms {
+		before[h] = sampleCount(t, h, labels)
+	}
+
+	resp, err := http.Post(ts.URL+"/?s=my-service.my-company.com", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	for i, h := range latencyHistograms {
+		if got := sampleCount(t, h, labels) - before[h]; got != 1 {
+			t.Errorf("histogram %d: got %d observations, want 1", i, got)
+		}
+	}
+}
+
+// TestOutcomes verifies that responses generated by the proxy are counted
+// by reason, separately from responses forwarded from backends.
+func TestOutcomes(t *testing.T) {
+	slow := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") != "" {
+			<-slow
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	defer close(slow) // Before the backend is closed
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedHostPort := backendHostPort(t, closed)
+	closed.Close()
+
+	var tests = []struct {
+		name   string
+		setup  func(*config.Service)
+		modify func(*Proxy)
+		query  string
+		ctx    time.Duration
+		code   int
+		reason string
+	}{
+		{"forwarded", nil, nil, "s=my-service.my-company.com", 0, http.StatusOK, ""},
+		{"unknown service", nil, nil, "s=unknown.my-company.com", 0, http.StatusNotFound, reasonUnknownService},
+		{"no backend", nil, func(p *Proxy) {
+			svc, _ := p.routes().service("outcome-service")
+			for _, b := range svc.pool.list() {
+				b.drained.Store(true)
+			}
+		}, "s=my-service.my-company.com", 0, http.StatusServiceUnavailable, reasonNoBackend},
+		{"forbidden", func(s *config.Service) {
+			s.ACL = &config.ACL{Deny: []string{"127.0.0.0/8", "::1"}}
+		}, nil, "s=my-service.my-company.com", 0, http.StatusForbidden, reasonForbidden},
+		{"connect error", func(s *config.Service) {
+			s.Hosts = []config.HostPort{closedHostPort}
+		}, nil, "s=my-service.my-company.com", 0, http.StatusBadGateway, reasonConnectError},
+		{"timeout", nil, func(p *Proxy) {
+			p.transport.ResponseHeaderTimeout = 50 * time.Millisecond
+		}, "s=my-service.my-company.com&slow=1", 0, http.StatusGatewayTimeout, reasonTimeout},
+		{"client cancel", nil, nil, "s=my-service.my-company.com&slow=1", 50 * time.Millisecond, 0, reasonClientCancel},
+	}
+
+	for _, tt := range tests {
+		testConfig := config.ProxyConfig{}
+		goldenConfig.Copy(&testConfig)
+		testConfig.Services[0].Name = "outcome-service"
+		testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+		if tt.setup != nil {
+			tt.setup(&testConfig.Services[0])
+		}
+		proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		if tt.modify != nil {
+			tt.modify(proxy)
+		}
+		ts := httptest.NewServer(proxy)
+
+		service := "outcome-service"
+		if tt.reason == reasonUnknownService {
+			service = ""
+		}
+		requests := testutil.ToFloat64(requestsTotal.WithLabelValues(service))
+		forwarded := testutil.ToFloat64(backendResponses.WithLabelValues(service, "200"))
+		var errors float64
+		if tt.reason != "" {
+			errors = testutil.ToFloat64(proxyErrors.WithLabelValues(service, tt.reason))
+		}
+
+		ctx := context.Background()
+		if tt.ctx != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tt.ctx)
+			defer cancel()
+		}
+		req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/?"+tt.query, nil)
+		code := 0
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			code = resp.StatusCode
+		}
+		if code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.code)
+		}
+
+		// The proxy may still be handling a cancelled request
+		ts.Close()
+		proxy.Close()
+
+		if got := testutil.ToFloat64(requestsTotal.WithLabelValues(service)) - requests; got != 1 {
+			t.Errorf("%s: got %v requests, want 1", tt.name, got)
+		}
+		wantForwarded := 0.0
+		if tt.reason == "" {
+			wantForwarded = 1
+		}
+		if got := testutil.ToFloat64(backendResponses.WithLabelValues(service, "200")) - forwarded; got != wantForwarded {
+			t.Errorf("%s: got %v forwarded responses, want %v", tt.name, got, wantForwarded)
+		}
+		if tt.reason != "" {
+			if got := testutil.ToFloat64(proxyErrors.WithLabelValues(service, tt.reason)) - errors; got != 1 {
+				t.Errorf("%s: got %v %s errors, want 1", tt.name, got, tt.reason)
+			}
+		}
+		if got := testutil.ToFloat64(inFlightRequests.WithLabelValues(service)); got != 0 {
+			t.Errorf("%s: got %v in flight requests, want 0", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The proxy's counters, gauges and histograms are Prometheus metrics,
+// served on the admin listener, wrapped so that each change is also
+// passed to the metricSinks configured to push them elsewhere, such as
+// StatsD or an OTLP collector. The wrappers have the same methods as the
+// Prometheus types they wrap, and are registered in the same way.
+
+// Kinds of metric.
+const (
+	counterMetric = iota
+	gaugeMetric
+	histogramMetric
+)
+
+// A metric describes a metric to sinks: its kind, name, help and label
+// names, and, for histograms, the upper bounds of its buckets.
+type metric struct {
+	kind    int
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+}
+
+// A metricSink receives every change to the proxy's metrics. values are
+// the values of the metric's labels, in the order of its label names.
+// Calls may be concurrent.
+type metricSink interface {
+	// add adds delta to a counter or gauge
+	add(m *metric, values []string, delta float64)
+	// set sets a gauge to value
+	set(m *metric, values []string, value float64)
+	// observe adds an observation to a histogram
+	observe(m *metric, values []string, value float64)
+	// Close sends anything buffered, and stops the sink
+	Close() error
+}
+
+var (
+	// sinks are the configured metricSinks. It is replaced, not changed,
+	// as changes are passed to sinks on every request
+	sinks   atomic.Pointer[[]metricSink]
+	sinksMu sync.Mutex
+)
+
+// addMetricSink passes every subsequent change to the proxy's metrics to
+// s.
+func addMetricSink(s metricSink) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	var next []metricSink
+	if current := sinks.Load(); current != nil {
+		next = append(next, *current...)
+	}
+	next = append(next, s)
+	sinks.Store(&next)
+}
+
+// forEachSink calls f with each configured sink.
+func forEachSink(f func(metricSink)) {
+	if current := sinks.Load(); current != nil {
+		for _, s := range *current {
+			f(s)
+		}
+	}
+}
+
+// labelValues returns the values of labels in the order of m's label
+// names.
+func (m *metric) labelValues(labels prometheus.Labels) []string {
+	values := make([]string, len(m.labels))
+	for i, name := range m.labels {
+		values[i] = labels[name]
+	}
+	return values
+}
+
+// A counterVec is a prometheus.CounterVec whose changes are passed to
+// the sinks.
+type counterVec struct {
+	*prometheus.CounterVec
+	m *metric
+}
+
+func newCounterVec(opts prometheus.CounterOpts, labels []string) *counterVec {
+	return &counterVec{
+		CounterVec: prometheus.NewCounterVec(opts, labels),
+		m:          &metric{kind: counterMetric, name: opts.Name, help: opts.Help, labels: labels},
+	}
+}
+
+func (v *counterVec) WithLabelValues(values ...string) counter {
+	return counter{Counter: v.CounterVec.WithLabelValues(values...), m: v.m, values: values}
+}
+
+// A counter is a prometheus.Counter whose changes are passed to the
+// sinks.
+type counter struct {
+	prometheus.Counter
+	m      *metric
+	values []string
+}
+
+func (c counter) Inc() {
+	c.Add(1)
+}
+
+func (c counter) Add(delta float64) {
+	c.Counter.Add(delta)
+	forEachSink(func(s metricSink) { s.add(c.m, c.values, delta) })
+}
+
+// A gaugeVec is a prometheus.GaugeVec whose changes are passed to the
+// sinks.
+type gaugeVec struct {
+	*prometheus.GaugeVec
+	m *metric
+}
+
+func newGaugeVec(opts prometheus.GaugeOpts, labels []string) *gaugeVec {
+	return &gaugeVec{
+		GaugeVec: prometheus.NewGaugeVec(opts, labels),
+		m:        &metric{kind: gaugeMetric, name: opts.Name, help: opts.Help, labels: labels},
+	}
+}
+
+func (v *gaugeVec) WithLabelValues(values ...string) gauge {
+	return gauge{Gauge: v.GaugeVec.WithLabelValues(values...), m: v.m, values: values}
+}
+
+// A gauge is a prometheus.Gauge whose changes are passed to the sinks.
+type gauge struct {
+	prometheus.Gauge
+	m      *metric
+	values []string
+}
+
+// newGauge returns a gauge without labels.
+func newGauge(opts prometheus.GaugeOpts) gauge {
+	return gauge{
+		Gauge: prometheus.NewGauge(opts),
+		m:     &metric{kind: gaugeMetric, name: opts.Name, help: opts.Help},
+	}
+}
+
+func (g gauge) Inc() {
+	g.Add(1)
+}
+
+func (g gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g gauge) Add(delta float64) {
+	g.Gauge.Add(delta)
+	forEachSink(func(s metricSink) { s.add(g.m, g.values, delta) })
+}
+
+func (g gauge) Set(value float64) {
+	g.Gauge.Set(value)
+	forEachSink(func(s metricSink) { s.set(g.m, g.values, value) })
+}
+
+// A histogramVec is a prometheus.HistogramVec whose observations are
+// passed to the sinks.
+type histogramVec struct {
+	*prometheus.HistogramVec
+	m *metric
+}
+
+func newHistogramVec(opts prometheus.HistogramOpts, labels []string) *histogramVec {
+	return &histogramVec{
+		HistogramVec: prometheus.NewHistogramVec(opts, labels),
+		m:            &metric{kind: histogramMetric, name: opts.Name, help: opts.Help, labels: labels, buckets: opts.Buckets},
+	}
+}
+
+func (v *histogramVec) WithLabelValues(values ...string) histogram {
+	return histogram{Observer: v.HistogramVec.WithLabelValues(values...), m: v.m, values: values}
+}
+
+func (v *histogramVec) With(labels prometheus.Labels) histogram {
+	return histogram{Observer: v.HistogramVec.With(labels), m: v.m, values: v.m.labelValues(labels)}
+}
+
+// A histogram is a prometheus.Observer whose observations are passed to
+// the sinks.
+type histogram struct {
+	prometheus.Observer
+	m      *metric
+	values []string
+}
+
+func (h histogram) Observe(value float64) {
+	h.Observer.Observe(value)
+	forEachSink(func(s metricSink) { s.observe(h.m, h.values, value) })
+}
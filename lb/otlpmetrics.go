@@ -0,0 +1,145 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+)
+
+// An otlpSink is a metricSink that records metrics with OpenTelemetry
+// instruments of the same names, which are exported with OTLP. Counters
+// are counters, gauges that are set are gauges and those that are
+// incremented are up-down counters, and histograms are histograms with
+// the same buckets. Histograms in seconds have the unit "s".
+type otlpSink struct {
+	provider *sdkmetric.MeterProvider
+	meter    otelmetric.Meter
+
+	mu sync.Mutex
+	// instruments holds the instrument for each metric, created when it
+	// first changes
+	instruments map[instrumentKey]interface{}
+}
+
+// An instrumentKey identifies the instrument for a metric. A gauge has a
+// gauge if it is set and an up-down counter if it is added to.
+type instrumentKey struct {
+	m   *metric
+	set bool
+}
+
+// newOTLPSink returns an otlpSink that exports to the collector configured
+// by cfg.
+func newOTLPSink(ctx context.Context, cfg *config.OTLPMetrics) (*otlpSink, error) {
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	exporter, err := otlpmetricgrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating OTLP metrics exporter for %s failed", cfg.Endpoint)
+	}
+
+	interval := cfg.Interval
+	if interval == 0 {
+		interval = config.DefaultOTLPMetricsInterval
+	}
+	return newOTLPSinkFromReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(interval))), nil
+}
+
+// newOTLPSinkFromReader returns an otlpSink whose metrics are read by
+// reader.
+func newOTLPSinkFromReader(reader sdkmetric.Reader) *otlpSink {
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(resource.NewSchemaless(semconv.ServiceName(tracingServiceName))),
+	)
+	return &otlpSink{
+		provider:    provider,
+		meter:       provider.Meter(tracerName),
+		instruments: make(map[instrumentKey]interface{}),
+	}
+}
+
+// instrument returns the instrument for m, for setting it if set is
+// true, creating it with create if it doesn't exist yet.
+func (s *otlpSink) instrument(m *metric, set bool, create func(name string, unit otelmetric.InstrumentOption) (interface{}, error)) interface{} {
+	key := instrumentKey{m, set}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i, ok := s.instruments[key]; ok {
+		return i
+	}
+
+	unit := otelmetric.WithUnit("1")
+	if strings.HasSuffix(m.name, "_seconds") {
+		unit = otelmetric.WithUnit("s")
+	}
+	i, err := create(m.name, unit)
+	if err != nil {
+		// Only invalid names or options fail, and the instrument
+		// returned still works
+		otel.Handle(err)
+	}
+	s.instruments[key] = i
+	return i
+}
+
+// attributes returns the attributes for m's label values.
+func attributes(m *metric, values []string) otelmetric.MeasurementOption {
+	attrs := make([]attribute.KeyValue, 0, len(values))
+	for i, v := range values {
+		if i < len(m.labels) {
+			attrs = append(attrs, attribute.String(m.labels[i], v))
+		}
+	}
+	return otelmetric.WithAttributes(attrs...)
+}
+
+func (s *otlpSink) add(m *metric, values []string, delta float64) {
+	if m.kind == counterMetric {
+		c := s.instrument(m, false, func(name string, unit otelmetric.InstrumentOption) (interface{}, error) {
+			return s.meter.Float64Counter(name, otelmetric.WithDescription(m.help), unit)
+		}).(otelmetric.Float64Counter)
+		c.Add(context.Background(), delta, attributes(m, values))
+		return
+	}
+	c := s.instrument(m, false, func(name string, unit otelmetric.InstrumentOption) (interface{}, error) {
+		return s.meter.Float64UpDownCounter(name, otelmetric.WithDescription(m.help), unit)
+	}).(otelmetric.Float64UpDownCounter)
+	c.Add(context.Background(), delta, attributes(m, values))
+}
+
+func (s *otlpSink) set(m *metric, values []string, value float64) {
+	g := s.instrument(m, true, func(name string, unit otelmetric.InstrumentOption) (interface{}, error) {
+		return s.meter.Float64Gauge(name, otelmetric.WithDescription(m.help), unit)
+	}).(otelmetric.Float64Gauge)
+	g.Record(context.Background(), value, attributes(m, values))
+}
+
+func (s *otlpSink) observe(m *metric, values []string, value float64) {
+	h := s.instrument(m, false, func(name string, unit otelmetric.InstrumentOption) (interface{}, error) {
+		return s.meter.Float64Histogram(name, otelmetric.WithDescription(m.help), unit,
+			otelmetric.WithExplicitBucketBoundaries(m.buckets...))
+	}).(otelmetric.Float64Histogram)
+	h.Record(context.Background(), value, attributes(m, values))
+}
+
+// Close exports the metrics recorded since the last export, and stops
+// exporting.
+func (s *otlpSink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.provider.Shutdown(ctx)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestOTLPSink(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	s := newOTLPSinkFromReader(reader)
+	defer s.Close()
+
+	requests := &metric{kind: counterMetric, name: "proxy_requests_total", labels: []string{"service"}}
+	inFlight := &metric{kind: gaugeMetric, name: "proxy_in_flight_requests"}
+	generation := &metric{kind: gaugeMetric, name: "proxy_config_generation"}
+	latency := &metric{kind: histogramMetric, name: "proxy_backend_total_seconds", labels: []string{"service"}, buckets: []float64{0.1, 1}}
+
+	s.add(requests, []string{"www"}, 1)
+	s.add(requests, []string{"www"}, 2)
+	s.add(inFlight, nil, 1)
+	s.add(inFlight, nil, 1)
+	s.add(inFlight, nil, -1)
+	s.set(generation, nil, 7)
+	s.observe(latency, []string{"www"}, 0.25)
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]metricdata.Metrics)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			got[m.Name] = m
+		}
+	}
+
+	if sum, ok := got["proxy_requests_total"].Data.(metricdata.Sum[float64]); !ok || !sum.IsMonotonic || len(sum.DataPoints) != 1 {
+		t.Errorf("proxy_requests_total: got %+v, want a counter with one data point", got["proxy_requests_total"].Data)
+	} else {
+		dp := sum.DataPoints[0]
+		if service, _ := dp.Attributes.Value("service"); dp.Value != 3 || service.AsString() != "www" {
+			t.Errorf("proxy_requests_total: got %v for service %q, want 3 for www", dp.Value, service.AsString())
+		}
+	}
+
+	if sum, ok := got["proxy_in_flight_requests"].Data.(metricdata.Sum[float64]); !ok || sum.IsMonotonic || len(sum.DataPoints) != 1 {
+		t.Errorf("proxy_in_flight_requests: got %+v, want an up-down counter with one data point", got["proxy_in_flight_requests"].Data)
+	} else if v := sum.DataPoints[0].Value; v != 1 {
+		t.Errorf("proxy_in_flight_requests: got %v, want %v", v, 1)
+	}
+
+	if g, ok := got["proxy_config_generation"].Data.(metricdata.Gauge[float64]); !ok || len(g.DataPoints) != 1 {
+		t.Errorf("proxy_config_generation: got %+v, want a gauge with one data point", got["proxy_config_generation"].Data)
+	} else if v := g.DataPoints[0].Value; v != 7 {
+		t.Errorf("proxy_config_generation: got %v, want %v", v, 7)
+	}
+
+	if unit := got["proxy_backend_total_seconds"].Unit; unit != "s" {
+		t.Errorf("proxy_backend_total_seconds: got unit %q, want %q", unit, "s")
+	}
+	if h, ok := got["proxy_backend_total_seconds"].Data.(metricdata.Histogram[float64]); !ok || len(h.DataPoints) != 1 {
+		t.Errorf("proxy_backend_total_seconds: got %+v, want a histogram with one data point", got["proxy_backend_total_seconds"].Data)
+	} else {
+		dp := h.DataPoints[0]
+		if len(dp.Bounds) != 2 || dp.Bounds[0] != 0.1 || dp.Bounds[1] != 1 {
+			t.Errorf("proxy_backend_total_seconds: got bounds %v, want %v", dp.Bounds, latency.buckets)
+		}
+		if dp.Count != 1 || len(dp.BucketCounts) != 3 || dp.BucketCounts[1] != 1 {
+			t.Errorf("proxy_backend_total_seconds: got count %v in buckets %v, want 1 in the second", dp.Count, dp.BucketCounts)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"afe/config"
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var configReloads = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_config_reloads_total",
+		Help: "Configuration reloads by result, \"ok\" or \"error\".",
+	},
+	[]string{"result"},
+)
+
+var configGeneration = newGauge(
+	prometheus.GaugeOpts{
+		Name: "proxy_config_generation",
+		Help: "Generation of the configuration in use, starting at 1 and incremented by each successful reload.",
+	},
+)
+
+// Reload validates cfg and, if it is valid, atomically replaces the
+// proxy's routing table with one built from it. Requests already in
+// flight complete using the previous table. If cfg is not valid the
+// proxy continues with its current configuration.
+//
+// The parts of the configuration only read when the proxy starts can not
+// be changed by a reload, a change is logged and ignored, and cfg is
+// validated with the values in use. Backend state changed through the
+// admin API is carried over to services with the same name.
+func (proxy *Proxy) Reload(cfg *config.ProxyConfig) []error {
+	proxy.reloadMu.Lock()
+	defer proxy.reloadMu.Unlock()
+
+	old := proxy.routes()
+	next := config.ProxyConfig{}
+	cfg.Copy(&next)
+	keepStartupConfig(&next, &old.config)
+
+	errs := config.ValidateConfig(&next)
+	if errs != nil {
+		configReloads.WithLabelValues("error").Inc()
+		return errs
+	}
+
+	table, err := newRoutingTable(&next, proxy.transport, old)
+	if err != nil {
+		configReloads.WithLabelValues("error").Inc()
+		return []error{err}
+	}
+
+	proxy.table.Store(table)
+	old.closeExcept(table)
+
+	configReloads.WithLabelValues("ok").Inc()
+	configGeneration.Set(float64(table.generation))
+	slog.Info("configuration reloaded", "generation", table.generation)
+	return nil
+}
+
+// keepStartupConfig replaces the parts of cfg that are only read when the
+// proxy starts with those of current, the configuration in use, logging
+// any that were changed.
+func keepStartupConfig(cfg, current *config.ProxyConfig) {
+	if cfg.Listen != current.Listen {
+		slog.Warn("reload ignored listen address change, restart to apply it",
+			"from", current.Listen.String(), "to", cfg.Listen.String())
+		cfg.Listen = current.Listen
+	}
+
+	if cfg.Admin.Listen != current.Admin.Listen {
+		slog.Warn("reload ignored admin listen address change, restart to apply it",
+			"from", current.Admin.Listen.String(), "to", cfg.Admin.Listen.String())
+		cfg.Admin.Listen = current.Admin.Listen
+	}
+
+	if cfg.Admin.GRPCListen != current.Admin.GRPCListen {
+		slog.Warn("reload ignored gRPC listen address change, restart to apply it",
+			"from", current.Admin.GRPCListen.String(), "to", cfg.Admin.GRPCListen.String())
+		cfg.Admin.GRPCListen = current.Admin.GRPCListen
+	}
+
+	keep := func(section string, changed bool, restore func()) {
+		if changed {
+			slog.Warn("reload ignored " + section + " change, restart to apply it")
+			restore()
+		}
+	}
+	keep("tracing", cfg.Tracing != current.Tracing, func() { cfg.Tracing = current.Tracing })
+	keep("metrics", !reflect.DeepEqual(cfg.Metrics, current.Metrics), func() { cfg.Metrics = current.Metrics })
+	keep("access log", !reflect.DeepEqual(cfg.AccessLog, current.AccessLog), func() { cfg.AccessLog = current.AccessLog })
+	keep("logging", cfg.Logging != current.Logging, func() { cfg.Logging = current.Logging })
+	keep("client statistics", !reflect.DeepEqual(cfg.ClientStats, current.ClientStats), func() { cfg.ClientStats = current.ClientStats })
+	keep("geo", !reflect.DeepEqual(cfg.Geo, current.Geo), func() { cfg.Geo = current.Geo })
+	keep("capture", !reflect.DeepEqual(cfg.Capture, current.Capture), func() { cfg.Capture = current.Capture })
+}
+
+// ReloadFromFile reloads the proxy's configuration from the given file.
+// Errors are logged, as well as returned.
+func (proxy *Proxy) ReloadFromFile(filename string) []error {
+	cfg := config.ProxyConfig{}
+
+	var errs []error
+	if err := config.ParseConfigFromFile(filename, &cfg); err != nil {
+		configReloads.WithLabelValues("error").Inc()
+		errs = []error{err}
+	} else {
+		errs = proxy.Reload(&cfg)
+	}
+
+	for _, err := range errs {
+		slog.Error("reloading configuration failed", "file", filename, "err", err)
+	}
+	return errs
+}
+
+// reloadOnSignal reloads the proxy's configuration from filename each
+// time the process receives SIGHUP.
+func reloadOnSignal(proxy *Proxy, filename string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		for range c {
+			slog.Info("reload signal received", "signal", "SIGHUP")
+			proxy.ReloadFromFile(filename)
+		}
+	}()
+}
+
+// reloadOnChange reloads the proxy's configuration from filename each
+// time the file's content changes.
+func reloadOnChange(proxy *Proxy, filename string) error {
+	last, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrapf(err, "read from %s failed", filename)
+	}
+
+	// Watch the directory, not the file, to survive the file being
+	// replaced by a rename.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrapf(err, "watching %s failed", filename)
+	}
+	if err := watcher.Add(filepath.Dir(filename)); err != nil {
+		watcher.Close()
+		return errors.Wrapf(err, "watching %s failed", filename)
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("watching configuration failed", "file", filename, "err", err)
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				content, err := ioutil.ReadFile(filename)
+				if err != nil || bytes.Equal(content, last) {
+					continue
+				}
+				last = content
+				slog.Info("configuration changed", "file", filename)
+				proxy.ReloadFromFile(filename)
+			}
+		}
+	}()
+
+	return nil
+}
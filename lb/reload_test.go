@@ -0,0 +1,291 @@
+package main
+
+import (
+	"afe/config"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// backendHostPort returns the HostPort that the test server ts listens on.
+func backendHostPort(t *testing.T, ts *httptest.Server) config.HostPort {
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("could not parse '%s' as a URL: %+v", ts.URL, err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatalf("could not parse '%s' as an int: %+v", u.Port(), err)
+	}
+	return config.HostPort{Address: u.Hostname(), Port: port}
+}
+
+// namedBackend starts a test server that responds with name.
+func namedBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+}
+
+// get requests my-service through the proxy at ts and returns the body.
+func get(t *testing.T, ts *httptest.Server) string {
+	resp, err := http.Get(fmt.Sprintf("%s/?s=my-service.my-company.com", ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response body: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	return string(result)
+}
+
+// TestReload verifies that a reload switches new requests to the new
+// configuration, that requests in flight complete, and that an invalid
+// configuration is rejected.
+func TestReload(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		fmt.Fprint(w, "old")
+	}))
+	defer slow.Close()
+	fresh := namedBackend("new")
+	defer fresh.Close()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, slow)}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	// Start a request on the old configuration, and leave it in flight.
+	inFlight := make(chan string)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("%s/?s=my-service.my-company.com", ts.URL))
+		if err != nil {
+			inFlight <- err.Error()
+			return
+		}
+		result, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		inFlight <- string(result)
+	}()
+	<-started
+
+	okReloads := testutil.ToFloat64(configReloads.WithLabelValues("ok"))
+	errReloads := testutil.ToFloat64(configReloads.WithLabelValues("error"))
+
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, fresh)}
+	if errs := proxy.Reload(&testConfig); errs != nil {
+		t.Fatal(errs)
+	}
+
+	if got := get(t, ts); got != "new" {
+		t.Errorf("got '%s' after reload, want 'new'", got)
+	}
+
+	close(release)
+	if got := <-inFlight; got != "old" {
+		t.Errorf("got '%s' from in-flight request, want 'old'", got)
+	}
+
+	if got := proxy.routes().generation; got != 2 {
+		t.Errorf("got generation %d, want 2", got)
+	}
+	if got := testutil.ToFloat64(configGeneration); got != 2 {
+		t.Errorf("got generation metric %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(configReloads.WithLabelValues("ok")) - okReloads; got != 1 {
+		t.Errorf("got %v successful reloads, want 1", got)
+	}
+
+	// An invalid configuration is rejected, and the proxy carries on.
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = nil
+	if errs := proxy.Reload(&testConfig); errs == nil {
+		t.Fatal("invalid config reloaded without error")
+	}
+	if got := get(t, ts); got != "new" {
+		t.Errorf("got '%s' after failed reload, want 'new'", got)
+	}
+	if got := proxy.routes().generation; got != 2 {
+		t.Errorf("got generation %d after failed reload, want 2", got)
+	}
+	if got := testutil.ToFloat64(configReloads.WithLabelValues("error")) - errReloads; got != 1 {
+		t.Errorf("got %v failed reloads, want 1", got)
+	}
+}
+
+// TestReloadStartupConfig verifies that a reload keeps the parts of the
+// configuration only read when the proxy starts, and validates the new
+// configuration with them.
+func TestReloadStartupConfig(t *testing.T) {
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	testConfig.Listen.Port = 8082
+	testConfig.Tracing = config.Tracing{Endpoint: "localhost:4318"}
+	testConfig.AccessLog = &config.AccessLog{Output: "stdout"}
+	if errs := proxy.Reload(&testConfig); errs != nil {
+		t.Fatal(errs)
+	}
+	got := proxy.routes().config
+	if got.Listen != goldenConfig.Listen {
+		t.Errorf("got listen address %v, want %v", got.Listen, goldenConfig.Listen)
+	}
+	if got.Tracing != goldenConfig.Tracing {
+		t.Errorf("got tracing %+v, want %+v", got.Tracing, goldenConfig.Tracing)
+	}
+	if got.AccessLog != nil {
+		t.Errorf("got access log %+v, want none", got.AccessLog)
+	}
+
+	// Region services need the geo database the proxy started without
+	goldenConfig.Copy(&testConfig)
+	testConfig.Geo = &config.Geo{Database: "unused.mmdb", Regions: []string{"BR"}}
+	testConfig.Services[0].RegionServices = map[string]string{"BR": "my-service"}
+	if errs := proxy.Reload(&testConfig); errs == nil {
+		t.Error("region services reloaded without a geo database")
+	}
+}
+
+// TestReloadKeepsDiscovery verifies that a reload keeps a service's
+// discovery running if its configuration is unchanged, and replaces it
+// if not.
+func TestReloadKeepsDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first := filepath.Join(dir, "first.yaml")
+	second := filepath.Join(dir, "second.yaml")
+	writeFile(t, first, `{"hosts": [{"address": "127.0.0.1", "port": 9090}]}`)
+	writeFile(t, second, `{"hosts": [{"address": "127.0.0.2", "port": 9090}]}`)
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Resolvers = []string{"127.0.0.1:53"}
+	testConfig.Services[0].Hosts = nil
+	testConfig.Services[0].Discovery = &config.Discovery{Type: config.DiscoveryFile, Path: first}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+	svc := func() *service { return proxy.routes().services["my-service.my-company.com"] }
+	before := svc()
+	checkBackends(t, before.pool, "127.0.0.1:9090")
+
+	testConfig.Services[0].SlowThreshold = time.Second
+	if errs := proxy.Reload(&testConfig); errs != nil {
+		t.Fatal(errs)
+	}
+	if got := svc(); got.discovery != before.discovery || got.pool != before.pool {
+		t.Fatal("discovery replaced by a reload that didn't change it")
+	}
+	// It is still running
+	updates := testutil.ToFloat64(discoveryUpdates.WithLabelValues("my-service", "ok"))
+	writeFile(t, first, `{"hosts": [{"address": "127.0.0.3", "port": 9090}]}`)
+	waitForCount(t, "my-service", "ok", updates+1)
+	checkBackends(t, svc().pool, "127.0.0.3:9090")
+
+	testConfig.Services[0].Discovery.Path = second
+	if errs := proxy.Reload(&testConfig); errs != nil {
+		t.Fatal(errs)
+	}
+	if svc().discovery == before.discovery {
+		t.Fatal("discovery kept by a reload that changed it")
+	}
+	checkBackends(t, svc().pool, "127.0.0.2:9090")
+	// The previous discovery has stopped
+	writeFile(t, first, `{"hosts": [{"address": "127.0.0.4", "port": 9090}]}`)
+	time.Sleep(100 * time.Millisecond)
+	checkBackends(t, before.pool, "127.0.0.3:9090")
+}
+
+// TestReloadOnChange verifies that changes to the configuration file
+// are reloaded when it is watched.
+func TestReloadOnChange(t *testing.T) {
+	first := namedBackend("first")
+	defer first.Close()
+	second := namedBackend("second")
+	defer second.Close()
+
+	dir, err := ioutil.TempDir("", "lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configYAML := func(hp config.HostPort) string {
+		return fmt.Sprintf(`proxy:
+  listen:
+    address: "127.0.0.1"
+    port: 8080
+  services:
+    - name: my-service
+      domain: my-service.my-company.com
+      hosts:
+        - address: "%s"
+          port: %d
+`, hp.Address, hp.Port)
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, configYAML(backendHostPort(t, first)))
+
+	proxy, errs := NewProxyFromFile(path, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	if err := reloadOnChange(proxy, path); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	if got := get(t, ts); got != "first" {
+		t.Fatalf("got '%s', want 'first'", got)
+	}
+
+	writeFile(t, path, configYAML(backendHostPort(t, second)))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && proxy.routes().generation == 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := get(t, ts); got != "second" {
+		t.Fatalf("got '%s' after changing the config file, want 'second'", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// maxRequestIDLength is the longest request ID accepted from a client.
+const maxRequestIDLength = 128
+
+// crockford is the Crockford base32 alphabet ULIDs are encoded in.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// requestID returns the ID of req, from the configured header if it has
+// a valid one, otherwise a new ID in the configured format.
+func requestID(req *http.Request, cfg config.RequestID) string {
+	if id := req.Header.Get(cfg.HeaderName()); validRequestID(id) {
+		return id
+	}
+	return newRequestID(cfg.Format, time.Now())
+}
+
+// validRequestID returns true if id can be used as a request ID. It must
+// be printable ASCII without spaces, so that it can't break up log lines,
+// and not too long.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a new request ID in format for a request received
+// at now.
+func newRequestID(format string, now time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(now.UnixMilli())<<16)
+	rand.Read(b[6:])
+
+	if format == config.RequestIDULID {
+		return encodeULID(b)
+	}
+	return encodeUUIDv7(b)
+}
+
+// encodeUUIDv7 returns b, a 48 bit Unix millisecond timestamp followed by
+// random bits, as a version 7 UUID.
+func encodeUUIDv7(b [16]byte) string {
+	b[6] = b[6]&0x0f | 0x70 // Version 7
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 variant
+
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:36], b[10:16])
+	return string(s[:])
+}
+
+// encodeULID returns b, a 48 bit Unix millisecond timestamp followed by
+// random bits, as a ULID.
+func encodeULID(b [16]byte) string {
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+
+	// 26 characters of 5 bits each, the first only has 3 of the 128
+	var s [26]byte
+	for i := len(s) - 1; i >= 0; i-- {
+		s[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
+
+type requestIDKey struct{}
+
+// withRequestID returns a copy of ctx carrying the request's ID.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the request ID stored by withRequestID.
+func requestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
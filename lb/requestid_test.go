@@ -0,0 +1,138 @@
+package main
+
+import (
+	"afe/config"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRequestID(t *testing.T) {
+	now := time.UnixMilli(0x0123456789ab)
+
+	var tests = []struct {
+		format string
+		want   *regexp.Regexp
+		prefix string
+	}{
+		{"", regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), "01234567-89ab-7"},
+		{config.RequestIDUUIDv7, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), "01234567-89ab-7"},
+		{config.RequestIDULID, regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`), "014D2PF2DB"},
+	}
+
+	for _, tt := range tests {
+		a, b := newRequestID(tt.format, now), newRequestID(tt.format, now)
+		if !tt.want.MatchString(a) {
+			t.Errorf("%s: got %s, want match for %s", tt.format, a, tt.want)
+		}
+		if !strings.HasPrefix(a, tt.prefix) {
+			t.Errorf("%s: got %s, want prefix %s", tt.format, a, tt.prefix)
+		}
+		if a == b {
+			t.Errorf("%s: got %s twice", tt.format, a)
+		}
+	}
+
+	// IDs sort in the order they were generated
+	for _, format := range []string{config.RequestIDUUIDv7, config.RequestIDULID} {
+		earlier, later := newRequestID(format, now), newRequestID(format, now.Add(time.Millisecond))
+		if earlier >= later {
+			t.Errorf("%s: got %s >= %s", format, earlier, later)
+		}
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	var tests = []struct {
+		in   string
+		want bool
+	}{
+		{"0190a5c2-7a3e-7b1c-9d2e-3f4a5b6c7d8e", true},
+		{"abc", true},
+		{"", false},
+		{"has space", false},
+		{"line\nbreak", false},
+		{strings.Repeat("a", maxRequestIDLength), true},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tt := range tests {
+		if got := validRequestID(tt.in); got != tt.want {
+			t.Errorf("%q: got %t, want %t", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestRequestIDPropagation verifies that a request's ID is passed to the
+// backend and returned to the client, once.
+func TestRequestIDPropagation(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Correlation-Id")
+		// Echoed, as some backends do
+		w.Header().Set("X-Correlation-Id", got)
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.RequestID = config.RequestID{Header: "X-Correlation-Id", Format: config.RequestIDULID}
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	var tests = []struct {
+		query string
+		in    string
+		// generated is true if the ID should be generated, not in
+		generated bool
+	}{
+		{"s=my-service.my-company.com", "", true},
+		{"s=my-service.my-company.com", "client-id-1", false},
+		{"s=my-service.my-company.com", "bad id", true},
+		{"s=unknown.my-company.com", "client-id-2", false},
+	}
+
+	for _, tt := range tests {
+		got = ""
+		req, _ := http.NewRequest("GET", ts.URL+"/?"+tt.query, nil)
+		if tt.in != "" {
+			req.Header.Set("X-Correlation-Id", tt.in)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		returned := resp.Header.Values("X-Correlation-Id")
+		if len(returned) != 1 {
+			t.Errorf("%s %q: got %d IDs returned, want 1", tt.query, tt.in, len(returned))
+			continue
+		}
+		id := returned[0]
+		if tt.generated {
+			if id == tt.in || len(id) != 26 {
+				t.Errorf("%s %q: got %s, want a new ULID", tt.query, tt.in, id)
+			}
+		} else if id != tt.in {
+			t.Errorf("%s %q: got %s, want %s", tt.query, tt.in, id, tt.in)
+		}
+		if resp.StatusCode == http.StatusOK && got != id {
+			t.Errorf("%s %q: backend got %s, want %s", tt.query, tt.in, got, id)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// minResolveInterval is the shortest time between two resolutions of
+	// the same name, regardless of how short the record's TTL is. It is
+	// also the retry interval after a failed resolution.
+	minResolveInterval = 5 * time.Second
+
+	// maxResolveInterval is the longest time between two resolutions of
+	// the same name, regardless of how long the record's TTL is.
+	maxResolveInterval = 5 * time.Minute
+)
+
+// A resolver looks up DNS records, returning the TTL of the answer along
+// with the results. The Go standard library's resolver does not expose
+// TTLs, hence this.
+type resolver struct {
+	client  *dns.Client
+	servers []string
+}
+
+// newResolver returns a resolver that queries the given "host:port"
+// servers. If none are given the servers in /etc/resolv.conf are used.
+func newResolver(servers []string) (*resolver, error) {
+	if len(servers) == 0 {
+		cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, errors.Wrap(err, "reading /etc/resolv.conf failed")
+		}
+		for _, s := range cc.Servers {
+			servers = append(servers, net.JoinHostPort(s, cc.Port))
+		}
+	}
+
+	return &resolver{
+		client:  &dns.Client{Timeout: 5 * time.Second},
+		servers: servers,
+	}, nil
+}
+
+// exchange sends a query for name and qtype to each server in turn until
+// one answers, and returns the answer records.
+func (r *resolver) exchange(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+
+	var err error
+	for _, server := range r.servers {
+		var in *dns.Msg
+		in, _, err = r.client.ExchangeContext(ctx, m, server)
+		if err != nil {
+			continue
+		}
+		if in.Rcode != dns.RcodeSuccess {
+			err = errors.Errorf("%s lookup of %s failed: %s", dns.TypeToString[qtype], name, dns.RcodeToString[in.Rcode])
+			continue
+		}
+		return in.Answer, nil
+	}
+
+	if err == nil {
+		err = errors.New("no DNS servers configured")
+	}
+	return nil, err
+}
+
+// lookupIP returns the A and AAAA records for name, and the smallest TTL
+// of those records. It only fails if no addresses were found.
+func (r *resolver) lookupIP(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var lastErr error
+	ttl := maxResolveInterval
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answer, err := r.exchange(ctx, name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			default:
+				continue // E.g., a CNAME on the way to the address
+			}
+			if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, 0, lastErr
+		}
+		return nil, 0, errors.Errorf("no addresses found for %s", name)
+	}
+	return ips, ttl, nil
+}
+
+// lookupSRV returns the SRV records for name with the lowest priority,
+// which are the ones clients are expected to use.
+func (r *resolver) lookupSRV(ctx context.Context, name string) ([]*dns.SRV, error) {
+	answer, err := r.exchange(ctx, name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+
+	var srvs []*dns.SRV
+	for _, rr := range answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		switch {
+		case len(srvs) == 0 || srv.Priority == srvs[0].Priority:
+			srvs = append(srvs, srv)
+		case srv.Priority < srvs[0].Priority:
+			srvs = []*dns.SRV{srv}
+		}
+	}
+
+	if len(srvs) == 0 {
+		return nil, errors.Errorf("no SRV records found for %s", name)
+	}
+	return srvs, nil
+}
+
+// ipBackends returns a TCP backend for each of ips, on port, with the
+// given weight.
+func ipBackends(ips []net.IP, port, weight int) []backend {
+	backends := make([]backend, 0, len(ips))
+	for _, ip := range ips {
+		backends = append(backends, backend{
+			network: "tcp",
+			address: net.JoinHostPort(ip.String(), strconv.Itoa(port)),
+			weight:  weight,
+		})
+	}
+	return backends
+}
+
+// clampTTL bounds a record TTL to the range the proxy is prepared to
+// re-resolve at.
+func clampTTL(ttl time.Duration) time.Duration {
+	if ttl < minResolveInterval {
+		return minResolveInterval
+	}
+	if ttl > maxResolveInterval {
+		return maxResolveInterval
+	}
+	return ttl
+}
+
+// A hostResolver keeps a pool in sync with a service's configured hosts.
+// IP addresses and Unix sockets are added to the pool as-is. DNS names
+// are resolved, each resolved address becomes a separate backend, and
+// the name is re-resolved when the TTL of its records expires. If a
+// re-resolution fails the last known addresses are kept.
+type hostResolver struct {
+	service  string
+	pool     *pool
+	resolver *resolver
+
+	mu sync.Mutex
+	// backends holds the current backends for each configured host,
+	// indexed by the host's position in the configuration.
+	backends [][]backend
+}
+
+// resolveHosts populates p from hosts, and starts re-resolving any DNS
+// names among them until ctx is done. The first resolution of each name
+// completes before resolveHosts returns.
+func resolveHosts(ctx context.Context, service string, hosts []config.HostPort, p *pool, r *resolver) {
+	hr := &hostResolver{
+		service:  service,
+		pool:     p,
+		resolver: r,
+		backends: make([][]backend, len(hosts)),
+	}
+
+	for i, host := range hosts {
+		if !host.IsHostname() {
+			hr.backends[i] = []backend{newBackend(host)}
+			continue
+		}
+
+		next := hr.resolve(ctx, i, host)
+		go hr.run(ctx, i, host, next)
+	}
+	hr.update(ctx)
+}
+
+// run re-resolves host each time its TTL expires, until ctx is done.
+func (hr *hostResolver) run(ctx context.Context, i int, host config.HostPort, next time.Duration) {
+	timer := time.NewTimer(next)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		timer.Reset(hr.refresh(ctx, i, host))
+	}
+}
+
+// refresh resolves the i'th host and updates the pool, unless ctx is done
+// by then, and returns how long to wait before resolving it again.
+func (hr *hostResolver) refresh(ctx context.Context, i int, host config.HostPort) time.Duration {
+	next := hr.resolve(ctx, i, host)
+	hr.update(ctx)
+	return next
+}
+
+// resolve looks up the addresses for the i'th host, records them, and
+// returns how long to wait before resolving it again.
+func (hr *hostResolver) resolve(ctx context.Context, i int, host config.HostPort) time.Duration {
+	ips, ttl, err := hr.resolver.lookupIP(ctx, host.Address)
+	if err != nil {
+		slog.Warn("resolving host failed, keeping last known addresses", "service", hr.service, "host", host.Address, "err", err)
+		return minResolveInterval
+	}
+
+	hr.mu.Lock()
+	hr.backends[i] = ipBackends(ips, host.Port, host.Weight)
+	hr.mu.Unlock()
+
+	return clampTTL(ttl)
+}
+
+// update replaces the pool's backends with the union of every host's
+// current backends, unless ctx is done. A resolver whose hosts have been
+// replaced, e.g., by a change to a hosts file, has its context cancelled
+// first, so a resolution it finishes afterwards doesn't revert the pool.
+func (hr *hostResolver) update(ctx context.Context) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	var backends []backend
+	for _, b := range hr.backends {
+		backends = append(backends, b...)
+	}
+	hr.pool.setUnlessDone(ctx, backends)
+}
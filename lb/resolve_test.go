@@ -0,0 +1,213 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A testDNSServer is an in-process DNS server that answers queries from
+// a set of records that tests can change.
+type testDNSServer struct {
+	addr   string
+	server *dns.Server
+
+	mu   sync.Mutex
+	rrs  []dns.RR
+	fail bool
+	// held, if set, receives each query, which isn't answered until
+	// release is closed
+	held, release chan struct{}
+}
+
+// startDNSServer starts a testDNSServer on a random UDP port that
+// answers queries from records, which are in zone file format (e.g.,
+// "backend.test. 30 IN A 127.0.0.1").
+func startDNSServer(t *testing.T, records ...string) *testDNSServer {
+	s := &testDNSServer{}
+	s.setRecords(t, records...)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = pc.LocalAddr().String()
+
+	started := make(chan struct{})
+	s.server = &dns.Server{
+		PacketConn:        pc,
+		Handler:           dns.HandlerFunc(s.serveDNS),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go s.server.ActivateAndServe()
+	<-started
+
+	return s
+}
+
+// setRecords replaces the records the server answers from.
+func (s *testDNSServer) setRecords(t *testing.T, records ...string) {
+	var rrs []dns.RR
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			t.Fatalf("could not parse record %q: %+v", r, err)
+		}
+		rrs = append(rrs, rr)
+	}
+
+	s.mu.Lock()
+	s.rrs = rrs
+	s.mu.Unlock()
+}
+
+// setFail makes the server answer every query with SERVFAIL.
+func (s *testDNSServer) setFail(fail bool) {
+	s.mu.Lock()
+	s.fail = fail
+	s.mu.Unlock()
+}
+
+// hold makes the server wait to answer queries until the returned function
+// is called, and returns a channel that receives a value for each query
+// held.
+func (s *testDNSServer) hold() (<-chan struct{}, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held, s.release = make(chan struct{}, 10), make(chan struct{})
+	release := s.release
+	return s.held, func() { close(release) }
+}
+
+func (s *testDNSServer) stop() {
+	s.server.Shutdown()
+}
+
+func (s *testDNSServer) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.mu.Lock()
+	held, release := s.held, s.release
+	s.mu.Unlock()
+	if release != nil {
+		held <- struct{}{}
+		<-release
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if s.fail {
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+
+	for _, q := range req.Question {
+		for _, rr := range s.rrs {
+			if rr.Header().Name == q.Name && rr.Header().Rrtype == q.Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+	w.WriteMsg(m)
+}
+
+// TestLookupIP verifies that A and AAAA records are returned, with the
+// smallest TTL among them.
+func TestLookupIP(t *testing.T) {
+	server := startDNSServer(t,
+		"backend.test. 30 IN A 127.0.0.1",
+		"backend.test. 20 IN A 127.0.0.2",
+		"backend.test. 60 IN AAAA ::1",
+	)
+	defer server.stop()
+
+	r, _ := newResolver([]string{server.addr})
+	ips, ttl, err := r.lookupIP(context.Background(), "backend.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, ip := range ips {
+		got = append(got, ip.String())
+	}
+	sort.Strings(got)
+	want := []string{"127.0.0.1", "127.0.0.2", "::1"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	if ttl != 20*time.Second {
+		t.Errorf("got TTL %v, want %v", ttl, 20*time.Second)
+	}
+
+	if _, _, err := r.lookupIP(context.Background(), "missing.test"); err == nil {
+		t.Error("lookup of missing.test succeeded, want an error")
+	}
+}
+
+// TestClampTTL verifies TTLs are bounded to the re-resolution range.
+func TestClampTTL(t *testing.T) {
+	var tests = []struct {
+		in  time.Duration
+		out time.Duration
+	}{
+		{0, minResolveInterval},
+		{time.Minute, time.Minute},
+		{time.Hour, maxResolveInterval},
+	}
+
+	for _, tt := range tests {
+		if got := clampTTL(tt.in); got != tt.out {
+			t.Errorf("clampTTL(%v) got %v, want %v", tt.in, got, tt.out)
+		}
+	}
+}
+
+// TestResolveAfterHostsChange verifies that a resolution that finishes
+// after its hosts have been replaced, as when a hosts file changes,
+// doesn't revert the pool to them.
+func TestResolveAfterHostsChange(t *testing.T) {
+	server := startDNSServer(t, "backend.test. 30 IN A 127.0.0.1")
+	defer server.stop()
+	r, _ := newResolver([]string{server.addr})
+
+	p := &pool{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	host := config.HostPort{Address: "backend.test", Port: 9090}
+	resolveHosts(ctx, "file-service", []config.HostPort{host}, p, r)
+	checkBackends(t, p, "127.0.0.1:9090")
+
+	// Block the next resolution, as if the name's TTL had expired
+	held, release := server.hold()
+	server.setRecords(t, "backend.test. 30 IN A 127.0.0.3")
+	hr := &hostResolver{service: "file-service", pool: p, resolver: r, backends: make([][]backend, 1)}
+	done := make(chan struct{})
+	go func() {
+		hr.refresh(ctx, 0, host)
+		close(done)
+	}()
+	<-held
+
+	// The hosts file changes while the resolution is blocked
+	cancel()
+	resolveHosts(context.Background(), "file-service", []config.HostPort{{Address: "127.0.0.2", Port: 9091}}, p, r)
+	release()
+	<-done
+
+	checkBackends(t, p, "127.0.0.2:9091")
+}
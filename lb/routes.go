@@ -0,0 +1,204 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"net/http"
+	"slices"
+)
+
+// A routingTable is the runtime state built from one version of the
+// configuration. Requests pick their service from the table that was
+// current when they arrived, so replacing the table doesn't disturb
+// requests already in flight.
+type routingTable struct {
+	config config.ProxyConfig
+	// generation counts the configurations loaded by the proxy, starting
+	// at 1
+	generation uint64
+	// services maps a service domain to the runtime state for that service
+	services map[string]*service
+	// acl and adminACL restrict the clients of the services and the admin
+	// listeners
+	acl, adminACL *acl
+	// cancel stops background work, such as re-resolving DNS names,
+	// other than the services' discovery
+	cancel context.CancelFunc
+}
+
+// A discovery is a service's running discoverer, with the configuration
+// it was started from, so that a table for a configuration that doesn't
+// change it can keep it rather than start another. Starting one can take
+// a while, e.g., to list a Kubernetes Service's EndpointSlices.
+type discovery struct {
+	cfg       config.Discovery
+	resolvers []string
+	cancel    context.CancelFunc
+}
+
+// unchanged returns true if the discovery was started from cfg, with the
+// same resolvers for sources that may return DNS names.
+func (d *discovery) unchanged(cfg *config.Discovery, resolvers []string) bool {
+	if *cfg != d.cfg {
+		return false
+	}
+	switch cfg.Type {
+	case config.DiscoveryDNSSRV, config.DiscoveryDNS, config.DiscoveryFile:
+		return slices.Equal(resolvers, d.resolvers)
+	}
+	return true
+}
+
+// newRoutingTable returns a routing table for cfg, which must already be
+// valid, with backend discovery and DNS resolution for its services
+// started. Backend state is carried over from services of the same name
+// in prev, the table being replaced, which is nil at startup, as is their
+// discovery and pool if its configuration is unchanged.
+func newRoutingTable(cfg *config.ProxyConfig, transport http.RoundTripper, prev *routingTable) (*routingTable, error) {
+	var res *resolver
+	if needsResolver(cfg) {
+		var err error
+		if res, err = newResolver(cfg.Resolvers); err != nil {
+			return nil, err
+		}
+	}
+
+	var generation uint64 = 1
+	if prev != nil {
+		generation = prev.generation + 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &routingTable{
+		generation: generation,
+		services:   make(map[string]*service),
+		cancel:     cancel,
+	}
+	cfg.Copy(&t.config)
+
+	// The discoveries started for t are stopped if it can't be built
+	fail := func(err error) (*routingTable, error) {
+		t.closeExcept(prev)
+		return nil, err
+	}
+
+	var err error
+	if t.acl, err = newACL(t.config.ACL); err != nil {
+		return fail(err)
+	}
+	if t.adminACL, err = newACL(t.config.Admin.ACL); err != nil {
+		return fail(err)
+	}
+
+	for _, svc := range t.config.Services {
+		var prevPool *pool
+		var prevSLO *sloTracker
+		var prevDiscovery *discovery
+		if prev != nil {
+			if ps, ok := prev.service(svc.Name); ok {
+				prevPool = ps.pool
+				prevSLO = ps.slo
+				prevDiscovery = ps.discovery
+			}
+		}
+
+		s := &service{
+			name:           svc.Name,
+			domain:         svc.Domain,
+			pool:           newPool(prevPool),
+			reverseProxy:   newReverseProxy(svc.Name, t.config.RequestID.HeaderName(), transport),
+			accessLog:      svc.AccessLog,
+			regionServices: svc.RegionServices,
+			slowThreshold:  svc.SlowThreshold,
+		}
+		if svc.SLO != nil {
+			// Keep counting against unchanged objectives
+			if prevSLO != nil && prevSLO.sameObjectives(svc.SLO) {
+				s.slo = prevSLO
+			} else {
+				s.slo = newSLOTracker(*svc.SLO)
+			}
+		}
+		if s.acl, err = newACL(svc.ACL); err != nil {
+			return fail(err)
+		}
+		switch {
+		case svc.Discovery != nil && prevDiscovery != nil && prevDiscovery.unchanged(svc.Discovery, t.config.Resolvers):
+			// The discoverer keeps updating the pool it was started with
+			s.pool = prevPool
+			s.discovery = prevDiscovery
+		case svc.Discovery != nil:
+			d, err := newDiscoverer(svc, s.pool, res)
+			if err != nil {
+				return fail(err)
+			}
+			dctx, dcancel := context.WithCancel(context.Background())
+			s.discovery = &discovery{cfg: *svc.Discovery, resolvers: t.config.Resolvers, cancel: dcancel}
+			d.start(dctx)
+		default:
+			resolveHosts(ctx, svc.Name, svc.Hosts, s.pool, res)
+		}
+		t.services[svc.Domain] = s
+	}
+
+	return t, nil
+}
+
+// service returns the service with the given name.
+func (t *routingTable) service(name string) (*service, bool) {
+	for _, s := range t.services {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// close stops the table's background work. Requests using the table may
+// continue to completion.
+func (t *routingTable) close() {
+	t.closeExcept(nil)
+}
+
+// closeExcept is close, but leaves the discoveries next uses running.
+// next may be nil.
+func (t *routingTable) closeExcept(next *routingTable) {
+	t.cancel()
+	for _, s := range t.services {
+		if s.discovery != nil && !next.usesDiscovery(s.discovery) {
+			s.discovery.cancel()
+		}
+	}
+}
+
+// usesDiscovery returns true if one of the table's services uses d.
+func (t *routingTable) usesDiscovery(d *discovery) bool {
+	if t == nil {
+		return false
+	}
+	for _, s := range t.services {
+		if s.discovery == d {
+			return true
+		}
+	}
+	return false
+}
+
+// needsResolver returns true if any host in cfg is a DNS name, or is
+// discovered from a source that may return DNS names.
+func needsResolver(cfg *config.ProxyConfig) bool {
+	for _, service := range cfg.Services {
+		if d := service.Discovery; d != nil {
+			switch d.Type {
+			case config.DiscoveryDNSSRV, config.DiscoveryDNS, config.DiscoveryFile:
+				return true
+			}
+		}
+		for _, host := range service.Hosts {
+			if host.IsHostname() {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether the active
+// requests have finished.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// NewServer returns an http.Server that serves the proxy on address.
+// Requests it serves, including upgraded connections, are cancelled if
+// they are still active when Shutdown's deadline passes.
+func (proxy *Proxy) NewServer(address string) *http.Server {
+	return &http.Server{
+		Addr:        address,
+		Handler:     proxy,
+		BaseContext: func(net.Listener) context.Context { return proxy.serverCtx },
+	}
+}
+
+// Shutdown gracefully shuts down server, which serves the proxy, in
+// phases:
+//
+//  1. The proxy fails its readiness checks, and keeps serving for the
+//     configured drain period so that load balancers in front of it see
+//     that and stop sending it requests.
+//  2. server stops accepting connections, and active requests, including
+//     upgraded connections, are given until the configured timeout to
+//     finish.
+//  3. Requests that are still active are cancelled, and their
+//     connections closed.
+//  4. Idle connections to backends are closed.
+//
+// Each phase is logged. The drain period and timeout are read from the
+// current configuration, so a reload can change them.
+func (proxy *Proxy) Shutdown(server *http.Server) {
+	drainPeriod := proxy.routes().config.Shutdown.DrainPeriod
+	if drainPeriod == 0 {
+		drainPeriod = config.DefaultDrainPeriod
+	}
+	proxy.shutdown(server, drainPeriod)
+}
+
+// shutdown is Shutdown with the given drain period. The drain is skipped
+// if it is 0, e.g., because a new process has taken over the listener
+// and will answer readiness checks.
+func (proxy *Proxy) shutdown(server *http.Server, drainPeriod time.Duration) {
+	timeout := proxy.routes().config.Shutdown.Timeout
+	if timeout == 0 {
+		timeout = config.DefaultShutdownTimeout
+	}
+
+	proxy.draining.Store(true)
+	if drainPeriod > 0 {
+		slog.Info("shutting down, failing readiness to drain", "drain_period", drainPeriod)
+		time.Sleep(drainPeriod)
+	}
+
+	slog.Info("shutting down, closing listener", "timeout", timeout, "active_requests", proxy.active.Load())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// server.Shutdown doesn't track upgraded connections, so wait for
+	// their requests too.
+	err := server.Shutdown(ctx)
+	if err == nil {
+		err = proxy.waitForRequests(ctx)
+	}
+	if err != nil {
+		slog.Warn("requests still active after shutdown timeout, closing them", "timeout", timeout, "active_requests", proxy.active.Load())
+		server.Close()
+		proxy.cancelServer()
+	}
+
+	proxy.transport.CloseIdleConnections()
+	slog.Info("shutdown complete")
+}
+
+// waitForRequests waits until the proxy has no active requests, or ctx is
+// done.
+func (proxy *Proxy) waitForRequests(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for proxy.active.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "waiting for active requests failed")
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// shutdownOnSignal shuts down server, which serves proxy, when SIGTERM
+// or SIGINT is received.
+//
+// SIGUSR2 upgrades the proxy instead: a new process is started with the
+// same binary and arguments, and handed listeners. Once it is serving,
+// stopControlPlane is called, and this process stops accepting
+// connections and finishes its active requests without draining, as the
+// new process answers on the same sockets. If the new process fails to
+// start this process carries on.
+//
+// The returned channel is closed once the shutdown is complete.
+func shutdownOnSignal(proxy *Proxy, server *http.Server, listeners *listenerSet, stopControlPlane func()) <-chan struct{} {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sig := range c {
+			if sig != syscall.SIGUSR2 {
+				slog.Info("shutdown signal received", "signal", sig.String())
+				proxy.Shutdown(server)
+				return
+			}
+
+			slog.Info("upgrade signal received", "signal", sig.String())
+			if err := listeners.handOff(); err != nil {
+				slog.Error("upgrade failed, carrying on", "err", err)
+				continue
+			}
+			stopControlPlane()
+			proxy.shutdown(server, 0)
+			return
+		}
+	}()
+	return done
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"afe/config"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// shutdownTestProxy returns a proxy for backend with the given shutdown
+// configuration, serving on a new listener, and the listener's address.
+func shutdownTestProxy(t *testing.T, backend *httptest.Server, cfg config.Shutdown) (*Proxy, *http.Server, string) {
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+	testConfig.Shutdown = cfg
+
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := proxy.NewServer(l.Addr().String())
+	go server.Serve(l)
+	return proxy, server, l.Addr().String()
+}
+
+// waitForActive waits for the proxy to have n active requests.
+func waitForActive(t *testing.T, proxy *Proxy, n int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for proxy.active.Load() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d active requests, want %d", proxy.active.Load(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestShutdown verifies that the proxy fails readiness while draining,
+// and lets an active request finish before shutdown completes.
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, "done")
+	}))
+	defer backend.Close()
+
+	proxy, server, addr := shutdownTestProxy(t, backend, config.Shutdown{
+		DrainPeriod: 100 * time.Millisecond,
+		Timeout:     5 * time.Second,
+	})
+	defer proxy.Close()
+
+	result := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://%s/?s=my-service.my-company.com", addr))
+		if err != nil {
+			result <- 0
+			return
+		}
+		resp.Body.Close()
+		result <- resp.StatusCode
+	}()
+	waitForActive(t, proxy, 1)
+
+	if err := proxy.readiness.Check(context.Background()); err != nil {
+		t.Fatalf("ready before shutdown: unexpected error: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		proxy.Shutdown(server)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := proxy.readiness.Check(context.Background()); err == nil {
+		t.Errorf("ready while draining, want not ready")
+	}
+
+	// Shutdown waits for the active request
+	select {
+	case <-done:
+		t.Fatal("shutdown completed with an active request")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	if code := <-result; code != http.StatusOK {
+		t.Errorf("got %d, want %d", code, http.StatusOK)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not complete")
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("connection accepted after shutdown")
+	}
+}
+
+// TestShutdownDeadline verifies that an upgraded connection that is still
+// open at the shutdown deadline is closed.
+func TestShutdownDeadline(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		rw.Flush()
+		io.Copy(io.Discard, conn) // Until the proxy closes the connection
+	}))
+	defer backend.Close()
+
+	proxy, server, addr := shutdownTestProxy(t, backend, config.Shutdown{
+		DrainPeriod: time.Millisecond,
+		Timeout:     100 * time.Millisecond,
+	})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /?s=my-service.my-company.com HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	start := time.Now()
+	proxy.Shutdown(server)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v, want it to give up after 100ms", elapsed)
+	}
+
+	// The upgraded connection is closed
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("got %v reading upgraded connection, want EOF", err)
+	}
+	waitForActive(t, proxy, 0)
+}
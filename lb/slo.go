@@ -0,0 +1,478 @@
+package main
+
+import (
+	"afe/config"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// SLIs, the indicators an SLO has objectives for.
+const (
+	sliAvailability = "availability"
+	sliLatency      = "latency"
+)
+
+// sloBucketWidth is the resolution SLO events are counted at.
+const sloBucketWidth = time.Minute
+
+// A burnRateAlert fires when the error budget is being spent BurnRate
+// times faster than it would be if the error ratio were exactly the
+// objective, over both Long and Short windows. The short window makes
+// the alert stop soon after the problem does. The alerts are those
+// recommended by the Site Reliability Workbook for a 30 day SLO.
+type burnRateAlert struct {
+	Long, Short time.Duration
+	BurnRate    float64
+	Severity    string
+}
+
+var burnRateAlerts = []burnRateAlert{
+	{time.Hour, 5 * time.Minute, 14.4, "page"},
+	{6 * time.Hour, 30 * time.Minute, 6, "page"},
+	{24 * time.Hour, 2 * time.Hour, 3, "ticket"},
+	{72 * time.Hour, 6 * time.Hour, 1, "ticket"},
+}
+
+// burnRate returns the alert's BurnRate for an SLO measured over window
+// rather than 30 days, so that it fires when the same fraction of the
+// budget has been spent over its Long window.
+func (a burnRateAlert) burnRate(window time.Duration) float64 {
+	return a.BurnRate * float64(window) / float64(config.DefaultSLOWindow)
+}
+
+// burnRateWindows returns the windows burn rates are computed over,
+// shortest first.
+func burnRateWindows() []time.Duration {
+	seen := make(map[time.Duration]bool)
+	var windows []time.Duration
+	for _, a := range burnRateAlerts {
+		for _, w := range []time.Duration{a.Long, a.Short} {
+			if !seen[w] {
+				seen[w] = true
+				windows = append(windows, w)
+			}
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	return windows
+}
+
+// promDuration formats d as a Prometheus duration, e.g., "5m" or "1d".
+func promDuration(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return strconv.Itoa(int(d/(24*time.Hour))) + "d"
+	case d%time.Hour == 0:
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	case d%time.Minute == 0:
+		return strconv.Itoa(int(d/time.Minute)) + "m"
+	}
+	return strconv.Itoa(int(d/time.Second)) + "s"
+}
+
+// sloHourBuckets is the number of sloBucketWidths in an hour.
+const sloHourBuckets = int64(time.Hour / sloBucketWidth)
+
+// sloEvents counts good and bad events for an SLI. The counts are kept
+// in buckets of sloBucketWidth, in a ring long enough for the longest
+// window they are summed over, and also by the hour, so that a long
+// window is summed from its whole hours.
+type sloEvents struct {
+	buckets []sloBucket
+	hours   []sloBucket
+}
+
+// An sloBucket counts the events in one sloBucketWidth.
+type sloBucket struct {
+	// index is the bucket's start as a count of sloBucketWidths since the
+	// Unix epoch, so that stale buckets can be recognised
+	index int64
+	total int64
+	bad   int64
+}
+
+func newSLOEvents(longest time.Duration) *sloEvents {
+	n := int64(longest / sloBucketWidth)
+	return &sloEvents{
+		buckets: make([]sloBucket, n),
+		hours:   make([]sloBucket, n/sloHourBuckets+2),
+	}
+}
+
+// bucketIndex returns the index of the bucket t is counted in.
+func bucketIndex(t time.Time) int64 {
+	return t.UnixNano() / int64(sloBucketWidth)
+}
+
+// add counts an event at now, which is bad if bad is true.
+func (e *sloEvents) add(bad bool, now time.Time) {
+	i := bucketIndex(now)
+	for _, b := range []*sloBucket{bucket(e.buckets, i), bucket(e.hours, i/sloHourBuckets)} {
+		b.total++
+		if bad {
+			b.bad++
+		}
+	}
+}
+
+// bucket returns the bucket with index i in ring, replacing the stale
+// bucket it takes the place of.
+func bucket(ring []sloBucket, i int64) *sloBucket {
+	b := &ring[i%int64(len(ring))]
+	if b.index != i {
+		*b = sloBucket{index: i}
+	}
+	return b
+}
+
+// errorRatio returns the fraction of the events in window before now
+// that were bad, and false if there were none. Only the buckets in the
+// window are read, an hour at a time where the window has the whole hour.
+func (e *sloEvents) errorRatio(window time.Duration, now time.Time) (float64, bool) {
+	last := bucketIndex(now)
+	first := last - int64(window/sloBucketWidth) + 1
+
+	var total, bad int64
+	for i := last; i >= first; {
+		ring, index, width := e.buckets, i, int64(1)
+		if (i+1)%sloHourBuckets == 0 && i-sloHourBuckets+1 >= first {
+			ring, index, width = e.hours, i/sloHourBuckets, sloHourBuckets
+		}
+		if b := ring[index%int64(len(ring))]; b.index == index {
+			total += b.total
+			bad += b.bad
+		}
+		i -= width
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return float64(bad) / float64(total), true
+}
+
+// An sloTracker measures a service's requests against its SLO.
+type sloTracker struct {
+	cfg config.SLO
+
+	mu           sync.Mutex
+	availability *sloEvents
+	latency      *sloEvents
+}
+
+// newSLOTracker returns a tracker for cfg.
+func newSLOTracker(cfg config.SLO) *sloTracker {
+	if cfg.Window == 0 {
+		cfg.Window = config.DefaultSLOWindow
+	}
+
+	// Events are kept for the SLO window, or the longest burn rate window
+	// if that is longer
+	longest := cfg.Window
+	if windows := burnRateWindows(); windows[len(windows)-1] > longest {
+		longest = windows[len(windows)-1]
+	}
+
+	t := &sloTracker{cfg: cfg}
+	if cfg.Availability != 0 {
+		t.availability = newSLOEvents(longest)
+	}
+	if cfg.Latency != nil {
+		t.latency = newSLOEvents(longest)
+	}
+	return t
+}
+
+// sameObjectives returns true if cfg has the tracker's objectives, so
+// that its events can still be measured against them.
+func (t *sloTracker) sameObjectives(cfg *config.SLO) bool {
+	window := cfg.Window
+	if window == 0 {
+		window = config.DefaultSLOWindow
+	}
+	if window != t.cfg.Window || cfg.Availability != t.cfg.Availability {
+		return false
+	}
+	if cfg.Latency == nil || t.cfg.Latency == nil {
+		return cfg.Latency == t.cfg.Latency
+	}
+	return *cfg.Latency == *t.cfg.Latency
+}
+
+// record counts a request that completed at now with status after
+// taking duration.
+func (t *sloTracker) record(status int, duration time.Duration, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.availability != nil {
+		t.availability.add(status >= 500, now)
+	}
+	if t.latency != nil {
+		t.latency.add(duration > t.cfg.Latency.Threshold, now)
+	}
+}
+
+// objectives returns the tracker's SLIs and their objectives.
+func (t *sloTracker) objectives() map[string]float64 {
+	o := make(map[string]float64)
+	if t.availability != nil {
+		o[sliAvailability] = t.cfg.Availability
+	}
+	if t.latency != nil {
+		o[sliLatency] = t.cfg.Latency.Percentile
+	}
+	return o
+}
+
+// sloStatus is an SLI's status at a point in time.
+type sloStatus struct {
+	SLI       string
+	Objective float64
+	// BudgetRemaining is the fraction of the error budget for the SLO
+	// window that is left, negative if it has been overspent
+	BudgetRemaining float64
+	// BurnRates are the rates the budget is being spent over each burn
+	// rate window, 1 being the rate that would spend exactly the budget
+	// over the SLO window
+	BurnRates map[time.Duration]float64
+}
+
+// status returns the status of each of the tracker's SLIs at now, in
+// name order.
+func (t *sloTracker) status(now time.Time) []sloStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var statuses []sloStatus
+	for _, sli := range []struct {
+		name   string
+		events *sloEvents
+	}{{sliAvailability, t.availability}, {sliLatency, t.latency}} {
+		if sli.events == nil {
+			continue
+		}
+		objective := t.objectives()[sli.name]
+		budget := 1 - objective
+
+		s := sloStatus{SLI: sli.name, Objective: objective, BudgetRemaining: 1, BurnRates: make(map[time.Duration]float64)}
+		if ratio, ok := sli.events.errorRatio(t.cfg.Window, now); ok {
+			s.BudgetRemaining = 1 - ratio/budget
+		}
+		for _, w := range burnRateWindows() {
+			ratio, _ := sli.events.errorRatio(w, now)
+			s.BurnRates[w] = ratio / budget
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// sloEventsTotal counts the events measured against each service's SLOs,
+// for the rules generated by writeSLORules.
+var sloEventsTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "proxy_slo_events_total",
+		Help: "Requests measured against each service's SLOs by SLI and result, \"good\" or \"bad\".",
+	},
+	[]string{"service", "sli", "result"},
+)
+
+// recordSLO measures a request for svc, which completed with status
+// after taking duration, against its SLO, if it has one.
+func recordSLO(svc *service, status int, duration time.Duration) {
+	if svc == nil || svc.slo == nil {
+		return
+	}
+	svc.slo.record(status, duration, time.Now())
+
+	result := func(bad bool) string {
+		if bad {
+			return "bad"
+		}
+		return "good"
+	}
+	if svc.slo.availability != nil {
+		sloEventsTotal.WithLabelValues(svc.name, sliAvailability, result(status >= 500)).Inc()
+	}
+	if svc.slo.latency != nil {
+		sloEventsTotal.WithLabelValues(svc.name, sliLatency, result(duration > svc.slo.cfg.Latency.Threshold)).Inc()
+	}
+}
+
+var (
+	sloObjectiveDesc = prometheus.NewDesc(
+		"proxy_slo_objective",
+		"Fraction of requests that must be good for each service's SLO.",
+		[]string{"service", "sli"}, nil,
+	)
+	sloBudgetRemainingDesc = prometheus.NewDesc(
+		"proxy_slo_error_budget_remaining",
+		"Fraction of the error budget left in the SLO window, negative if overspent.",
+		[]string{"service", "sli"}, nil,
+	)
+	sloBurnRateDesc = prometheus.NewDesc(
+		"proxy_slo_burn_rate",
+		"Rate the error budget is being spent over each window, 1 spending exactly the budget over the SLO window.",
+		[]string{"service", "sli", "window"}, nil,
+	)
+)
+
+// An sloCollector is a prometheus.Collector that reports the status of
+// every service's SLO when scraped. The status is computed from the
+// events since the proxy started.
+type sloCollector struct {
+	proxy *Proxy
+}
+
+func (c sloCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sloObjectiveDesc
+	ch <- sloBudgetRemainingDesc
+	ch <- sloBurnRateDesc
+}
+
+func (c sloCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, svc := range c.proxy.routes().services {
+		if svc.slo == nil {
+			continue
+		}
+		for _, s := range svc.slo.status(now) {
+			ch <- prometheus.MustNewConstMetric(sloObjectiveDesc, prometheus.GaugeValue, s.Objective, svc.name, s.SLI)
+			ch <- prometheus.MustNewConstMetric(sloBudgetRemainingDesc, prometheus.GaugeValue, s.BudgetRemaining, svc.name, s.SLI)
+			for w, rate := range s.BurnRates {
+				ch <- prometheus.MustNewConstMetric(sloBurnRateDesc, prometheus.GaugeValue, rate, svc.name, s.SLI, promDuration(w))
+			}
+		}
+	}
+}
+
+// sloRulesCommand is the lb subcommand that writes SLO rules.
+const sloRulesCommand = "slo-rules"
+
+// writeSLORulesFromFile writes the rules for the SLOs in the
+// configuration file filename to w.
+func writeSLORulesFromFile(filename string, w io.Writer) []error {
+	cfg := config.ProxyConfig{}
+	if err := config.ParseConfigFromFile(filename, &cfg); err != nil {
+		return []error{err}
+	}
+	if errs := config.ValidateConfig(&cfg); errs != nil {
+		return errs
+	}
+	if err := writeSLORules(w, &cfg); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// A ruleFile is a Prometheus rule file.
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+// A rule is a recording rule, if Record is set, or an alerting rule.
+type rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// errorRatioRecord is the name of the recording rule for the error ratio
+// over window.
+func errorRatioRecord(window time.Duration) string {
+	return "service_sli:proxy_slo_error_ratio:rate" + promDuration(window)
+}
+
+// writeSLORules writes Prometheus recording rules for the error ratio of
+// each SLI, and multi-window burn rate alerts for each service's SLOs in
+// cfg, to w. The rules are computed from proxy_slo_events_total, so they
+// survive the proxy restarting, unlike the proxy's own SLO metrics.
+func writeSLORules(w io.Writer, cfg *config.ProxyConfig) error {
+	recording := ruleGroup{Name: "afe-slo-recording"}
+	for _, window := range burnRateWindows() {
+		recording.Rules = append(recording.Rules, rule{
+			Record: errorRatioRecord(window),
+			Expr: fmt.Sprintf(`sum by (service, sli) (rate(proxy_slo_events_total{result="bad"}[%[1]s]))
+/
+sum by (service, sli) (rate(proxy_slo_events_total[%[1]s]))`, promDuration(window)),
+		})
+	}
+
+	alerting := ruleGroup{Name: "afe-slo-alerts"}
+	for _, service := range cfg.Services {
+		if service.SLO == nil {
+			continue
+		}
+		t := newSLOTracker(*service.SLO)
+		objectives := t.objectives()
+		for _, sli := range []string{sliAvailability, sliLatency} {
+			objective, ok := objectives[sli]
+			if !ok {
+				continue
+			}
+			alerting.Rules = append(alerting.Rules, burnRateRules(service.Name, sli, objective, t.cfg.Window)...)
+		}
+	}
+
+	groups := []ruleGroup{recording}
+	if len(alerting.Rules) > 0 {
+		groups = append(groups, alerting)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(ruleFile{Groups: groups}); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// burnRateRules returns the burn rate alerts for the named service's SLI
+// with objective over window, one for each severity.
+func burnRateRules(service, sli string, objective float64, window time.Duration) []rule {
+	selector := fmt.Sprintf(`{service=%q, sli=%q}`, service, sli)
+	budget := "(1 - " + strconv.FormatFloat(objective, 'g', -1, 64) + ")"
+
+	var rules []rule
+	for _, severity := range []string{"page", "ticket"} {
+		var exprs []string
+		for _, a := range burnRateAlerts {
+			if a.Severity != severity {
+				continue
+			}
+			burnRate := strconv.FormatFloat(a.burnRate(window), 'g', 4, 64)
+			exprs = append(exprs, fmt.Sprintf("(%s%s > (%s * %s) and %s%s > (%s * %s))",
+				errorRatioRecord(a.Long), selector, burnRate, budget,
+				errorRatioRecord(a.Short), selector, burnRate, budget))
+		}
+
+		expr := exprs[0]
+		for _, e := range exprs[1:] {
+			expr += "\nor\n" + e
+		}
+		rules = append(rules, rule{
+			Alert:  "ProxySLOBurnRate",
+			Expr:   expr,
+			Labels: map[string]string{"severity": severity, "service": service, "sli": sli},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("Service %s is spending its %s error budget too fast", service, sli),
+			},
+		})
+	}
+	return rules
+}
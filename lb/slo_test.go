@@ -0,0 +1,220 @@
+package main
+
+import (
+	"afe/config"
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSLOEvents(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	e := newSLOEvents(time.Hour)
+
+	// 1 bad event in 10 each minute for the first 30 minutes, then all
+	// good for 30 minutes
+	for m := 0; m < 60; m++ {
+		for i := 0; i < 10; i++ {
+			e.add(m < 30 && i == 0, start.Add(time.Duration(m)*time.Minute))
+		}
+	}
+	now := start.Add(59 * time.Minute)
+
+	var tests = []struct {
+		window time.Duration
+		now    time.Time
+		want   float64
+		ok     bool
+	}{
+		{time.Hour, now, 0.05, true},
+		{30 * time.Minute, now, 0, true},
+		{45 * time.Minute, now, 15.0 / 450, true},
+		{5 * time.Minute, now.Add(time.Hour), 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := e.errorRatio(tt.window, tt.now)
+		if ok != tt.ok || math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%v: got %v, %t, want %v, %t", tt.window, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// The ring wraps, replacing the oldest buckets
+	e.add(true, start.Add(time.Hour))
+	if got, _ := e.errorRatio(time.Hour, start.Add(time.Hour)); math.Abs(got-30.0/591) > 1e-9 {
+		t.Errorf("got %v after wrapping, want %v", got, 30.0/591)
+	}
+
+	// Long windows are summed by the hour, and the minutes either side
+	e = newSLOEvents(3 * time.Hour)
+	for m := 0; m < 180; m++ {
+		e.add(m%60 == 0, start.Add(time.Duration(m)*time.Minute+30*time.Second))
+	}
+	now = start.Add(179 * time.Minute)
+	for _, tt := range []struct {
+		window time.Duration
+		want   float64
+	}{
+		{3 * time.Hour, 3.0 / 180},
+		{2*time.Hour + 30*time.Minute, 2.0 / 150},
+		{time.Hour + 30*time.Minute, 1.0 / 90},
+	} {
+		if got, _ := e.errorRatio(tt.window, now); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%v: got %v, want %v", tt.window, got, tt.want)
+		}
+	}
+	if got, _ := e.errorRatio(2*time.Hour, now.Add(30*time.Minute)); math.Abs(got-1.0/90) > 1e-9 {
+		t.Errorf("got %v for a window ending after the events, want %v", got, 1.0/90)
+	}
+}
+
+func TestSLOStatus(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newSLOTracker(config.SLO{
+		Availability: 0.99,
+		Latency:      &config.LatencySLO{Threshold: 100 * time.Millisecond, Percentile: 0.9},
+	})
+
+	// 2% errors and 5% slow in the last 5 minutes, after an hour of good
+	// requests
+	for i := 0; i < 900; i++ {
+		tracker.record(200, time.Millisecond, now.Add(-time.Hour))
+	}
+	for i := 0; i < 100; i++ {
+		status, duration := 200, time.Millisecond
+		if i < 2 {
+			status = 503
+		}
+		if i >= 95 {
+			duration = time.Second
+		}
+		tracker.record(status, duration, now)
+	}
+
+	var tests = []struct {
+		sli       string
+		budget    float64
+		burn5m    float64
+		burn1h    float64
+		objective float64
+	}{
+		// 2 errors in 1000 requests spend 20% of a 1% budget
+		{sliAvailability, 0.8, 2, 2, 0.99},
+		// 5 slow requests in 1000 spend 5% of a 10% budget
+		{sliLatency, 0.95, 0.5, 0.5, 0.9},
+	}
+
+	statuses := tracker.status(now)
+	if len(statuses) != len(tests) {
+		t.Fatalf("got %d statuses, want %d", len(statuses), len(tests))
+	}
+	for i, tt := range tests {
+		s := statuses[i]
+		if s.SLI != tt.sli || s.Objective != tt.objective {
+			t.Errorf("got %s with objective %v, want %s with %v", s.SLI, s.Objective, tt.sli, tt.objective)
+		}
+		if math.Abs(s.BudgetRemaining-tt.budget) > 1e-9 {
+			t.Errorf("%s: got %v budget remaining, want %v", tt.sli, s.BudgetRemaining, tt.budget)
+		}
+		// The hour before now doesn't include the good requests an hour
+		// ago, so both windows only have the recent requests
+		for w, want := range map[time.Duration]float64{5 * time.Minute: tt.burn5m, time.Hour: tt.burn1h} {
+			if got := s.BurnRates[w]; math.Abs(got-want) > 1e-9 {
+				t.Errorf("%s: got burn rate %v over %v, want %v", tt.sli, got, w, want)
+			}
+		}
+	}
+}
+
+func TestSLORules(t *testing.T) {
+	cfg := config.ProxyConfig{}
+	goldenConfig.Copy(&cfg)
+	cfg.Services[0].SLO = &config.SLO{Availability: 0.999}
+
+	var buf bytes.Buffer
+	if err := writeSLORules(&buf, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var got ruleFile
+	if err := yaml.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("got %s, %v", buf.String(), err)
+	}
+	if len(got.Groups) != 2 {
+		t.Fatalf("got %d groups, want recording and alerting", len(got.Groups))
+	}
+
+	recording := got.Groups[0].Rules
+	if len(recording) != len(burnRateWindows()) || recording[0].Record != "service_sli:proxy_slo_error_ratio:rate5m" {
+		t.Errorf("got recording rules %+v", recording)
+	}
+
+	alerts := got.Groups[1].Rules
+	if len(alerts) != 2 {
+		t.Fatalf("got %d alerts, want page and ticket", len(alerts))
+	}
+	page := alerts[0]
+	if page.Labels["severity"] != "page" || page.Labels["service"] != "my-service" || page.Labels["sli"] != sliAvailability {
+		t.Errorf("got labels %v", page.Labels)
+	}
+	want := `(service_sli:proxy_slo_error_ratio:rate1h{service="my-service", sli="availability"} > (14.4 * (1 - 0.999))` +
+		` and service_sli:proxy_slo_error_ratio:rate5m{service="my-service", sli="availability"} > (14.4 * (1 - 0.999)))`
+	if !strings.HasPrefix(page.Expr, want) {
+		t.Errorf("got page expr\n%s\nwant it to start with\n%s", page.Expr, want)
+	}
+
+	// The burn rates are scaled to spend the same fraction of a 7 day
+	// budget
+	cfg.Services[0].SLO.Window = 7 * 24 * time.Hour
+	buf.Reset()
+	if err := writeSLORules(&buf, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("got %s, %v", buf.String(), err)
+	}
+	want = `(service_sli:proxy_slo_error_ratio:rate1h{service="my-service", sli="availability"} > (3.36 * (1 - 0.999))`
+	if page := got.Groups[1].Rules[0]; !strings.HasPrefix(page.Expr, want) {
+		t.Errorf("7 day window: got page expr\n%s\nwant it to start with\n%s", page.Expr, want)
+	}
+}
+
+// TestSLOReload verifies that events are kept by a reload that doesn't
+// change a service's objectives.
+func TestSLOReload(t *testing.T) {
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].SLO = &config.SLO{Availability: 0.99}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	defer proxy.Close()
+
+	tracker := proxy.routes().services["my-service.my-company.com"].slo
+	var tests = []struct {
+		slo  config.SLO
+		same bool
+	}{
+		{config.SLO{Availability: 0.99}, true},
+		{config.SLO{Availability: 0.99, Window: config.DefaultSLOWindow}, true},
+		{config.SLO{Availability: 0.999}, false},
+	}
+
+	for _, tt := range tests {
+		slo := tt.slo
+		testConfig.Services[0].SLO = &slo
+		if errs := proxy.Reload(&testConfig); errs != nil {
+			t.Fatal(errs)
+		}
+		got := proxy.routes().services["my-service.my-company.com"].slo
+		if (got == tracker) != tt.same {
+			t.Errorf("%+v: got same tracker %t, want %t", tt.slo, got == tracker, tt.same)
+		}
+		tracker = got
+	}
+}
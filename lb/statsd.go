@@ -0,0 +1,241 @@
+package main
+
+import (
+	"afe/config"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// statsdMaxPacket is the largest packet sent to a StatsD server, small
+// enough not to be fragmented on an Ethernet network.
+const statsdMaxPacket = 1432
+
+// A statsdSink is a metricSink that sends metrics to a StatsD or
+// DogStatsD server over UDP. Counters are sent as counts, gauges as
+// gauges, and observations of histograms in seconds as timers, in
+// milliseconds. Gauges are always sent as their value, not as a change,
+// as DogStatsD doesn't apply signed gauge values.
+//
+// Lines are buffered in to packets, which are sent when full, and every
+// flush interval, by a single goroutine so that they arrive in order.
+type statsdSink struct {
+	prefix string
+	// tags is true to send labels as DogStatsD tags, rather than in the
+	// metric name
+	tags bool
+	conn net.Conn
+
+	mu  sync.Mutex
+	buf []byte
+	// full are the packets waiting to be sent
+	full [][]byte
+	// gauges are the values of the gauges sent, by name and labels
+	gauges map[string]float64
+
+	ready chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newStatsDSink returns a statsdSink configured by cfg.
+func newStatsDSink(cfg *config.StatsD) (*statsdSink, error) {
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to StatsD at %s failed", cfg.Address)
+	}
+
+	interval := cfg.FlushInterval
+	if interval == 0 {
+		interval = config.DefaultStatsDFlushInterval
+	}
+	s := &statsdSink{
+		prefix: cfg.Prefix,
+		tags:   cfg.Format == config.StatsDDogStatsD,
+		conn:   conn,
+		buf:    make([]byte, 0, statsdMaxPacket),
+		gauges: make(map[string]float64),
+		ready:  make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.flushEvery(interval)
+	return s, nil
+}
+
+func (s *statsdSink) add(m *metric, values []string, delta float64) {
+	if m.kind == counterMetric {
+		s.write(m, values, formatStatsDValue(delta), "c")
+		return
+	}
+	s.writeGauge(m, values, func(value float64) float64 { return value + delta })
+}
+
+func (s *statsdSink) set(m *metric, values []string, value float64) {
+	s.writeGauge(m, values, func(float64) float64 { return value })
+}
+
+func (s *statsdSink) observe(m *metric, values []string, value float64) {
+	if name, ok := strings.CutSuffix(m.name, "_seconds"); ok {
+		s.writeName(name+"_milliseconds", m, values, formatStatsDValue(value*1000), "ms")
+		return
+	}
+	s.write(m, values, formatStatsDValue(value), "h")
+}
+
+// formatStatsDValue formats v without an exponent.
+func formatStatsDValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// statsdReplacer replaces the characters with a meaning in the StatsD
+// protocol in a label value. Dots are also replaced in the plain format,
+// where they separate the parts of the name.
+var (
+	statsdReplacer    = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_", ".", "_")
+	dogstatsdReplacer = strings.NewReplacer("|", "_", "@", "_", "#", "_", ",", "_", "\n", "_")
+)
+
+// write buffers the line for m with the given label values, value and
+// StatsD type.
+func (s *statsdSink) write(m *metric, values []string, value, typ string) {
+	s.writeName(m.name, m, values, value, typ)
+}
+
+// writeName buffers the line for the named metric m with the given label
+// values, value and StatsD type.
+func (s *statsdSink) writeName(name string, m *metric, values []string, value, typ string) {
+	head, tail := s.format(name, m, values)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.appendLocked(head + ":" + value + "|" + typ + tail)
+}
+
+// writeGauge buffers the line for the gauge m with the given label
+// values, set to the value update returns from its current value.
+func (s *statsdSink) writeGauge(m *metric, values []string, update func(float64) float64) {
+	head, tail := s.format(m.name, m, values)
+	key := head + tail
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value := update(s.gauges[key])
+	s.gauges[key] = value
+	if value < 0 && !s.tags {
+		// StatsD takes a signed value as a change, so the gauge is
+		// zeroed first
+		s.appendLocked(head + ":0|g" + tail)
+	}
+	s.appendLocked(head + ":" + formatStatsDValue(value) + "|g" + tail)
+}
+
+// format returns the parts of the line for the named metric m with the
+// given label values before and after its value and type.
+func (s *statsdSink) format(name string, m *metric, values []string) (head, tail string) {
+	var line strings.Builder
+	line.WriteString(s.prefix)
+	line.WriteString(name)
+	if !s.tags {
+		// Empty label values would leave empty parts of the name
+		for _, v := range values {
+			if v == "" {
+				v = "none"
+			}
+			line.WriteByte('.')
+			line.WriteString(statsdReplacer.Replace(v))
+		}
+		return line.String(), ""
+	}
+	head = line.String()
+
+	line.Reset()
+	sep := "|#"
+	for i, v := range values {
+		if v == "" || i >= len(m.labels) {
+			continue
+		}
+		line.WriteString(sep)
+		line.WriteString(m.labels[i])
+		line.WriteByte(':')
+		line.WriteString(dogstatsdReplacer.Replace(v))
+		sep = ","
+	}
+	return head, line.String()
+}
+
+// appendLocked buffers line, queueing the buffered lines to be sent if it
+// doesn't fit in the packet. s.mu must be held.
+func (s *statsdSink) appendLocked(line string) {
+	if len(s.buf) > 0 && len(s.buf)+1+len(line) > statsdMaxPacket {
+		s.queueLocked()
+		select {
+		case s.ready <- struct{}{}:
+		default:
+		}
+	}
+	if len(s.buf) > 0 {
+		s.buf = append(s.buf, '\n')
+	}
+	s.buf = append(s.buf, line...)
+}
+
+// queueLocked queues the buffered lines to be sent. s.mu must be held.
+func (s *statsdSink) queueLocked() {
+	if len(s.buf) == 0 {
+		return
+	}
+	s.full = append(s.full, s.buf)
+	s.buf = make([]byte, 0, statsdMaxPacket)
+}
+
+// send sends the queued packets, and the buffered lines if all is true.
+// The packets are taken under s.mu, and written without it.
+func (s *statsdSink) send(all bool) {
+	s.mu.Lock()
+	if all {
+		s.queueLocked()
+	}
+	packets := s.full
+	s.full = nil
+	s.mu.Unlock()
+
+	for _, packet := range packets {
+		if _, err := s.conn.Write(packet); err != nil {
+			// The server may not be listening yet, or have gone away,
+			// and UDP reports it on a later write
+			slog.Debug("sending metrics to StatsD failed", "err", err)
+		}
+	}
+}
+
+// flushEvery sends full packets as they are queued, and the buffered
+// lines every interval, until the sink is closed.
+func (s *statsdSink) flushEvery(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.ready:
+			s.send(false)
+		case <-ticker.C:
+			s.send(true)
+		}
+	}
+}
+
+// Close sends the buffered lines and closes the connection.
+func (s *statsdSink) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.send(true)
+	return s.conn.Close()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"afe/config"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStatsDSink(t *testing.T) {
+	requests := &metric{kind: counterMetric, name: "proxy_requests_total", labels: []string{"service", "code"}}
+	inFlight := &metric{kind: gaugeMetric, name: "proxy_in_flight_requests"}
+	latency := &metric{kind: histogramMetric, name: "proxy_backend_total_seconds", labels: []string{"service", "backend"}}
+	size := &metric{kind: histogramMetric, name: "proxy_response_bytes", labels: []string{"service"}}
+
+	var tests = []struct {
+		format string
+		want   []string
+	}{
+		{config.StatsDPlain, []string{
+			"afe.proxy_requests_total.www.200:1|c",
+			"afe.proxy_requests_total.none.404:2|c",
+			"afe.proxy_in_flight_requests:1|g",
+			"afe.proxy_in_flight_requests:0|g",
+			"afe.proxy_in_flight_requests:3|g",
+			"afe.proxy_backend_total_milliseconds.www.10_0_0_1_8080:250|ms",
+			"afe.proxy_response_bytes.www:512|h",
+		}},
+		{config.StatsDDogStatsD, []string{
+			"afe.proxy_requests_total:1|c|#service:www,code:200",
+			"afe.proxy_requests_total:2|c|#code:404",
+			"afe.proxy_in_flight_requests:1|g",
+			"afe.proxy_in_flight_requests:0|g",
+			"afe.proxy_in_flight_requests:3|g",
+			"afe.proxy_backend_total_milliseconds:250|ms|#service:www,backend:10.0.0.1:8080",
+			"afe.proxy_response_bytes:512|h|#service:www",
+		}},
+	}
+
+	for _, tt := range tests {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		s, err := newStatsDSink(&config.StatsD{
+			Address:       conn.LocalAddr().String(),
+			Format:        tt.format,
+			Prefix:        "afe.",
+			FlushInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.add(requests, []string{"www", "200"}, 1)
+		s.add(requests, []string{"", "404"}, 2)
+		s.add(inFlight, nil, 1)
+		s.add(inFlight, nil, -1)
+		s.set(inFlight, nil, 3)
+		s.observe(latency, []string{"www", "10.0.0.1:8080"}, 0.25)
+		s.observe(size, []string{"www"}, 512)
+		// Closing sends the buffered lines in a single packet
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, statsdMaxPacket)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		if got, want := string(buf[:n]), strings.Join(tt.want, "\n"); got != want {
+			t.Errorf("%s: got %q, want %q", tt.format, got, want)
+		}
+	}
+}
+
+// TestStatsDSinkPackets verifies that lines are split across packets no
+// larger than statsdMaxPacket.
+func TestStatsDSinkPackets(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := newStatsDSink(&config.StatsD{Address: conn.LocalAddr().String(), FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &metric{kind: counterMetric, name: "proxy_requests_total"}
+	const lines = 200
+	for i := 0; i < lines; i++ {
+		s.add(m, nil, 1)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := 0
+	buf := make([]byte, 64*1024)
+	for got < lines {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %v lines, want %v: %v", got, lines, err)
+		}
+		if n > statsdMaxPacket {
+			t.Errorf("got a %v byte packet, want at most %v", n, statsdMaxPacket)
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line != "proxy_requests_total:1|c" {
+				t.Errorf("got line %q, want %q", line, "proxy_requests_total:1|c")
+			}
+			got++
+		}
+	}
+}
+
+// A recordingSink records the changes passed to it to metrics whose names
+// start with "test_".
+type recordingSink struct {
+	mu      sync.Mutex
+	changes []string
+}
+
+func (s *recordingSink) record(op string, m *metric, values []string, v float64) {
+	if !strings.HasPrefix(m.name, "test_") {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changes = append(s.changes, op+" "+m.name+" "+strings.Join(values, ",")+" "+formatStatsDValue(v))
+}
+
+func (s *recordingSink) add(m *metric, values []string, delta float64) {
+	s.record("add", m, values, delta)
+}
+
+func (s *recordingSink) set(m *metric, values []string, value float64) {
+	s.record("set", m, values, value)
+}
+
+func (s *recordingSink) observe(m *metric, values []string, value float64) {
+	s.record("observe", m, values, value)
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+// TestMetricSinks verifies that changes to the wrapped Prometheus metrics
+// are passed to the sinks.
+func TestMetricSinks(t *testing.T) {
+	prev := sinks.Load()
+	defer sinks.Store(prev)
+	sinks.Store(nil)
+
+	s := &recordingSink{}
+	addMetricSink(s)
+
+	c := newCounterVec(prometheus.CounterOpts{Name: "test_total"}, []string{"service"})
+	c.WithLabelValues("www").Inc()
+	g := newGauge(prometheus.GaugeOpts{Name: "test_gauge"})
+	g.Inc()
+	g.Set(5)
+	h := newHistogramVec(prometheus.HistogramOpts{Name: "test_seconds"}, []string{"service", "backend"})
+	h.With(prometheus.Labels{"backend": "b", "service": "www"}).Observe(0.5)
+
+	want := []string{
+		"add test_total www 1",
+		"add test_gauge  1",
+		"set test_gauge  5",
+		"observe test_seconds www,b 0.5",
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.Join(s.changes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", s.changes, want)
+	}
+}
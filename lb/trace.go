@@ -2,58 +2,246 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http/httptrace"
+	"sync"
 	"time"
 )
 
+// A tracePhase is the duration of one phase of a request to a backend. Valid is false if the
+// phase didn't happen or didn't complete, e.g., there is no DNS phase if a connection is
+// reused, and no response phases if connecting failed.
+type tracePhase struct {
+	Duration time.Duration
+	Valid    bool
+}
+
+// between returns the phase from start to end, which is only valid if both happened.
+func between(start, end time.Time) tracePhase {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return tracePhase{}
+	}
+	return tracePhase{Duration: end.Sub(start), Valid: true}
+}
+
+func (p tracePhase) String() string {
+	if !p.Valid {
+		return "-"
+	}
+	return p.Duration.String()
+}
+
 type httpTraceStats struct {
+	// mu guards the fields below. The trace hooks are called from the transport's goroutines,
+	// and a dial may carry on after the request has given up on it.
+	mu sync.Mutex
+
+	getConn      time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	wroteRequest time.Time
+
+	gotFirstResponseByte time.Time
+
+	// LatencyGetConn records the time taken to get a connection to the backend, including any
+	// DNS lookup, connecting and TLS handshake, or waiting for an idle connection.
+	LatencyGetConn tracePhase
+
+	// LatencyDNS records the time taken to look up the backend's address.
+	LatencyDNS tracePhase
+
+	// LatencyConnect records the time taken to establish a TCP connection, or connect to a Unix
+	// domain socket. If several addresses are tried it runs from the first attempt starting
+	// to the last finishing.
+	LatencyConnect tracePhase
+
+	// LatencyTLS records the time taken by the TLS handshake.
+	LatencyTLS tracePhase
+
 	// LatencyRequest records the time taken to send the request after the TCP connection is
 	// established or reused.
-	LatencyRequest time.Duration
-	gotConn        time.Time
-	wroteRequest   time.Time
+	LatencyRequest tracePhase
 
 	// LatencyBackend records the time taken by the backend to process the request.
-	LatencyBackend time.Duration
+	LatencyBackend tracePhase
 
 	// LatencyResponse records the time taken to receive the response from the backend after
 	// the request has been sent.
-	LatencyResponse      time.Duration
-	gotFirstResponseByte time.Time
+	LatencyResponse tracePhase
 
-	// LatencyTotal records the total time taken to send and receive the response.
-	LatencyTotal time.Duration
+	// LatencyTotal records the total time taken to get a connection, send the request and
+	// receive the response.
+	LatencyTotal tracePhase
+
+	// Reused is true if the connection had been used for a previous request, WasIdle if it
+	// had been idle in the connection pool, for IdleTime.
+	Reused   bool
+	WasIdle  bool
+	IdleTime time.Duration
+
+	// ConnectErr is the error from the last failed connection attempt, if any.
+	ConnectErr error
 }
 
 func (s *httpTraceStats) String() string {
-	return fmt.Sprintf("Request(%v) Backend(%v) Response(%v) Total(%v)",
-		s.LatencyRequest, s.LatencyBackend, s.LatencyResponse, s.LatencyTotal)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str := fmt.Sprintf("GetConn(%v) DNS(%v) Connect(%v) TLS(%v) Request(%v) Backend(%v) Response(%v) Total(%v) Reused(%t) WasIdle(%t) IdleTime(%v)",
+		s.LatencyGetConn, s.LatencyDNS, s.LatencyConnect, s.LatencyTLS,
+		s.LatencyRequest, s.LatencyBackend, s.LatencyResponse, s.LatencyTotal,
+		s.Reused, s.WasIdle, s.IdleTime)
+	if s.ConnectErr != nil {
+		str += fmt.Sprintf(" ConnectErr(%v)", s.ConnectErr)
+	}
+	return str
+}
+
+// record sets *t to the current time, unless it has already been set.
+func (s *httpTraceStats) record(t *time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.IsZero() {
+		*t = time.Now()
+	}
 }
 
 // WithHTTPTrace returns a new context based on the provided context that records httptrace
 // statistics in the provided httpTraceStats struct.
 func WithHTTPTrace(ctx context.Context, s *httpTraceStats) context.Context {
 	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
-		GotConn: func(gotConnInfo httptrace.GotConnInfo) {
+		GetConn: func(hostPort string) {
+			s.record(&s.getConn)
+		},
+
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			s.record(&s.dnsStart)
+		},
+
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			s.record(&s.dnsDone)
+		},
+
+		ConnectStart: func(network, addr string) {
+			s.record(&s.connectStart)
+		},
+
+		ConnectDone: func(network, addr string, err error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if err != nil {
+				s.ConnectErr = err
+				return
+			}
+			s.connectDone = time.Now()
+		},
+
+		TLSHandshakeStart: func() {
+			s.record(&s.tlsStart)
+		},
+
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			s.record(&s.tlsDone)
+		},
+
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
 			s.gotConn = time.Now()
+			s.Reused = info.Reused
+			s.WasIdle = info.WasIdle
+			s.IdleTime = info.IdleTime
 		},
 
 		WroteRequest: func(info httptrace.WroteRequestInfo) {
-			s.wroteRequest = time.Now()
+			s.record(&s.wroteRequest)
 		},
 
 		GotFirstResponseByte: func() {
-			s.gotFirstResponseByte = time.Now()
+			s.record(&s.gotFirstResponseByte)
 		},
 	})
 }
 
-// Done records the time that the request completed.
+// Done records the time that the request completed. Phases whose events didn't happen, e.g.,
+// because connecting to the backend failed, are left invalid.
 func (s *httpTraceStats) Done() {
 	done := time.Now()
-	s.LatencyRequest = s.wroteRequest.Sub(s.gotConn)
-	s.LatencyResponse = done.Sub(s.gotFirstResponseByte)
-	s.LatencyBackend = s.gotFirstResponseByte.Sub(s.wroteRequest)
-	s.LatencyTotal = done.Sub(s.gotConn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.LatencyGetConn = between(s.getConn, s.gotConn)
+	s.LatencyDNS = between(s.dnsStart, s.dnsDone)
+	s.LatencyConnect = between(s.connectStart, s.connectDone)
+	s.LatencyTLS = between(s.tlsStart, s.tlsDone)
+	s.LatencyRequest = between(s.gotConn, s.wroteRequest)
+	s.LatencyBackend = between(s.wroteRequest, s.gotFirstResponseByte)
+	s.LatencyResponse = between(s.gotFirstResponseByte, done)
+	s.LatencyTotal = between(s.getConn, done)
+}
+
+// A namedPhase is a tracePhase and its name.
+type namedPhase struct {
+	Name string
+	tracePhase
+}
+
+// namedPhases returns the phases of the request, once Done, in the order
+// they happen in a request.
+func (s *httpTraceStats) namedPhases() []namedPhase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return []namedPhase{
+		{"get_conn", s.LatencyGetConn},
+		{"dns", s.LatencyDNS},
+		{"connect", s.LatencyConnect},
+		{"tls", s.LatencyTLS},
+		{"request", s.LatencyRequest},
+		{"backend", s.LatencyBackend},
+		{"response", s.LatencyResponse},
+		{"total", s.LatencyTotal},
+	}
+}
+
+// A traceEvent is something that happened while making a request to a
+// backend, e.g., the DNS lookup starting.
+type traceEvent struct {
+	Name string
+	Time time.Time
+}
+
+// events returns the events that happened during the request, in the order
+// they happen in a request.
+func (s *httpTraceStats) events() []traceEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := []traceEvent{
+		{"get_conn", s.getConn},
+		{"dns_start", s.dnsStart},
+		{"dns_done", s.dnsDone},
+		{"connect_start", s.connectStart},
+		{"connect_done", s.connectDone},
+		{"tls_handshake_start", s.tlsStart},
+		{"tls_handshake_done", s.tlsDone},
+		{"got_conn", s.gotConn},
+		{"wrote_request", s.wroteRequest},
+		{"got_first_response_byte", s.gotFirstResponseByte},
+	}
+
+	var events []traceEvent
+	for _, e := range all {
+		if !e.Time.IsZero() {
+			events = append(events, e)
+		}
+	}
+	return events
 }
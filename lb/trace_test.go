@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tracedGet gets url with client, recording its trace.
+func tracedGet(client *http.Client, url string) (*httpTraceStats, error) {
+	var stats httpTraceStats
+	req, _ := http.NewRequestWithContext(WithHTTPTrace(context.Background(), &stats), "GET", url, nil)
+	resp, err := client.Do(req)
+	if err == nil {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	stats.Done()
+	return &stats, err
+}
+
+// phases returns the phases of s by name.
+func (s *httpTraceStats) phases() map[string]tracePhase {
+	return map[string]tracePhase{
+		"GetConn":  s.LatencyGetConn,
+		"DNS":      s.LatencyDNS,
+		"Connect":  s.LatencyConnect,
+		"TLS":      s.LatencyTLS,
+		"Request":  s.LatencyRequest,
+		"Backend":  s.LatencyBackend,
+		"Response": s.LatencyResponse,
+		"Total":    s.LatencyTotal,
+	}
+}
+
+// checkPhases verifies that exactly the phases in valid are valid, and
+// that no phase has a negative duration.
+func checkPhases(t *testing.T, name string, s *httpTraceStats, valid ...string) {
+	t.Helper()
+	want := make(map[string]bool)
+	for _, v := range valid {
+		want[v] = true
+	}
+	for phase, p := range s.phases() {
+		if p.Valid != want[phase] {
+			t.Errorf("%s: %s: got valid %t, want %t", name, phase, p.Valid, want[phase])
+		}
+		if p.Duration < 0 {
+			t.Errorf("%s: %s: got negative duration %v", name, phase, p.Duration)
+		}
+	}
+}
+
+func TestTraceNewAndReusedConnections(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+
+	// Use a host name, so there is a DNS lookup
+	url := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	first, err := tracedGet(client, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPhases(t, "first", first, "GetConn", "DNS", "Connect", "Request", "Backend", "Response", "Total")
+	if first.Reused {
+		t.Errorf("first: got reused, want new connection")
+	}
+
+	second, err := tracedGet(client, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPhases(t, "second", second, "GetConn", "Request", "Backend", "Response", "Total")
+	if !second.Reused || !second.WasIdle {
+		t.Errorf("second: got reused %t, was idle %t, want both", second.Reused, second.WasIdle)
+	}
+}
+
+func TestTraceTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	stats, err := tracedGet(ts.Client(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPhases(t, "tls", stats, "GetConn", "Connect", "TLS", "Request", "Backend", "Response", "Total")
+}
+
+// TestTraceConnectError verifies that the phases after a failed connect
+// are left invalid, rather than computed from unset times.
+func TestTraceConnectError(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL
+	ts.Close()
+
+	stats, err := tracedGet(&http.Client{Transport: &http.Transport{}}, url)
+	if err == nil {
+		t.Fatal("got no error, want connect error")
+	}
+	checkPhases(t, "connect error", stats, "Total")
+	if stats.ConnectErr == nil {
+		t.Errorf("got no ConnectErr, want one")
+	}
+	if got := stats.String(); !strings.Contains(got, "Connect(-)") || !strings.Contains(got, "ConnectErr(") {
+		t.Errorf("got '%s', want invalid Connect and ConnectErr", got)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"afe/config"
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the proxy's tracer, the instrumentation scope of its
+// spans.
+const tracerName = "afe/lb"
+
+// tracingServiceName is the service name spans are exported with.
+const tracingServiceName = "afe-lb"
+
+// Span attributes specific to the proxy.
+const (
+	serviceAttr      = attribute.Key("afe.service")
+	backendAttr      = attribute.Key("afe.backend")
+	errorReasonAttr  = attribute.Key("afe.error.reason")
+	requestIDAttr    = attribute.Key("afe.request_id")
+	regionAttr       = attribute.Key("afe.client.region")
+	connReusedAttr   = attribute.Key("afe.connection.reused")
+	connWasIdleAttr  = attribute.Key("afe.connection.was_idle")
+	connIdleTimeAttr = attribute.Key("afe.connection.idle_time_ms")
+	connectErrorAttr = attribute.Key("afe.connection.connect_error")
+)
+
+// propagator extracts the trace context from client requests and injects
+// it in to requests to backends. W3C traceparent and tracestate, and B3
+// single and multiple headers, are extracted. W3C takes precedence if a
+// request has both. W3C and B3 multiple headers are injected, along with
+// W3C baggage.
+var propagator = propagation.NewCompositeTextMapPropagator(
+	b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)),
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+// newTracerProvider returns a TracerProvider that exports spans to the
+// OTLP collector configured by cfg. The caller must shut it down, to
+// flush the spans that haven't been exported.
+func newTracerProvider(ctx context.Context, cfg config.Tracing) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating OTLP exporter for %s failed", cfg.Endpoint)
+	}
+
+	ratio := cfg.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracingServiceName))),
+	), nil
+}
+
+// startServerSpan starts the span for a request received by the proxy,
+// continuing the trace the request is part of, if any.
+func (proxy *Proxy) startServerSpan(req *http.Request) (context.Context, trace.Span) {
+	ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	return proxy.tracer.Start(ctx, "proxy "+req.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(methodClass(req.Method)),
+			semconv.URLPath(req.URL.Path),
+		),
+	)
+}
+
+// endSpan ends the span for a request that was responded to with status.
+// Only server errors are span errors, a client error is the client's
+// fault.
+func endSpan(span trace.Span, status int) {
+	if status != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// route returns the service for domain, or the service its requests from
+// a client at geo are sent to, tracing the lookup.
+func (proxy *Proxy) route(ctx context.Context, domain string, geo geoInfo) (*service, bool) {
+	_, span := proxy.tracer.Start(ctx, "route")
+	defer span.End()
+
+	table := proxy.routes()
+	svc, ok := table.services[domain]
+	if !ok {
+		span.SetStatus(codes.Error, "service not found")
+		return nil, false
+	}
+	if name, region, ok := svc.regionService(geo); ok {
+		if s, ok := table.service(name); ok {
+			span.SetAttributes(regionAttr.String(region))
+			svc = s
+		}
+	}
+	span.SetAttributes(serviceAttr.String(svc.name))
+	return svc, true
+}
+
+// pickBackend picks the backend svc's request is sent to, tracing the
+// choice.
+func (proxy *Proxy) pickBackend(ctx context.Context, svc *service) (*backendState, bool) {
+	_, span := proxy.tracer.Start(ctx, "pick backend", trace.WithAttributes(serviceAttr.String(svc.name)))
+	defer span.End()
+
+	b, ok := svc.pool.pick()
+	if !ok {
+		span.SetStatus(codes.Error, "no backend available")
+		return nil, false
+	}
+	span.SetAttributes(backendAttr.String(b.backend.String()))
+	return b, true
+}
+
+// startUpstreamSpan starts the span for the request to backend b. The
+// span's context is injected in to the request by the reverse proxy.
+func (proxy *Proxy) startUpstreamSpan(ctx context.Context, svc *service, b *backendState) (context.Context, trace.Span) {
+	return proxy.tracer.Start(ctx, "upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			serviceAttr.String(svc.name),
+			backendAttr.String(b.backend.String()),
+		),
+	)
+}
+
+// endUpstreamSpan ends the span for a request to a backend, which
+// responded with status, adding stats' connection details and events.
+func endUpstreamSpan(span trace.Span, stats *httpTraceStats, status int) {
+	for _, e := range stats.events() {
+		span.AddEvent(e.Name, trace.WithTimestamp(e.Time))
+	}
+
+	stats.mu.Lock()
+	if stats.LatencyGetConn.Valid {
+		span.SetAttributes(
+			connReusedAttr.Bool(stats.Reused),
+			connWasIdleAttr.Bool(stats.WasIdle),
+			connIdleTimeAttr.Int64(stats.IdleTime.Milliseconds()),
+		)
+	}
+	if stats.ConnectErr != nil {
+		span.SetAttributes(connectErrorAttr.String(stats.ConnectErr.Error()))
+	}
+	stats.mu.Unlock()
+
+	endSpan(span, status)
+}
+
+// injectTraceContext replaces the trace context headers copied from the
+// client's request with the context of req's span.
+func injectTraceContext(req *http.Request) {
+	for _, field := range propagator.Fields() {
+		req.Header.Del(field)
+	}
+	req.Header.Del("b3") // Extracted but not injected, so not a field
+	propagator.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// recordSpanError records on the span in ctx the reason the proxy
+// responded with an error, and err if not nil. Whether the span failed
+// depends on the status code, set by endSpan.
+func recordSpanError(ctx context.Context, reason string, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(errorReasonAttr.String(reason))
+	if err != nil {
+		span.RecordError(err)
+	}
+}
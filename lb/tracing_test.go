@@ -0,0 +1,180 @@
+package main
+
+import (
+	"afe/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingTestProxy returns a proxy for a service with the given backend
+// whose spans are recorded in the returned exporter.
+func tracingTestProxy(t *testing.T, backend *httptest.Server) (*Proxy, *tracetest.InMemoryExporter) {
+	testConfig := config.ProxyConfig{}
+	goldenConfig.Copy(&testConfig)
+	testConfig.Services[0].Hosts = []config.HostPort{backendHostPort(t, backend)}
+	proxy, errs := NewProxyFromConfig(&testConfig, okHealthCheck)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	proxy.tracer = tp.Tracer(tracerName)
+	return proxy, exporter
+}
+
+// spansByName returns the spans in exporter by name.
+func spansByName(exporter *tracetest.InMemoryExporter) map[string]tracetest.SpanStub {
+	spans := make(map[string]tracetest.SpanStub)
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = s
+	}
+	return spans
+}
+
+func TestTracingPropagation(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	var tests = []struct {
+		name    string
+		headers map[string]string
+	}{
+		{"W3C", map[string]string{
+			"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01",
+			"tracestate":  "vendor=value",
+		}},
+		{"B3 single", map[string]string{
+			"b3": traceID + "-00f067aa0ba902b7-1",
+		}},
+		{"B3 multiple", map[string]string{
+			"X-B3-TraceId": traceID,
+			"X-B3-SpanId":  "00f067aa0ba902b7",
+			"X-B3-Sampled": "1",
+		}},
+	}
+
+	for _, tt := range tests {
+		var got http.Header
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header.Clone()
+		}))
+		proxy, exporter := tracingTestProxy(t, backend)
+		ts := httptest.NewServer(proxy)
+
+		req, _ := http.NewRequest("GET", ts.URL+"/?s=my-service.my-company.com", nil)
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		ts.Close()
+		backend.Close()
+		proxy.Close()
+
+		spans := spansByName(exporter)
+		server, ok := spans["proxy GET"]
+		if !ok {
+			t.Fatalf("%s: no server span in %v", tt.name, spans)
+		}
+		if server.SpanContext.TraceID().String() != traceID {
+			t.Errorf("%s: got trace ID %s, want %s", tt.name, server.SpanContext.TraceID(), traceID)
+		}
+		if server.SpanKind != trace.SpanKindServer {
+			t.Errorf("%s: got server span kind %v", tt.name, server.SpanKind)
+		}
+
+		for _, name := range []string{"route", "pick backend", "upstream"} {
+			s, ok := spans[name]
+			if !ok {
+				t.Errorf("%s: no %s span", tt.name, name)
+				continue
+			}
+			if s.Parent.SpanID() != server.SpanContext.SpanID() {
+				t.Errorf("%s: %s span's parent is %s, want %s", tt.name, name, s.Parent.SpanID(), server.SpanContext.SpanID())
+			}
+		}
+
+		upstream := spans["upstream"]
+		var events []string
+		for _, e := range upstream.Events {
+			events = append(events, e.Name)
+		}
+		if len(events) == 0 || events[0] != "get_conn" || events[len(events)-1] != "got_first_response_byte" {
+			t.Errorf("%s: got upstream events %v", tt.name, events)
+		}
+
+		// The backend sees the upstream span as the parent, in both formats
+		wantParent := upstream.SpanContext.SpanID().String()
+		if got.Get("traceparent") != "00-"+traceID+"-"+wantParent+"-01" {
+			t.Errorf("%s: got traceparent %q, want parent %s", tt.name, got.Get("traceparent"), wantParent)
+		}
+		if got.Get("X-B3-TraceId") != traceID || got.Get("X-B3-SpanId") != wantParent {
+			t.Errorf("%s: got B3 %s/%s, want %s/%s", tt.name, got.Get("X-B3-TraceId"), got.Get("X-B3-SpanId"), traceID, wantParent)
+		}
+		if got.Get("b3") != "" {
+			t.Errorf("%s: got client's b3 header %q forwarded", tt.name, got.Get("b3"))
+		}
+	}
+}
+
+// TestTracingErrors verifies that requests the proxy fails are marked as
+// errors, with the reason.
+func TestTracingErrors(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	proxy, exporter := tracingTestProxy(t, closed)
+	closed.Close()
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	defer proxy.Close()
+
+	resp, err := http.Get(ts.URL + "/?s=my-service.my-company.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	spans := spansByName(exporter)
+	for _, name := range []string{"proxy GET", "upstream"} {
+		s := spans[name]
+		if s.Status.Code != codes.Error {
+			t.Errorf("%s: got status %v, want error", name, s.Status)
+		}
+	}
+	var reason string
+	for _, a := range spans["upstream"].Attributes {
+		if a.Key == errorReasonAttr {
+			reason = a.Value.AsString()
+		}
+	}
+	if reason != reasonConnectError {
+		t.Errorf("got reason %q, want %q", reason, reasonConnectError)
+	}
+
+	exporter.Reset()
+	resp, err = http.Get(ts.URL + "/?s=unknown.my-company.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	spans = spansByName(exporter)
+	if s := spans["route"]; s.Status.Code != codes.Error {
+		t.Errorf("route: got status %v, want error", s.Status)
+	}
+	// Not found is the client's fault, not the proxy's
+	if s := spans["proxy GET"]; s.Status.Code == codes.Error {
+		t.Errorf("proxy GET: got status %v, want unset", s.Status)
+	}
+}
@@ -0,0 +1,240 @@
+// Package logging configures leveled, structured logging with log/slog
+// for the lb and be programs.
+//
+// Loggers created by New add attributes stored in a context with
+// NewContext to every record logged with that context, so a request's
+// ID, for example, is added to every message about the request. Repeated
+// messages are rate-limited, so that a failure affecting every request
+// doesn't flood the log.
+package logging
+
+import (
+	"afe/config"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Rate limits applied to each message by New's loggers.
+const (
+	// DefaultBurst is the number of times a message is logged in each
+	// DefaultInterval before it is suppressed.
+	DefaultBurst = 10
+	// DefaultInterval is how long a message is rate-limited for.
+	DefaultInterval = 10 * time.Second
+)
+
+// SuppressedKey is the attribute that records how many times a message
+// was suppressed by the rate limit, added to the next time it's logged.
+const SuppressedKey = "suppressed"
+
+// New returns a logger that writes records at level or above to w in
+// format, config.LogText if empty. level can be changed while the logger
+// is in use.
+func New(w io.Writer, format string, level *slog.LevelVar) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	if format == config.LogJSON {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+
+	h = NewRateLimitHandler(h, DefaultBurst, DefaultInterval)
+	return slog.New(&contextHandler{h})
+}
+
+// Setup configures the default logger from cfg, logging to standard
+// error at level, which is set to the configured level.
+func Setup(cfg config.Logging, level *slog.LevelVar) error {
+	l, err := cfg.SlogLevel()
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	slog.SetDefault(New(os.Stderr, cfg.Format, level))
+	return nil
+}
+
+// Fatal logs msg and args at the error level and exits. It is for errors
+// starting a program, never for errors handling a request.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying args, as in slog.Logger.With,
+// which are added to every record logged with it.
+func NewContext(ctx context.Context, args ...any) context.Context {
+	attrs := append([]slog.Attr(nil), attrsFromContext(ctx)...)
+	r := slog.Record{}
+	r.Add(args...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return context.WithValue(ctx, contextKey{}, attrs)
+}
+
+func attrsFromContext(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(contextKey{}).([]slog.Attr)
+	return attrs
+}
+
+// A contextHandler adds the attributes stored by NewContext to records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs := attrsFromContext(ctx); len(attrs) > 0 {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+// A RateLimitHandler passes on each message at most burst times in each
+// interval. Messages at the debug level are never suppressed, as they
+// are only logged when asked for. Each message is limited separately,
+// whatever its attributes, so a message should be a constant with the
+// details in attributes.
+type RateLimitHandler struct {
+	slog.Handler
+	limits *rateLimits
+}
+
+// rateLimits is shared by a RateLimitHandler and those derived from it
+// with WithAttrs and WithGroup.
+type rateLimits struct {
+	burst    int
+	interval time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	messages map[string]*messageLimit
+}
+
+// A messageLimit is the state of a message's rate limit.
+type messageLimit struct {
+	start      time.Time
+	logged     int
+	suppressed int
+}
+
+// NewRateLimitHandler returns a handler that passes records on to h,
+// unless they are rate-limited.
+func NewRateLimitHandler(h slog.Handler, burst int, interval time.Duration) *RateLimitHandler {
+	return &RateLimitHandler{
+		Handler: h,
+		limits: &rateLimits{
+			burst:    burst,
+			interval: interval,
+			now:      time.Now,
+			messages: make(map[string]*messageLimit),
+		},
+	}
+}
+
+func (h *RateLimitHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level > slog.LevelDebug {
+		suppressed, ok := h.limits.allow(r.Level.String() + " " + r.Message)
+		if !ok {
+			return nil
+		}
+		if suppressed > 0 {
+			r = r.Clone()
+			r.AddAttrs(slog.Int(SuppressedKey, suppressed))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *RateLimitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &RateLimitHandler{Handler: h.Handler.WithAttrs(attrs), limits: h.limits}
+}
+
+func (h *RateLimitHandler) WithGroup(name string) slog.Handler {
+	return &RateLimitHandler{Handler: h.Handler.WithGroup(name), limits: h.limits}
+}
+
+// allow returns true if message can be logged now, and how many times it
+// was suppressed since it was last logged.
+func (l *rateLimits) allow(message string) (int, bool) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m, ok := l.messages[message]
+	if !ok {
+		m = &messageLimit{start: now}
+		l.messages[message] = m
+	}
+	if now.Sub(m.start) >= l.interval {
+		m.start, m.logged = now, 0
+	}
+	if m.logged >= l.burst {
+		m.suppressed++
+		return 0, false
+	}
+
+	m.logged++
+	suppressed := m.suppressed
+	m.suppressed = 0
+	return suppressed, true
+}
+
+// LevelHandler returns an http.Handler that reports level as JSON on GET,
+// and changes it to the "level" query parameter on PUT or POST.
+func LevelHandler(level *slog.LevelVar) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		code := http.StatusOK
+		resp := map[string]string{}
+
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var l slog.Level
+			if err := l.UnmarshalText([]byte(req.URL.Query().Get("level"))); err != nil {
+				code = http.StatusBadRequest
+				resp["error"] = err.Error()
+				break
+			}
+			if old := level.Level(); old != l {
+				level.Set(l)
+				slog.Warn("log level changed", "from", old, "to", l, "client", req.RemoteAddr)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		resp["level"] = level.Level().String()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("writing log level response failed", "err", err)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLogger returns a logger writing JSON to buf at level, limiting
+// each message to burst a minute by the clock set by the test.
+func newTestLogger(buf *bytes.Buffer, level *slog.LevelVar, burst int, now *time.Time) *slog.Logger {
+	h := NewRateLimitHandler(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: level}), burst, time.Minute)
+	h.limits.now = func() time.Time { return *now }
+	return slog.New(&contextHandler{h})
+}
+
+// records returns the records logged to buf.
+func records(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var got []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var r map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("got %s, %v", line, err)
+		}
+		got = append(got, r)
+	}
+	buf.Reset()
+	return got
+}
+
+func TestRateLimit(t *testing.T) {
+	var buf bytes.Buffer
+	var level slog.LevelVar
+	level.Set(slog.LevelDebug)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	logger := newTestLogger(&buf, &level, 2, &now)
+
+	var tests = []struct {
+		name    string
+		advance time.Duration
+		log     func()
+		want    int
+		// suppressed is the count on the last record, or 0 for none
+		suppressed float64
+	}{
+		{"burst", 0, func() { logger.Warn("failed", "n", 1); logger.Warn("failed", "n", 2) }, 2, 0},
+		{"suppressed", 0, func() { logger.Warn("failed"); logger.With("a", 1).Warn("failed") }, 0, 0},
+		{"other message", 0, func() { logger.Warn("other") }, 1, 0},
+		{"other level", 0, func() { logger.Error("failed") }, 1, 0},
+		{"debug", 0, func() {
+			for i := 0; i < 5; i++ {
+				logger.Debug("failed")
+			}
+		}, 5, 0},
+		{"next interval", time.Minute, func() { logger.Warn("failed") }, 1, 2},
+		{"count reset", 0, func() { logger.Warn("failed") }, 1, 0},
+	}
+
+	for _, tt := range tests {
+		now = now.Add(tt.advance)
+		tt.log()
+		got := records(t, &buf)
+		if len(got) != tt.want {
+			t.Errorf("%s: got %d records, want %d", tt.name, len(got), tt.want)
+			continue
+		}
+		if len(got) == 0 {
+			continue
+		}
+		last := got[len(got)-1]
+		if s, _ := last[SuppressedKey].(float64); s != tt.suppressed {
+			t.Errorf("%s: got %v suppressed, want %v", tt.name, last[SuppressedKey], tt.suppressed)
+		}
+	}
+}
+
+func TestNewContext(t *testing.T) {
+	var buf bytes.Buffer
+	var level slog.LevelVar
+	now := time.Now()
+	logger := newTestLogger(&buf, &level, DefaultBurst, &now)
+
+	ctx := NewContext(context.Background(), "request_id", "req-1")
+	ctx = NewContext(ctx, "service", "my-service")
+	logger.InfoContext(ctx, "routing request", "backend", "127.0.0.1:9090")
+	logger.InfoContext(context.Background(), "no context")
+
+	got := records(t, &buf)
+	if len(got) != 2 {
+		t.Fatalf("got %d records, want 2", len(got))
+	}
+	for k, want := range map[string]string{"request_id": "req-1", "service": "my-service", "backend": "127.0.0.1:9090"} {
+		if got[0][k] != want {
+			t.Errorf("got %s %v, want %s", k, got[0][k], want)
+		}
+	}
+	if _, ok := got[1]["request_id"]; ok {
+		t.Errorf("got request_id %v without a context, want none", got[1]["request_id"])
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	var level slog.LevelVar
+	h := LevelHandler(&level)
+
+	var tests = []struct {
+		method string
+		query  string
+		code   int
+		want   string
+	}{
+		{http.MethodGet, "", http.StatusOK, "INFO"},
+		{http.MethodPut, "level=debug", http.StatusOK, "DEBUG"},
+		{http.MethodGet, "", http.StatusOK, "DEBUG"},
+		{http.MethodPost, "level=WARN", http.StatusOK, "WARN"},
+		{http.MethodPut, "level=verbose", http.StatusBadRequest, "WARN"},
+		{http.MethodDelete, "", http.StatusMethodNotAllowed, "WARN"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, "/api/log/level?"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.query, w.Code, tt.code)
+		}
+		if got := level.Level().String(); got != tt.want {
+			t.Errorf("%s %s: got level %s, want %s", tt.method, tt.query, got, tt.want)
+		}
+		if w.Code == http.StatusMethodNotAllowed {
+			continue
+		}
+
+		var resp map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s %s: got %s, %v", tt.method, tt.query, w.Body.String(), err)
+			continue
+		}
+		if resp["level"] != tt.want {
+			t.Errorf("%s %s: got level %s in response, want %s", tt.method, tt.query, resp["level"], tt.want)
+		}
+		if _, hasErr := resp["error"]; hasErr != (tt.code == http.StatusBadRequest) {
+			t.Errorf("%s %s: got error %q", tt.method, tt.query, resp["error"])
+		}
+	}
+}